@@ -0,0 +1,166 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/admin"
+)
+
+func AdminCmd() error {
+	var adminAddress string
+
+	adminCmd := flag.NewFlagSet(os.Args[2], flag.ExitOnError)
+	adminCmd.StringVar(&adminAddress, "admin-address", "localhost:6666", "The address of the relay admin API (host:port or unix:/path)")
+	adminCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s [flags] <command[servers|sessions|metrics|unregister|drain|bans|ban|unban|credentials|set-credential|remove-credential]>\n", os.Args[0], os.Args[1], os.Args[2])
+		adminCmd.PrintDefaults()
+	}
+	adminCmd.Parse(os.Args[3:])
+
+	command := adminCmd.Arg(0)
+	if command == "" {
+		return fmt.Errorf("command is required")
+	}
+
+	client := admin.NewAdminClient(adminAddress)
+
+	switch command {
+	case "servers":
+		servers, err := client.Servers()
+		if err != nil {
+			return fmt.Errorf("error listing servers: %s", err.Error())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tADDRESS\tWEIGHT\tCONNECTIONS\tLAST PING")
+		for _, server := range servers {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s ago\n", server.Name, server.Address, server.Weight, server.Connections, time.Since(server.LastPing).Round(time.Second))
+		}
+		return w.Flush()
+	case "sessions":
+		sessions, err := client.Sessions()
+		if err != nil {
+			return fmt.Errorf("error listing sessions: %s", err.Error())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CLIENT\tSERVER\tSTARTED")
+		for _, session := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s ago\n", session.Client, session.Server, time.Since(session.Started).Round(time.Second))
+		}
+		return w.Flush()
+	case "metrics":
+		metrics, err := client.QueueMetrics()
+		if err != nil {
+			return fmt.Errorf("error getting metrics: %s", err.Error())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "QUEUE DEPTH\t%d\n", metrics.Depth)
+		names := make([]string, 0, len(metrics.Queues))
+		for name := range metrics.Queues {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %s\t%d/%d\n", name, metrics.Queues[name], metrics.Capacity)
+		}
+		fmt.Fprintf(w, "WAITING SERVERS\t%d\n", metrics.WaitingServers)
+		fmt.Fprintf(w, "ENQUEUED\t%d\n", metrics.Enqueued)
+		fmt.Fprintf(w, "EXPIRED\t%d\n", metrics.Expired)
+		fmt.Fprintf(w, "REJECTED\t%d\n", metrics.Rejected)
+		return w.Flush()
+	case "unregister":
+		name := adminCmd.Arg(1)
+		if name == "" {
+			return fmt.Errorf("name is required")
+		}
+		if err := client.Unregister(name); err != nil {
+			return fmt.Errorf("error unregistering %s: %s", name, err.Error())
+		}
+		fmt.Printf("Unregistered %s\n", name)
+	case "drain":
+		if err := client.Drain(); err != nil {
+			return fmt.Errorf("error draining relay: %s", err.Error())
+		}
+		fmt.Println("Draining")
+	case "bans":
+		bans, err := client.Bans()
+		if err != nil {
+			return fmt.Errorf("error listing bans: %s", err.Error())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tSINCE")
+		for _, ban := range bans {
+			fmt.Fprintf(w, "%s\t%s ago\n", ban.Host, time.Since(ban.Since).Round(time.Second))
+		}
+		return w.Flush()
+	case "ban":
+		host := adminCmd.Arg(1)
+		if host == "" {
+			return fmt.Errorf("host is required")
+		}
+		if err := client.Ban(host); err != nil {
+			return fmt.Errorf("error banning %s: %s", host, err.Error())
+		}
+		fmt.Printf("Banned %s\n", host)
+	case "unban":
+		host := adminCmd.Arg(1)
+		if host == "" {
+			return fmt.Errorf("host is required")
+		}
+		if err := client.Unban(host); err != nil {
+			return fmt.Errorf("error unbanning %s: %s", host, err.Error())
+		}
+		fmt.Printf("Unbanned %s\n", host)
+	case "credentials":
+		credentials, err := client.Credentials()
+		if err != nil {
+			return fmt.Errorf("error listing credentials: %s", err.Error())
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSINCE")
+		for _, credential := range credentials {
+			fmt.Fprintf(w, "%s\t%s ago\n", credential.Name, time.Since(credential.Since).Round(time.Second))
+		}
+		return w.Flush()
+	case "set-credential":
+		name := adminCmd.Arg(1)
+		if name == "" {
+			return fmt.Errorf("name is required")
+		}
+		// the token is read from stdin when it is not given, to keep it out of the process list
+		token := adminCmd.Arg(2)
+		if token == "" {
+			b, err := io.ReadAll(io.LimitReader(os.Stdin, 4096))
+			if err != nil {
+				return fmt.Errorf("error reading token: %s", err.Error())
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		if token == "" {
+			return fmt.Errorf("token is required")
+		}
+		if err := client.SetCredential(name, token); err != nil {
+			return fmt.Errorf("error setting credential of %s: %s", name, err.Error())
+		}
+		fmt.Printf("Set credential of %s\n", name)
+	case "remove-credential":
+		name := adminCmd.Arg(1)
+		if name == "" {
+			return fmt.Errorf("name is required")
+		}
+		if err := client.RemoveCredential(name); err != nil {
+			return fmt.Errorf("error removing credential of %s: %s", name, err.Error())
+		}
+		fmt.Printf("Removed credential of %s\n", name)
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	return nil
+}
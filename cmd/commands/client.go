@@ -1,32 +1,55 @@
 package commands
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 
+	"github.com/cbodonnell/net/pkg/agent"
 	"github.com/cbodonnell/net/pkg/net"
+	quicclient "github.com/cbodonnell/net/pkg/quic/client"
 	tcpclient "github.com/cbodonnell/net/pkg/tcp/client"
 	udpclient "github.com/cbodonnell/net/pkg/udp/client"
 )
 
 type ClientOpts struct {
-	Port         uint
-	RelayAddress string
-	ServerName   string
-	Key          []byte
-	BufferSize   uint
-	Debug        bool
+	Port            uint
+	RelayAddress    string
+	ServerName      string
+	Key             []byte
+	BufferSize      uint
+	Fragment        bool
+	MaxDatagramSize uint
+	PunchTimeout    string
+	Stream          bool
+	PunchRelay      string
+	Rendezvous      string
+	DialTimeout     string
+	Socks           bool
+	HTTPProxy       bool
+	UpstreamProxy   string
+	Stdio           bool
+	Debug           bool
 }
 
 func ClientCmd() error {
+	var configPath string
+	var statusAddress string
+
 	rootCmd := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	rootCmd.StringVar(&configPath, "config", "", "The path to a YAML, TOML or JSON file describing the tunnels to run")
+	rootCmd.StringVar(&statusAddress, "status-address", "", "The address to serve tunnel status on when running from a config (host:port or unix:/path)")
 	rootCmd.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s %s <network[tcp|udp]>\n", os.Args[0], os.Args[1])
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [--config <path>] <network[tcp|udp|quic]>\n", os.Args[0], os.Args[1])
 		rootCmd.PrintDefaults()
 	}
 	rootCmd.Parse(os.Args[2:])
 
+	if configPath != "" {
+		return runClientsFromConfig(configPath, statusAddress)
+	}
+
 	network := rootCmd.Arg(0)
 	if network == "" {
 		return fmt.Errorf("network is required")
@@ -34,11 +57,33 @@ func ClientCmd() error {
 
 	var port uint
 	var bufferSize uint
+	var fragment bool
+	var maxDatagramSize uint
+	var punchTimeout string
+	var stream bool
+	var punchRelay string
+	var rendezvous string
+	var dialTimeout string
+	var socks bool
+	var httpProxy bool
+	var upstreamProxy string
+	var stdio bool
 	var debug bool
 
 	clientCmd := flag.NewFlagSet(network, flag.ExitOnError)
 	clientCmd.UintVar(&port, "port", 2222, "The port to listen on")
 	clientCmd.UintVar(&bufferSize, "buffer-size", 1024, "The maximum size of the buffer")
+	clientCmd.BoolVar(&fragment, "fragment", false, "Fragment encrypted datagrams larger than the maximum datagram size (udp)")
+	clientCmd.UintVar(&maxDatagramSize, "max-datagram-size", 1400, "The maximum size of a datagram sent to the server when fragmenting (udp)")
+	clientCmd.StringVar(&punchTimeout, "punch-timeout", "5s", "The duration to wait for the relay to answer a punch")
+	clientCmd.BoolVar(&stream, "stream", false, "Accept TCP connections and stream them reliably over the punched path (udp)")
+	clientCmd.StringVar(&punchRelay, "punch-relay", "", "The address of a UDP relay to punch to the server through, falling back to the relay if it fails (tcp)")
+	clientCmd.StringVar(&rendezvous, "rendezvous", "", "The address of a TCP relay rendezvous to punch a TCP connection to the server through, tried before the punch relay and the relay (tcp)")
+	clientCmd.StringVar(&dialTimeout, "dial-timeout", "5s", "The duration to wait for the relay to connect and answer (quic)")
+	clientCmd.BoolVar(&socks, "socks", false, "Accept SOCKS5 clients and have the server connect to the destinations they ask for (tcp)")
+	clientCmd.BoolVar(&httpProxy, "http-proxy", false, "Accept HTTP proxy clients, with CONNECT or absolute URIs, and have the server connect to the hosts they ask for (tcp)")
+	clientCmd.StringVar(&upstreamProxy, "upstream-proxy", "", "The proxy to connect to the relay through, as http://, socks5:// or socks5h:// with optional user:password@, defaulting to HTTPS_PROXY or ALL_PROXY (tcp)")
+	clientCmd.BoolVar(&stdio, "stdio", false, "Tunnel a single session on stdin and stdout instead of listening on the port, as an SSH ProxyCommand (tcp)")
 	clientCmd.BoolVar(&debug, "debug", false, "Print debug messages")
 	clientCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s %s %s [flags] <relayAddress> <serverName>\n", os.Args[0], os.Args[1], os.Args[2])
@@ -58,12 +103,23 @@ func ClientCmd() error {
 	}
 
 	client, err := NewClient(network, ClientOpts{
-		Port:         port,
-		RelayAddress: relayAddress,
-		ServerName:   serverName,
-		Key:          []byte("passphrasewhichneedstobe32bytes!"),
-		BufferSize:   bufferSize,
-		Debug:        debug,
+		Port:            port,
+		RelayAddress:    relayAddress,
+		ServerName:      serverName,
+		Key:             []byte(defaultKey),
+		BufferSize:      bufferSize,
+		Fragment:        fragment,
+		MaxDatagramSize: maxDatagramSize,
+		PunchTimeout:    punchTimeout,
+		Stream:          stream,
+		PunchRelay:      punchRelay,
+		Rendezvous:      rendezvous,
+		DialTimeout:     dialTimeout,
+		Socks:           socks,
+		HTTPProxy:       httpProxy,
+		UpstreamProxy:   upstreamProxy,
+		Stdio:           stdio,
+		Debug:           debug,
 	})
 	if err != nil {
 		return fmt.Errorf("error creating client: %s", err.Error())
@@ -75,24 +131,121 @@ func ClientCmd() error {
 func NewClient(network string, opts ClientOpts) (net.Client, error) {
 	switch network {
 	case "tcp":
-		return tcpclient.NewTCPClient(tcpclient.TCPClientOpts{
-			Port:         opts.Port,
-			RelayAddress: opts.RelayAddress,
-			// ServerName:   opts.ServerName,
-			Key:        opts.Key,
-			BufferSize: opts.BufferSize,
-			Debug:      opts.Debug,
-		})
+		tcpOpts := tcpclient.TCPClientOpts{
+			Port:              opts.Port,
+			RelayAddress:      opts.RelayAddress,
+			ServerName:        opts.ServerName,
+			Key:               opts.Key,
+			BufferSize:        opts.BufferSize,
+			PunchRelayAddress: opts.PunchRelay,
+			RendezvousAddress: opts.Rendezvous,
+			PunchTimeout:      opts.PunchTimeout,
+			Socks:             opts.Socks,
+			HTTPProxy:         opts.HTTPProxy,
+			UpstreamProxy:     opts.UpstreamProxy,
+			Stdio:             opts.Stdio,
+			Debug:             opts.Debug,
+		}
+		// the session is on stdout, so the client logs to stderr
+		if opts.Stdio {
+			tcpOpts.Stdin = os.Stdin
+			tcpOpts.Stdout = os.Stdout
+			tcpOpts.Log = os.Stderr
+		}
+		return tcpclient.NewTCPClient(tcpOpts)
 	case "udp":
+		if opts.Socks || opts.HTTPProxy {
+			return nil, errors.New("proxying is not supported by the udp client")
+		}
+		if opts.UpstreamProxy != "" {
+			return nil, errors.New("an upstream proxy is not supported by the udp client")
+		}
+		if opts.Stdio {
+			return nil, errors.New("stdio is not supported by the udp client")
+		}
 		return udpclient.NewUDPClient(udpclient.UDPClientOpts{
+			Port:            opts.Port,
+			RelayAddress:    opts.RelayAddress,
+			ServerName:      opts.ServerName,
+			Key:             opts.Key,
+			BufferSize:      opts.BufferSize,
+			Fragment:        opts.Fragment,
+			MaxDatagramSize: opts.MaxDatagramSize,
+			PunchTimeout:    opts.PunchTimeout,
+			Stream:          opts.Stream,
+			Debug:           opts.Debug,
+		})
+	case "quic":
+		if opts.Socks || opts.HTTPProxy {
+			return nil, errors.New("proxying is not supported by the quic client")
+		}
+		if opts.UpstreamProxy != "" {
+			return nil, errors.New("an upstream proxy is not supported by the quic client")
+		}
+		if opts.Stdio {
+			return nil, errors.New("stdio is not supported by the quic client")
+		}
+		return quicclient.NewQUICClient(quicclient.QUICClientOpts{
 			Port:         opts.Port,
 			RelayAddress: opts.RelayAddress,
 			ServerName:   opts.ServerName,
 			Key:          opts.Key,
-			BufferSize:   opts.BufferSize,
+			DialTimeout:  opts.DialTimeout,
 			Debug:        opts.Debug,
 		})
 	default:
 		return nil, fmt.Errorf("unknown network: %s", network)
 	}
 }
+
+func runClientsFromConfig(configPath, statusAddress string) error {
+	config, err := LoadConfig(configPath, ClientMode)
+	if err != nil {
+		return err
+	}
+
+	debug := false
+	for _, tunnel := range config.Tunnels {
+		debug = debug || tunnel.Debug
+	}
+
+	a := agent.NewAgent(agent.AgentOpts{Debug: debug})
+	for _, tunnel := range config.Tunnels {
+		key, err := tunnel.Key.Load()
+		if err != nil {
+			return fmt.Errorf("tunnel %s: error loading key: %s", tunnel.Name, err.Error())
+		}
+
+		bufferSize := tunnel.BufferSize
+		if bufferSize == 0 {
+			bufferSize = 1024
+		}
+
+		client, err := NewClient(tunnel.Network, ClientOpts{
+			Port:            tunnel.Port,
+			RelayAddress:    tunnel.RelayAddress,
+			ServerName:      tunnel.ServerName,
+			Key:             key,
+			BufferSize:      bufferSize,
+			Fragment:        tunnel.Fragment,
+			MaxDatagramSize: tunnel.MaxDatagramSize,
+			PunchTimeout:    tunnel.PunchTimeout,
+			Stream:          tunnel.Stream,
+			PunchRelay:      tunnel.PunchRelayAddress,
+			Rendezvous:      tunnel.RendezvousAddress,
+			DialTimeout:     tunnel.DialTimeout,
+			Socks:           tunnel.Socks,
+			HTTPProxy:       tunnel.HTTPProxy,
+			UpstreamProxy:   tunnel.UpstreamProxy,
+			Debug:           tunnel.Debug,
+		})
+		if err != nil {
+			return fmt.Errorf("tunnel %s: error creating client: %s", tunnel.Name, err.Error())
+		}
+		if err := a.Add(tunnel.Name, tunnel.Network, client); err != nil {
+			return err
+		}
+	}
+
+	return runAgent(a, statusAddress, debug)
+}
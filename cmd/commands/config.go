@@ -0,0 +1,291 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cbodonnell/net/pkg/agent"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultKey is used by tunnels that do not configure a key source.
+const defaultKey = "passphrasewhichneedstobe32bytes!"
+
+// Config describes a set of tunnels run by a single client or server process.
+type Config struct {
+	Tunnels []TunnelConfig `yaml:"tunnels" toml:"tunnels" json:"tunnels"`
+}
+
+type TunnelConfig struct {
+	Name              string    `yaml:"name" toml:"name" json:"name"`
+	Network           string    `yaml:"network" toml:"network" json:"network"`
+	RelayAddress      string    `yaml:"relayAddress" toml:"relayAddress" json:"relayAddress"`
+	ServerName        string    `yaml:"serverName" toml:"serverName" json:"serverName"`
+	Port              uint      `yaml:"port" toml:"port" json:"port"`
+	ServerAddress     string    `yaml:"serverAddress" toml:"serverAddress" json:"serverAddress"`
+	Weight            uint      `yaml:"weight" toml:"weight" json:"weight"`
+	Credential        string    `yaml:"credential" toml:"credential" json:"credential"`
+	HealthCheck       string    `yaml:"healthCheck" toml:"healthCheck" json:"healthCheck"`
+	HealthInterval    string    `yaml:"healthInterval" toml:"healthInterval" json:"healthInterval"`
+	HealthTimeout     string    `yaml:"healthTimeout" toml:"healthTimeout" json:"healthTimeout"`
+	HealthThreshold   uint      `yaml:"healthThreshold" toml:"healthThreshold" json:"healthThreshold"`
+	Key               KeySource `yaml:"key" toml:"key" json:"key"`
+	BufferSize        uint      `yaml:"bufferSize" toml:"bufferSize" json:"bufferSize"`
+	Fragment          bool      `yaml:"fragment" toml:"fragment" json:"fragment"`
+	MaxDatagramSize   uint      `yaml:"maxDatagramSize" toml:"maxDatagramSize" json:"maxDatagramSize"`
+	RetryDuration     string    `yaml:"retryDuration" toml:"retryDuration" json:"retryDuration"`
+	MaxRetryDuration  string    `yaml:"maxRetryDuration" toml:"maxRetryDuration" json:"maxRetryDuration"`
+	CircuitThreshold  uint      `yaml:"circuitThreshold" toml:"circuitThreshold" json:"circuitThreshold"`
+	RegisterTimeout   string    `yaml:"registerTimeout" toml:"registerTimeout" json:"registerTimeout"`
+	PingInterval      string    `yaml:"pingInterval" toml:"pingInterval" json:"pingInterval"`
+	PingTimeout       string    `yaml:"pingTimeout" toml:"pingTimeout" json:"pingTimeout"`
+	PunchTimeout      string    `yaml:"punchTimeout" toml:"punchTimeout" json:"punchTimeout"`
+	Stream            bool      `yaml:"stream" toml:"stream" json:"stream"`
+	PunchRelayAddress string    `yaml:"punchRelayAddress" toml:"punchRelayAddress" json:"punchRelayAddress"`
+	RendezvousAddress string    `yaml:"rendezvousAddress" toml:"rendezvousAddress" json:"rendezvousAddress"`
+	DialTimeout       string    `yaml:"dialTimeout" toml:"dialTimeout" json:"dialTimeout"`
+	ListenAddress     string    `yaml:"listenAddress" toml:"listenAddress" json:"listenAddress"`
+	Socks             bool      `yaml:"socks" toml:"socks" json:"socks"`
+	HTTPProxy         bool      `yaml:"httpProxy" toml:"httpProxy" json:"httpProxy"`
+	Allow             []string  `yaml:"allow" toml:"allow" json:"allow"`
+	Public            bool      `yaml:"public" toml:"public" json:"public"`
+	ProxyProtocol     string    `yaml:"proxyProtocol" toml:"proxyProtocol" json:"proxyProtocol"`
+	UpstreamProxy     string    `yaml:"upstreamProxy" toml:"upstreamProxy" json:"upstreamProxy"`
+	Debug             bool      `yaml:"debug" toml:"debug" json:"debug"`
+}
+
+// KeySource is where a tunnel reads its key from. At most one of the
+// fields may be set.
+type KeySource struct {
+	Value string `yaml:"value" toml:"value" json:"value"`
+	File  string `yaml:"file" toml:"file" json:"file"`
+	Env   string `yaml:"env" toml:"env" json:"env"`
+}
+
+// Mode is whether a config describes the tunnels of a client or of a server.
+type Mode string
+
+const (
+	ClientMode Mode = "client"
+	ServerMode Mode = "server"
+)
+
+// LoadConfig reads a config file and validates its tunnels for the mode.
+// Files ending in .json are decoded as JSON, files ending in .toml as TOML,
+// and everything else as YAML.
+func LoadConfig(path string, mode Mode) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %s", err.Error())
+	}
+
+	config := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(b, config)
+	case ".toml":
+		err = toml.Unmarshal(b, config)
+	default:
+		err = yaml.Unmarshal(b, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config: %s", err.Error())
+	}
+
+	if len(config.Tunnels) == 0 {
+		return nil, fmt.Errorf("no tunnels in config")
+	}
+
+	names := make(map[string]bool)
+	ports := make(map[uint]string)
+	for i, tunnel := range config.Tunnels {
+		if tunnel.Name == "" {
+			return nil, fmt.Errorf("tunnel %d: name is required", i)
+		}
+		if names[tunnel.Name] {
+			return nil, fmt.Errorf("tunnel %s: duplicate name", tunnel.Name)
+		}
+		names[tunnel.Name] = true
+
+		if err := tunnel.validate(mode); err != nil {
+			return nil, fmt.Errorf("tunnel %s: %s", tunnel.Name, err.Error())
+		}
+		// the client tunnels of a process can't listen on the same port
+		if mode == ClientMode {
+			if other, ok := ports[tunnel.Port]; ok {
+				return nil, fmt.Errorf("tunnel %s: port %d is already used by tunnel %s", tunnel.Name, tunnel.Port, other)
+			}
+			ports[tunnel.Port] = tunnel.Name
+		}
+
+		if tunnel.ServerName == "" {
+			config.Tunnels[i].ServerName = tunnel.Name
+		}
+	}
+
+	return config, nil
+}
+
+// validate checks a tunnel on its own, rejecting the options of the other
+// mode so that a server config isn't silently run as a client or the reverse.
+func (t TunnelConfig) validate(mode Mode) error {
+	switch t.Network {
+	case "":
+		return errors.New("network is required")
+	case "tcp", "udp", "quic":
+	default:
+		return fmt.Errorf("unknown network: %s", t.Network)
+	}
+	if t.RelayAddress == "" {
+		return errors.New("relayAddress is required")
+	}
+
+	switch mode {
+	case ClientMode:
+		if t.Port == 0 || t.Port > 65535 {
+			return fmt.Errorf("port must be between 1 and 65535, got %d", t.Port)
+		}
+		if option := t.serverOption(); option != "" {
+			return fmt.Errorf("%s is only for servers", option)
+		}
+	case ServerMode:
+		// with an allowlist, clients choose the destination instead
+		if t.ServerAddress == "" && len(t.Allow) == 0 {
+			return errors.New("serverAddress is required")
+		}
+		if t.ServerAddress != "" {
+			if err := validateAddress(t.ServerAddress); err != nil {
+				return fmt.Errorf("invalid serverAddress: %s", err.Error())
+			}
+		}
+		if t.ListenAddress != "" {
+			if err := validateAddress(t.ListenAddress); err != nil {
+				return fmt.Errorf("invalid listenAddress: %s", err.Error())
+			}
+		}
+		if option := t.clientOption(); option != "" {
+			return fmt.Errorf("%s is only for clients", option)
+		}
+	default:
+		return fmt.Errorf("unknown mode: %s", mode)
+	}
+	return nil
+}
+
+// clientOption returns the name of an option set on the tunnel that only
+// clients take, if any.
+func (t TunnelConfig) clientOption() string {
+	switch {
+	case t.Port != 0:
+		return "port"
+	case t.PunchTimeout != "":
+		return "punchTimeout"
+	case t.DialTimeout != "":
+		return "dialTimeout"
+	case t.Socks:
+		return "socks"
+	case t.HTTPProxy:
+		return "httpProxy"
+	}
+	return ""
+}
+
+// serverOption returns the name of an option set on the tunnel that only
+// servers take, if any.
+func (t TunnelConfig) serverOption() string {
+	switch {
+	case t.ServerAddress != "":
+		return "serverAddress"
+	case t.Weight != 0:
+		return "weight"
+	case t.Credential != "":
+		return "credential"
+	case t.HealthCheck != "":
+		return "healthCheck"
+	case t.RetryDuration != "":
+		return "retryDuration"
+	case t.MaxRetryDuration != "":
+		return "maxRetryDuration"
+	case t.CircuitThreshold != 0:
+		return "circuitThreshold"
+	case t.RegisterTimeout != "":
+		return "registerTimeout"
+	case t.PingInterval != "":
+		return "pingInterval"
+	case t.PingTimeout != "":
+		return "pingTimeout"
+	case t.ListenAddress != "":
+		return "listenAddress"
+	case len(t.Allow) > 0:
+		return "allow"
+	case t.Public:
+		return "public"
+	case t.ProxyProtocol != "":
+		return "proxyProtocol"
+	}
+	return ""
+}
+
+// validateAddress checks that an address has a port in range, with the host
+// left out for the local host.
+func validateAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port in %s", address)
+	}
+	return nil
+}
+
+// Load returns the key described by the source.
+func (k KeySource) Load() ([]byte, error) {
+	switch {
+	case k.Value != "" && (k.File != "" || k.Env != ""), k.File != "" && k.Env != "":
+		return nil, fmt.Errorf("only one of value, file or env may be set")
+	case k.Value != "":
+		return []byte(k.Value), nil
+	case k.File != "":
+		b, err := ioutil.ReadFile(k.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key file: %s", err.Error())
+		}
+		return []byte(strings.TrimSpace(string(b))), nil
+	case k.Env != "":
+		value, ok := os.LookupEnv(k.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", k.Env)
+		}
+		return []byte(value), nil
+	default:
+		return []byte(defaultKey), nil
+	}
+}
+
+// runAgent runs the tunnels of an agent, serving their status if an address is given.
+func runAgent(a *agent.Agent, statusAddress string, debug bool) error {
+	if statusAddress != "" {
+		statusServer := agent.NewStatusServer(agent.StatusServerOpts{
+			Address: statusAddress,
+			Agent:   a,
+			Debug:   debug,
+		})
+		go func() {
+			if err := statusServer.Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "status server stopped: %s\n", err.Error())
+			}
+		}()
+	}
+
+	return a.Run()
+}
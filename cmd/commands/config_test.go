@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	want := &Config{Tunnels: []TunnelConfig{
+		{
+			Name:          "box1",
+			Network:       "udp",
+			RelayAddress:  "relay.example.com:3333",
+			ServerName:    "box1",
+			ServerAddress: "localhost:22",
+			Weight:        2,
+			Key:           KeySource{File: "/etc/net/box1.key"},
+		},
+		{
+			Name:         "proxy",
+			Network:      "tcp",
+			RelayAddress: "relay1.example.com:3333,relay2.example.com:3333",
+			ServerName:   "office",
+			Allow:        []string{"*.example.com:443", "10.0.0.0/8"},
+		},
+	}}
+
+	for _, path := range []string{"testdata/tunnels.json", "testdata/tunnels.toml", "testdata/tunnels.yaml"} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			config, err := LoadConfig(path, ServerMode)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if !reflect.DeepEqual(config, want) {
+				t.Fatalf("got %+v, want %+v", config, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    Mode
+		config  string
+		wantErr string
+	}{
+		{"client", ClientMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, port: 2222, socks: true}
+  - {name: game, network: udp, relayAddress: relay:3333, port: 2223, punchTimeout: 5s}
+`, ""},
+		{"server", ServerMode, `
+tunnels:
+  - {name: ssh, network: quic, relayAddress: relay:3333, serverAddress: "[::1]:22", listenAddress: ":4433"}
+`, ""},
+		{"no tunnels", ServerMode, "tunnels: []", "no tunnels"},
+		{"not a config", ServerMode, "tunnels: {", "error parsing config"},
+		{"missing name", ServerMode, `
+tunnels:
+  - {network: tcp, relayAddress: relay:3333, serverAddress: localhost:22}
+`, "name is required"},
+		{"duplicate name", ServerMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, serverAddress: localhost:22}
+  - {name: ssh, network: udp, relayAddress: relay:3333, serverAddress: localhost:22}
+`, "duplicate name"},
+		{"missing network", ServerMode, `
+tunnels:
+  - {name: ssh, relayAddress: relay:3333, serverAddress: localhost:22}
+`, "network is required"},
+		{"unknown network", ServerMode, `
+tunnels:
+  - {name: ssh, network: sctp, relayAddress: relay:3333, serverAddress: localhost:22}
+`, "unknown network"},
+		{"missing relay address", ServerMode, `
+tunnels:
+  - {name: ssh, network: tcp, serverAddress: localhost:22}
+`, "relayAddress is required"},
+		{"missing port", ClientMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333}
+`, "port must be between"},
+		{"port out of range", ClientMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, port: 70000}
+`, "port must be between"},
+		{"duplicate port", ClientMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, port: 2222}
+  - {name: web, network: quic, relayAddress: relay:3333, port: 2222}
+`, "already used by tunnel ssh"},
+		{"server option on a client", ClientMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, port: 2222, serverAddress: localhost:22}
+`, "serverAddress is only for servers"},
+		{"missing server address", ServerMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333}
+`, "serverAddress is required"},
+		{"server address without a port", ServerMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, serverAddress: localhost}
+`, "invalid serverAddress"},
+		{"server address port out of range", ServerMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, serverAddress: "localhost:0"}
+`, "invalid serverAddress"},
+		{"bad listen address", ServerMode, `
+tunnels:
+  - {name: ssh, network: quic, relayAddress: relay:3333, serverAddress: localhost:22, listenAddress: "4433"}
+`, "invalid listenAddress"},
+		{"client option on a server", ServerMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, serverAddress: localhost:22, port: 2222}
+`, "port is only for clients"},
+		{"proxy client option on a server", ServerMode, `
+tunnels:
+  - {name: ssh, network: tcp, relayAddress: relay:3333, allow: ["*"], socks: true}
+`, "socks is only for clients"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tunnels.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			_, err := LoadConfig(path, tt.mode)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,26 +1,50 @@
 package commands
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/cbodonnell/net/pkg/net"
+	quicrelay "github.com/cbodonnell/net/pkg/quic/relay"
 	tcprelay "github.com/cbodonnell/net/pkg/tcp/relay"
 	udprelay "github.com/cbodonnell/net/pkg/udp/relay"
 )
 
 type RelayOpts struct {
-	ClientPort uint
-	ServerPort uint
-	BufferSize uint
-	Debug      bool
+	ClientPort       uint
+	ServerPort       uint
+	RendezvousPort   uint
+	HTTPPort         uint
+	TLSPort          uint
+	ProxyProtocol    bool
+	WebSocketAddress string
+	WebSocketPath    string
+	WebSocketCert    string
+	WebSocketKey     string
+	BufferSize       uint
+	QueueSize        uint
+	QueueTimeout     string
+	EvictionTimeout  string
+	SessionTimeout   string
+	AdminAddress     string
+	Policy           string
+	Sticky           bool
+	ClusterAddress   string
+	AdvertiseHost    string
+	Peers            []string
+	ClusterSecret    string
+	StateFile        string
+	GracePeriod      string
+	Debug            bool
 }
 
 func RelayCmd() error {
 	rootCmd := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
 	rootCmd.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s %s <network[tcp|udp]>\n", os.Args[0], os.Args[1])
+		fmt.Fprintf(os.Stderr, "Usage: %s %s <network[tcp|udp|quic]|admin>\n", os.Args[0], os.Args[1])
 		rootCmd.PrintDefaults()
 	}
 	rootCmd.Parse(os.Args[2:])
@@ -30,15 +54,61 @@ func RelayCmd() error {
 		return fmt.Errorf("network is required")
 	}
 
+	if network == "admin" {
+		return AdminCmd()
+	}
+
 	var clientPort uint
 	var serverPort uint
+	var rendezvousPort uint
+	var httpPort uint
+	var tlsPort uint
+	var proxyProtocol bool
+	var websocketAddress string
+	var websocketPath string
+	var websocketCert string
+	var websocketKey string
 	var bufferSize uint
+	var queueSize uint
+	var queueTimeout string
+	var evictionTimeout string
+	var sessionTimeout string
+	var adminAddress string
+	var policy string
+	var sticky bool
+	var clusterAddress string
+	var advertiseHost string
+	var peers string
+	var clusterSecret string
+	var stateFile string
+	var gracePeriod string
 	var debug bool
 
 	relayCmd := flag.NewFlagSet(network, flag.ExitOnError)
 	relayCmd.UintVar(&clientPort, "client-port", 3333, "The port to listen for the client on")
 	relayCmd.UintVar(&serverPort, "server-port", 4444, "The port to listen for the server on")
+	relayCmd.UintVar(&rendezvousPort, "rendezvous-port", 0, "The port to coordinate hole punching between clients and servers on, disabled if 0 (tcp)")
+	relayCmd.UintVar(&httpPort, "http-port", 0, "The port to accept public HTTP clients on, routed by Host to the public server registered under it, disabled if 0 (tcp)")
+	relayCmd.UintVar(&tlsPort, "tls-port", 0, "The port to accept public TLS clients on, routed by SNI to the public server registered under it, disabled if 0 (tcp)")
+	relayCmd.BoolVar(&proxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol header from a load balancer in front of the client and virtual host ports (tcp)")
+	relayCmd.StringVar(&websocketAddress, "websocket-address", "", "The address to accept clients and servers on over WebSocket, as an alternative to the client and server ports, disabled if empty (tcp)")
+	relayCmd.StringVar(&websocketPath, "websocket-path", "/", "The HTTP path to accept WebSockets on (tcp)")
+	relayCmd.StringVar(&websocketCert, "websocket-cert", "", "The certificate to serve WebSockets over TLS (wss) with, served without TLS (ws) if empty (tcp)")
+	relayCmd.StringVar(&websocketKey, "websocket-key", "", "The private key of the WebSocket certificate (tcp)")
 	relayCmd.UintVar(&bufferSize, "buffer-size", 1024, "The maximum size of the buffer")
+	relayCmd.UintVar(&queueSize, "queue-size", 64, "The maximum number of client requests waiting for a server (tcp)")
+	relayCmd.StringVar(&queueTimeout, "queue-timeout", "10s", "The duration a client request waits for a server before it fails (tcp)")
+	relayCmd.StringVar(&evictionTimeout, "eviction-timeout", "10s", "The duration without a ping after which a server is unregistered (udp)")
+	relayCmd.StringVar(&sessionTimeout, "session-timeout", "10m", "The duration after a punch during which a client counts against its server for balancing (udp)")
+	relayCmd.StringVar(&adminAddress, "admin-address", "", "The address to serve the admin API on (host:port or unix:/path), disabled if empty")
+	relayCmd.StringVar(&policy, "balance", "round-robin", "How to spread clients across servers registered under the same name (round-robin|least-conn|weighted)")
+	relayCmd.BoolVar(&sticky, "sticky", false, "Keep sending a client to the server it was sent to before while that server is available")
+	relayCmd.StringVar(&clusterAddress, "cluster-address", "", "The address to listen for other relays in the cluster on, disabled if empty (tcp|udp)")
+	relayCmd.StringVar(&advertiseHost, "advertise-host", "", "The host other relays in the cluster reach this one at, defaults to the cluster address host or the hostname")
+	relayCmd.StringVar(&peers, "peers", "", "A comma separated list of the cluster addresses of the other relays in the cluster")
+	relayCmd.StringVar(&clusterSecret, "cluster-secret", os.Getenv("NET_CLUSTER_SECRET"), "The secret the relays in the cluster share to authenticate each other, required unless the cluster address is loopback, defaulting to NET_CLUSTER_SECRET")
+	relayCmd.StringVar(&stateFile, "state-file", "", "The file to keep registrations in across restarts, disabled if empty (udp)")
+	relayCmd.StringVar(&gracePeriod, "grace-period", "30s", "The duration after a restart during which servers may reclaim their registrations (udp)")
 	relayCmd.BoolVar(&debug, "debug", false, "Print debug messages")
 	relayCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s %s %s [flags]\n", os.Args[0], os.Args[1], os.Args[2])
@@ -47,10 +117,31 @@ func RelayCmd() error {
 	relayCmd.Parse(os.Args[3:])
 
 	relay, err := NewRelay(network, RelayOpts{
-		ClientPort: clientPort,
-		ServerPort: serverPort,
-		BufferSize: bufferSize,
-		Debug:      debug,
+		ClientPort:       clientPort,
+		ServerPort:       serverPort,
+		RendezvousPort:   rendezvousPort,
+		HTTPPort:         httpPort,
+		TLSPort:          tlsPort,
+		ProxyProtocol:    proxyProtocol,
+		WebSocketAddress: websocketAddress,
+		WebSocketPath:    websocketPath,
+		WebSocketCert:    websocketCert,
+		WebSocketKey:     websocketKey,
+		BufferSize:       bufferSize,
+		QueueSize:        queueSize,
+		QueueTimeout:     queueTimeout,
+		EvictionTimeout:  evictionTimeout,
+		SessionTimeout:   sessionTimeout,
+		AdminAddress:     adminAddress,
+		Policy:           policy,
+		Sticky:           sticky,
+		ClusterAddress:   clusterAddress,
+		AdvertiseHost:    advertiseHost,
+		Peers:            splitList(peers),
+		ClusterSecret:    clusterSecret,
+		StateFile:        stateFile,
+		GracePeriod:      gracePeriod,
+		Debug:            debug,
 	})
 	if err != nil {
 		return fmt.Errorf("error creating relay: %s", err.Error())
@@ -63,19 +154,76 @@ func NewRelay(network string, opts RelayOpts) (net.Relay, error) {
 	switch network {
 	case "tcp":
 		return tcprelay.NewTCPRelay(tcprelay.TCPRelayOpts{
-			ClientPort: opts.ClientPort,
-			ServerPort: opts.ServerPort,
-			BufferSize: opts.BufferSize,
-			Debug:      opts.Debug,
-		}), nil
+			ClientPort:       opts.ClientPort,
+			ServerPort:       opts.ServerPort,
+			RendezvousPort:   opts.RendezvousPort,
+			HTTPPort:         opts.HTTPPort,
+			TLSPort:          opts.TLSPort,
+			ProxyProtocol:    opts.ProxyProtocol,
+			WebSocketAddress: opts.WebSocketAddress,
+			WebSocketPath:    opts.WebSocketPath,
+			WebSocketCert:    opts.WebSocketCert,
+			WebSocketKey:     opts.WebSocketKey,
+			BufferSize:       opts.BufferSize,
+			QueueSize:        opts.QueueSize,
+			QueueTimeout:     opts.QueueTimeout,
+			AdminAddress:     opts.AdminAddress,
+			Policy:           opts.Policy,
+			Sticky:           opts.Sticky,
+			ClusterAddress:   opts.ClusterAddress,
+			AdvertiseHost:    opts.AdvertiseHost,
+			Peers:            opts.Peers,
+			ClusterSecret:    opts.ClusterSecret,
+			Debug:            opts.Debug,
+		})
 	case "udp":
+		if opts.WebSocketAddress != "" {
+			return nil, errors.New("WebSockets are not supported by the udp relay")
+		}
 		return udprelay.NewUDPRelay(udprelay.UDPRelayOpts{
-			ClientPort: opts.ClientPort,
-			ServerPort: opts.ServerPort,
-			BufferSize: opts.BufferSize,
-			Debug:      opts.Debug,
-		}), nil
+			ClientPort:      opts.ClientPort,
+			ServerPort:      opts.ServerPort,
+			BufferSize:      opts.BufferSize,
+			EvictionTimeout: opts.EvictionTimeout,
+			SessionTimeout:  opts.SessionTimeout,
+			AdminAddress:    opts.AdminAddress,
+			Policy:          opts.Policy,
+			Sticky:          opts.Sticky,
+			ClusterAddress:  opts.ClusterAddress,
+			AdvertiseHost:   opts.AdvertiseHost,
+			Peers:           opts.Peers,
+			ClusterSecret:   opts.ClusterSecret,
+			StateFile:       opts.StateFile,
+			GracePeriod:     opts.GracePeriod,
+			Debug:           opts.Debug,
+		})
+	case "quic":
+		if opts.ClusterAddress != "" {
+			return nil, errors.New("clustering is not supported by the quic relay")
+		}
+		if opts.WebSocketAddress != "" {
+			return nil, errors.New("WebSockets are not supported by the quic relay")
+		}
+		return quicrelay.NewQUICRelay(quicrelay.QUICRelayOpts{
+			ClientPort:   opts.ClientPort,
+			ServerPort:   opts.ServerPort,
+			AdminAddress: opts.AdminAddress,
+			Policy:       opts.Policy,
+			Sticky:       opts.Sticky,
+			Debug:        opts.Debug,
+		})
 	default:
 		return nil, fmt.Errorf("unknown network: %s", network)
 	}
 }
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
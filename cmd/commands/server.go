@@ -1,49 +1,131 @@
 package commands
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 
+	"github.com/cbodonnell/net/pkg/agent"
 	"github.com/cbodonnell/net/pkg/net"
+	quicserver "github.com/cbodonnell/net/pkg/quic/server"
 	tcpserver "github.com/cbodonnell/net/pkg/tcp/server"
 	udpserver "github.com/cbodonnell/net/pkg/udp/server"
 )
 
 type ServerOpts struct {
-	RelayAddress  string
-	ServerAddress string
-	ServerName    string
-	Key           []byte
-	RetryDuration string
-	Debug         bool
+	RelayAddress     string
+	ServerAddress    string
+	ServerName       string
+	Weight           uint
+	Credential       string
+	Key              []byte
+	BufferSize       uint
+	Fragment         bool
+	MaxDatagramSize  uint
+	RetryDuration    string
+	MaxRetryDuration string
+	CircuitThreshold uint
+	RegisterTimeout  string
+	PingInterval     string
+	PingTimeout      string
+	Stream           bool
+	PunchRelay       string
+	Rendezvous       string
+	ListenAddress    string
+	HealthCheck      string
+	HealthInterval   string
+	HealthTimeout    string
+	HealthThreshold  uint
+	Allow            []string
+	Public           bool
+	ProxyProtocol    string
+	UpstreamProxy    string
+	Debug            bool
 }
 
 func ServerCmd() error {
+	var configPath string
+	var statusAddress string
+
 	rootCmd := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	rootCmd.StringVar(&configPath, "config", "", "The path to a YAML, TOML or JSON file describing the tunnels to run")
+	rootCmd.StringVar(&statusAddress, "status-address", "", "The address to serve tunnel status on when running from a config (host:port or unix:/path)")
 	rootCmd.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s %s <network[tcp|udp]>\n", os.Args[0], os.Args[1])
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [--config <path>] <network[tcp|udp|quic]>\n", os.Args[0], os.Args[1])
 		rootCmd.PrintDefaults()
 	}
 	rootCmd.Parse(os.Args[2:])
 
+	if configPath != "" {
+		return runServersFromConfig(configPath, statusAddress)
+	}
+
 	network := rootCmd.Arg(0)
 	if network == "" {
 		return fmt.Errorf("network is required")
 	}
 
+	var bufferSize uint
+	var fragment bool
+	var maxDatagramSize uint
 	var retryDuration string
+	var maxRetryDuration string
+	var circuitThreshold uint
+	var registerTimeout string
+	var pingInterval string
+	var pingTimeout string
+	var stream bool
+	var punchRelay string
+	var rendezvous string
+	var listenAddress string
+	var weight uint
+	var credential string
+	var healthCheck string
+	var healthInterval string
+	var healthTimeout string
+	var healthThreshold uint
+	var allow string
+	var public bool
+	var proxyProtocol string
+	var upstreamProxy string
 	var debug bool
 
 	serverCmd := flag.NewFlagSet(network, flag.ExitOnError)
-	serverCmd.StringVar(&retryDuration, "retry-duration", "1s", "The duration to wait between retries")
+	serverCmd.UintVar(&bufferSize, "buffer-size", 1024, "The maximum size of a datagram to or from the server (udp)")
+	serverCmd.BoolVar(&fragment, "fragment", false, "Fragment encrypted datagrams larger than the maximum datagram size (udp)")
+	serverCmd.UintVar(&maxDatagramSize, "max-datagram-size", 1400, "The maximum size of a datagram sent to clients when fragmenting (udp)")
+	serverCmd.StringVar(&retryDuration, "retry-duration", "1s", "The duration to wait before the first retry, doubling with each failure")
+	serverCmd.StringVar(&maxRetryDuration, "max-retry-duration", "30s", "The longest duration to wait between retries")
+	serverCmd.UintVar(&circuitThreshold, "circuit-threshold", 5, "The number of failures in a row that open the circuit to the relay")
+	serverCmd.StringVar(&registerTimeout, "register-timeout", "5s", "The duration to wait for the relay to confirm a registration (udp)")
+	serverCmd.StringVar(&pingInterval, "ping-interval", "5s", "The duration to wait between pings to the relay (udp)")
+	serverCmd.StringVar(&pingTimeout, "ping-timeout", "5s", "The duration to wait for the relay to answer a ping (udp)")
+	serverCmd.BoolVar(&stream, "stream", false, "Accept reliable streams over the punched path and connect them to a TCP server (udp)")
+	serverCmd.StringVar(&punchRelay, "punch-relay", "", "The address of a UDP relay to accept punched streams through (tcp)")
+	serverCmd.StringVar(&rendezvous, "rendezvous", "", "The address of a TCP relay rendezvous to accept punched TCP connections through (tcp)")
+	serverCmd.StringVar(&listenAddress, "listen", "", "The address to also accept connections from clients on directly (quic)")
+	serverCmd.UintVar(&weight, "weight", 1, "The share of clients this server gets relative to others under the same name with weighted balancing")
+	serverCmd.StringVar(&credential, "credential", "", "The token the relay requires to register under the server name, defaulting to NET_CREDENTIAL (udp)")
+	serverCmd.StringVar(&healthCheck, "health-check", "", "Check the server and only register while it is healthy (tcp|udp|udp:<payload>|http[:<path>]|<url>)")
+	serverCmd.StringVar(&healthInterval, "health-interval", "5s", "The duration to wait between health checks")
+	serverCmd.StringVar(&healthTimeout, "health-timeout", "2s", "The duration to wait for a health check to complete")
+	serverCmd.UintVar(&healthThreshold, "health-threshold", 2, "The number of health checks in a row it takes to mark the server healthy or unhealthy")
+	serverCmd.StringVar(&allow, "allow", "", "A comma separated list of destinations clients may ask to connect to instead of the server address, as host[:port] with names, *.domain wildcards, addresses or CIDR ranges (tcp)")
+	serverCmd.BoolVar(&public, "public", false, "Serve the relay's public HTTP and TLS clients for the host named by the server name, streamed as they are without the tunnel's encryption (tcp)")
+	serverCmd.StringVar(&proxyProtocol, "proxy-protocol", "", "Send each client's address to the server in a PROXY protocol header (v1|v2), disabled if empty (tcp)")
+	serverCmd.StringVar(&upstreamProxy, "upstream-proxy", "", "The proxy to connect to the relay through, as http://, socks5:// or socks5h:// with optional user:password@, defaulting to HTTPS_PROXY or ALL_PROXY (tcp)")
 	serverCmd.BoolVar(&debug, "debug", false, "Print debug messages")
 	serverCmd.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s %s %s [flags] <relayAddress> <serverName> <serverAddress>\n", os.Args[0], os.Args[1], os.Args[2])
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s [flags] <relayAddress> <serverName> [serverAddress]\n", os.Args[0], os.Args[1], os.Args[2])
 		serverCmd.PrintDefaults()
 	}
 	serverCmd.Parse(os.Args[3:])
 
+	if credential == "" && network == "udp" {
+		credential = os.Getenv("NET_CREDENTIAL")
+	}
+
 	relayAddress := serverCmd.Arg(0)
 	if relayAddress == "" {
 		return fmt.Errorf("relayAddress is required")
@@ -54,18 +136,41 @@ func ServerCmd() error {
 		return fmt.Errorf("serverName is required")
 	}
 
+	// clients choose the destination when there is an allowlist
 	serverAddress := serverCmd.Arg(2)
-	if serverAddress == "" {
+	if serverAddress == "" && allow == "" {
 		return fmt.Errorf("serverAddress is required")
 	}
 
 	server, err := NewServer(network, ServerOpts{
-		RelayAddress:  relayAddress,
-		ServerAddress: serverAddress,
-		ServerName:    serverName,
-		Key:           []byte("passphrasewhichneedstobe32bytes!"),
-		RetryDuration: retryDuration,
-		Debug:         debug,
+		RelayAddress:     relayAddress,
+		ServerAddress:    serverAddress,
+		ServerName:       serverName,
+		Weight:           weight,
+		Credential:       credential,
+		Key:              []byte(defaultKey),
+		BufferSize:       bufferSize,
+		Fragment:         fragment,
+		MaxDatagramSize:  maxDatagramSize,
+		RetryDuration:    retryDuration,
+		MaxRetryDuration: maxRetryDuration,
+		CircuitThreshold: circuitThreshold,
+		RegisterTimeout:  registerTimeout,
+		PingInterval:     pingInterval,
+		PingTimeout:      pingTimeout,
+		Stream:           stream,
+		PunchRelay:       punchRelay,
+		Rendezvous:       rendezvous,
+		ListenAddress:    listenAddress,
+		HealthCheck:      healthCheck,
+		HealthInterval:   healthInterval,
+		HealthTimeout:    healthTimeout,
+		HealthThreshold:  healthThreshold,
+		Allow:            splitList(allow),
+		Public:           public,
+		ProxyProtocol:    proxyProtocol,
+		UpstreamProxy:    upstreamProxy,
+		Debug:            debug,
 	})
 	if err != nil {
 		return fmt.Errorf("error creating server: %s", err.Error())
@@ -77,24 +182,158 @@ func ServerCmd() error {
 func NewServer(network string, opts ServerOpts) (net.Server, error) {
 	switch network {
 	case "tcp":
+		if opts.Credential != "" {
+			return nil, errors.New("credentials are not supported by the tcp server")
+		}
 		return tcpserver.NewTCPServer(tcpserver.TCPServerOpts{
-			RelayAddress:  opts.RelayAddress,
-			ServerAddress: opts.ServerAddress,
-			// ServerName:    opts.ServerName,
-			Key:           opts.Key,
-			RetryDuration: opts.RetryDuration,
-			Debug:         opts.Debug,
+			RelayAddress:      opts.RelayAddress,
+			ServerAddress:     opts.ServerAddress,
+			ServerName:        opts.ServerName,
+			Weight:            opts.Weight,
+			Key:               opts.Key,
+			RetryDuration:     opts.RetryDuration,
+			MaxRetryDuration:  opts.MaxRetryDuration,
+			CircuitThreshold:  opts.CircuitThreshold,
+			PunchRelayAddress: opts.PunchRelay,
+			RendezvousAddress: opts.Rendezvous,
+			HealthCheck:       opts.HealthCheck,
+			HealthInterval:    opts.HealthInterval,
+			HealthTimeout:     opts.HealthTimeout,
+			HealthThreshold:   opts.HealthThreshold,
+			Allow:             opts.Allow,
+			Public:            opts.Public,
+			ProxyProtocol:     opts.ProxyProtocol,
+			UpstreamProxy:     opts.UpstreamProxy,
+			Debug:             opts.Debug,
 		})
 	case "udp":
+		if len(opts.Allow) > 0 {
+			return nil, errors.New("an allowlist is not supported by the udp server")
+		}
+		if opts.Public {
+			return nil, errors.New("public serving is not supported by the udp server")
+		}
+		if opts.ProxyProtocol != "" {
+			return nil, errors.New("the PROXY protocol is not supported by the udp server")
+		}
+		if opts.UpstreamProxy != "" {
+			return nil, errors.New("an upstream proxy is not supported by the udp server")
+		}
 		return udpserver.NewUDPServer(udpserver.UDPServerOpts{
-			RelayAddress:  opts.RelayAddress,
-			ServerAddress: opts.ServerAddress,
-			ServerName:    opts.ServerName,
-			Key:           opts.Key,
-			RetryDuration: opts.RetryDuration,
-			Debug:         opts.Debug,
+			RelayAddress:     opts.RelayAddress,
+			ServerAddress:    opts.ServerAddress,
+			ServerName:       opts.ServerName,
+			Weight:           opts.Weight,
+			Credential:       opts.Credential,
+			Key:              opts.Key,
+			BufferSize:       opts.BufferSize,
+			Fragment:         opts.Fragment,
+			MaxDatagramSize:  opts.MaxDatagramSize,
+			RetryDuration:    opts.RetryDuration,
+			MaxRetryDuration: opts.MaxRetryDuration,
+			CircuitThreshold: opts.CircuitThreshold,
+			RegisterTimeout:  opts.RegisterTimeout,
+			PingInterval:     opts.PingInterval,
+			PingTimeout:      opts.PingTimeout,
+			Stream:           opts.Stream,
+			HealthCheck:      opts.HealthCheck,
+			HealthInterval:   opts.HealthInterval,
+			HealthTimeout:    opts.HealthTimeout,
+			HealthThreshold:  opts.HealthThreshold,
+			Debug:            opts.Debug,
+		})
+	case "quic":
+		if len(opts.Allow) > 0 {
+			return nil, errors.New("an allowlist is not supported by the quic server")
+		}
+		if opts.Public {
+			return nil, errors.New("public serving is not supported by the quic server")
+		}
+		if opts.ProxyProtocol != "" {
+			return nil, errors.New("the PROXY protocol is not supported by the quic server")
+		}
+		if opts.UpstreamProxy != "" {
+			return nil, errors.New("an upstream proxy is not supported by the quic server")
+		}
+		if opts.Credential != "" {
+			return nil, errors.New("credentials are not supported by the quic server")
+		}
+		return quicserver.NewQUICServer(quicserver.QUICServerOpts{
+			RelayAddress:     opts.RelayAddress,
+			ServerAddress:    opts.ServerAddress,
+			ServerName:       opts.ServerName,
+			Weight:           opts.Weight,
+			ListenAddress:    opts.ListenAddress,
+			Key:              opts.Key,
+			RetryDuration:    opts.RetryDuration,
+			MaxRetryDuration: opts.MaxRetryDuration,
+			CircuitThreshold: opts.CircuitThreshold,
+			HealthCheck:      opts.HealthCheck,
+			HealthInterval:   opts.HealthInterval,
+			HealthTimeout:    opts.HealthTimeout,
+			HealthThreshold:  opts.HealthThreshold,
+			Debug:            opts.Debug,
 		})
 	default:
 		return nil, fmt.Errorf("unknown network: %s", network)
 	}
 }
+
+func runServersFromConfig(configPath, statusAddress string) error {
+	config, err := LoadConfig(configPath, ServerMode)
+	if err != nil {
+		return err
+	}
+
+	debug := false
+	for _, tunnel := range config.Tunnels {
+		debug = debug || tunnel.Debug
+	}
+
+	a := agent.NewAgent(agent.AgentOpts{Debug: debug})
+	for _, tunnel := range config.Tunnels {
+		key, err := tunnel.Key.Load()
+		if err != nil {
+			return fmt.Errorf("tunnel %s: error loading key: %s", tunnel.Name, err.Error())
+		}
+
+		server, err := NewServer(tunnel.Network, ServerOpts{
+			RelayAddress:     tunnel.RelayAddress,
+			ServerAddress:    tunnel.ServerAddress,
+			ServerName:       tunnel.ServerName,
+			Weight:           tunnel.Weight,
+			Credential:       tunnel.Credential,
+			Key:              key,
+			BufferSize:       tunnel.BufferSize,
+			Fragment:         tunnel.Fragment,
+			MaxDatagramSize:  tunnel.MaxDatagramSize,
+			RetryDuration:    tunnel.RetryDuration,
+			MaxRetryDuration: tunnel.MaxRetryDuration,
+			CircuitThreshold: tunnel.CircuitThreshold,
+			RegisterTimeout:  tunnel.RegisterTimeout,
+			PingInterval:     tunnel.PingInterval,
+			PingTimeout:      tunnel.PingTimeout,
+			Stream:           tunnel.Stream,
+			PunchRelay:       tunnel.PunchRelayAddress,
+			Rendezvous:       tunnel.RendezvousAddress,
+			ListenAddress:    tunnel.ListenAddress,
+			HealthCheck:      tunnel.HealthCheck,
+			HealthInterval:   tunnel.HealthInterval,
+			HealthTimeout:    tunnel.HealthTimeout,
+			HealthThreshold:  tunnel.HealthThreshold,
+			Allow:            tunnel.Allow,
+			Public:           tunnel.Public,
+			ProxyProtocol:    tunnel.ProxyProtocol,
+			UpstreamProxy:    tunnel.UpstreamProxy,
+			Debug:            tunnel.Debug,
+		})
+		if err != nil {
+			return fmt.Errorf("tunnel %s: error creating server: %s", tunnel.Name, err.Error())
+		}
+		if err := a.Add(tunnel.Name, tunnel.Network, server); err != nil {
+			return err
+		}
+	}
+
+	return runAgent(a, statusAddress, debug)
+}
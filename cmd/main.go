@@ -14,14 +14,18 @@ func main() {
 
 	command := os.Args[1]
 
+	var err error
 	switch command {
 	case "client":
-		log.Fatal(commands.ClientCmd())
+		err = commands.ClientCmd()
 	case "server":
-		log.Fatal(commands.ServerCmd())
+		err = commands.ServerCmd()
 	case "relay":
-		log.Fatal(commands.RelayCmd())
+		err = commands.RelayCmd()
 	default:
 		log.Fatalf("Unknown command: %s\n", command)
 	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,7 +1,32 @@
 package main
 
-import "github.com/cbodonnell/net/pkg/ssh"
+import (
+	"log"
+	"os"
+
+	"github.com/cbodonnell/net/pkg/ssh"
+)
 
 func main() {
-	ssh.Client()
+	client, err := ssh.Dial(ssh.SSHClientOpts{
+		Address:         "localhost:2022",
+		User:            "testuser",
+		KeyFiles:        []string{"./id_ed25519_client"},
+		KnownHosts:      "./known_hosts",
+		TrustOnFirstUse: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	result, err := client.Run("/usr/bin/whoami")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(result.Stdout)
+	os.Stderr.Write(result.Stderr)
+	if result.ExitStatus != 0 {
+		os.Exit(result.ExitStatus)
+	}
 }
@@ -1,7 +1,20 @@
 package main
 
-import "github.com/cbodonnell/net/pkg/ssh"
+import (
+	"log"
+
+	"github.com/cbodonnell/net/pkg/ssh"
+)
 
 func main() {
-	ssh.Server()
+	server, err := ssh.NewSSHServer(ssh.SSHServerOpts{
+		ListenAddress:  ":2022",
+		HostKeys:       []string{"./id_ed25519"},
+		AuthorizedKeys: "./authorized_keys",
+		Debug:          true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(server.Run())
 }
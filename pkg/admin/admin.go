@@ -0,0 +1,338 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotRegistered is returned by a Relay when asked to unregister
+// a name that it does not know about.
+var ErrNotRegistered = errors.New("not registered")
+
+// ErrNotFound is returned by an AccessRelay when asked to remove a ban or
+// credential that it does not have.
+var ErrNotFound = errors.New("not found")
+
+type ServerInfo struct {
+	Name        string    `json:"name"`
+	Address     string    `json:"address"`
+	LastPing    time.Time `json:"lastPing"`
+	Weight      int       `json:"weight,omitempty"`
+	Connections int       `json:"connections"`
+}
+
+type SessionInfo struct {
+	Client  string    `json:"client"`
+	Server  string    `json:"server"`
+	Started time.Time `json:"started"`
+}
+
+// QueueMetrics describes a relay's queue of client requests waiting for a server.
+type QueueMetrics struct {
+	Depth          int    `json:"depth"`
+	Capacity       int    `json:"capacity"`
+	WaitingServers int    `json:"waitingServers"`
+	Enqueued       uint64 `json:"enqueued"`
+	Expired        uint64 `json:"expired"`
+	Rejected       uint64 `json:"rejected"`
+	// Queues is the depth of the queue for each server name.
+	Queues map[string]int `json:"queues,omitempty"`
+}
+
+// BanInfo is a host whose requests a relay rejects.
+type BanInfo struct {
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+// CredentialInfo is a name that servers need a token to register under.
+// The token itself is never returned.
+type CredentialInfo struct {
+	Name  string    `json:"name"`
+	Since time.Time `json:"since"`
+}
+
+// Relay is implemented by the relays that can be managed through the admin API.
+type Relay interface {
+	Servers() []ServerInfo
+	Sessions() []SessionInfo
+	Unregister(name string) error
+	Drain() error
+}
+
+// QueueRelay is implemented by relays that queue client requests until a
+// server picks them up.
+type QueueRelay interface {
+	QueueMetrics() QueueMetrics
+}
+
+// AccessRelay is implemented by relays that can ban hosts and require
+// credentials to register names.
+type AccessRelay interface {
+	Bans() []BanInfo
+	Ban(host string) error
+	Unban(host string) error
+	Credentials() []CredentialInfo
+	SetCredential(name, token string) error
+	RemoveCredential(name string) error
+}
+
+type AdminServer struct {
+	address string
+	relay   Relay
+	debug   bool
+}
+
+type AdminServerOpts struct {
+	Address string
+	Relay   Relay
+	Debug   bool
+}
+
+func NewAdminServer(opts AdminServerOpts) *AdminServer {
+	return &AdminServer{
+		address: opts.Address,
+		relay:   opts.Relay,
+		debug:   opts.Debug,
+	}
+}
+
+func (s *AdminServer) Run() error {
+	listener, err := Listen(s.address)
+	if err != nil {
+		return fmt.Errorf("error listening for admin requests: %s", err.Error())
+	}
+	defer listener.Close()
+
+	if s.debug {
+		log.Printf("Listening for admin requests on %s\n", listener.Addr().String())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/servers", s.handleServers)
+	mux.HandleFunc("/servers/", s.handleServer)
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/drain", s.handleDrain)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/bans", s.handleBans)
+	mux.HandleFunc("/bans/", s.handleBan)
+	mux.HandleFunc("/credentials", s.handleCredentials)
+	mux.HandleFunc("/credentials/", s.handleCredential)
+
+	return http.Serve(listener, mux)
+}
+
+func (s *AdminServer) handleServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.relay.Servers())
+}
+
+func (s *AdminServer) handleServer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/servers/")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.relay.Unregister(name); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrNotRegistered) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if s.debug {
+		log.Printf("[ADMIN] unregistered %s\n", name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.relay.Sessions())
+}
+
+func (s *AdminServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.relay.Drain(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.debug {
+		log.Println("[ADMIN] draining")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relay, ok := s.relay.(QueueRelay)
+	if !ok {
+		http.Error(w, "relay has no queue", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, relay.QueueMetrics())
+}
+
+// accessRelay returns the relay if it has access control, answering the
+// request otherwise.
+func (s *AdminServer) accessRelay(w http.ResponseWriter) (AccessRelay, bool) {
+	relay, ok := s.relay.(AccessRelay)
+	if !ok {
+		http.Error(w, "relay has no access control", http.StatusNotFound)
+	}
+	return relay, ok
+}
+
+func (s *AdminServer) handleBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relay, ok := s.accessRelay(w)
+	if !ok {
+		return
+	}
+	writeJSON(w, relay.Bans())
+}
+
+func (s *AdminServer) handleBan(w http.ResponseWriter, r *http.Request) {
+	relay, ok := s.accessRelay(w)
+	if !ok {
+		return
+	}
+	host := strings.TrimPrefix(r.URL.Path, "/bans/")
+	if host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if err := relay.Ban(host); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.debug {
+			log.Printf("[ADMIN] banned %s\n", host)
+		}
+	case http.MethodDelete:
+		if err := relay.Unban(host); err != nil {
+			writeAccessError(w, err)
+			return
+		}
+		if s.debug {
+			log.Printf("[ADMIN] unbanned %s\n", host)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relay, ok := s.accessRelay(w)
+	if !ok {
+		return
+	}
+	writeJSON(w, relay.Credentials())
+}
+
+// handleCredential sets the token for a name from the request body, or
+// removes it.
+func (s *AdminServer) handleCredential(w http.ResponseWriter, r *http.Request) {
+	relay, ok := s.accessRelay(w)
+	if !ok {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/credentials/")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		b, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := relay.SetCredential(name, strings.TrimSpace(string(b))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.debug {
+			log.Printf("[ADMIN] set credential for %s\n", name)
+		}
+	case http.MethodDelete:
+		if err := relay.RemoveCredential(name); err != nil {
+			writeAccessError(w, err)
+			return
+		}
+		if s.debug {
+			log.Printf("[ADMIN] removed credential for %s\n", name)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAccessError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrNotFound) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing admin response: %s\n", err.Error())
+	}
+}
+
+// Listen listens on a TCP address, or on a Unix socket
+// if the address is prefixed with "unix:".
+func Listen(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		// remove a stale socket left behind by a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
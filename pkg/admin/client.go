@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type AdminClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewAdminClient(address string) *AdminClient {
+	network := "tcp"
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		network, address = "unix", path
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &AdminClient{
+		// the host is ignored since every request is dialed to the admin address
+		baseURL: "http://relay",
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, address)
+				},
+			},
+		},
+	}
+}
+
+func (c *AdminClient) Servers() ([]ServerInfo, error) {
+	var servers []ServerInfo
+	if err := c.do(http.MethodGet, "/servers", &servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+func (c *AdminClient) Sessions() ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	if err := c.do(http.MethodGet, "/sessions", &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (c *AdminClient) QueueMetrics() (*QueueMetrics, error) {
+	var metrics QueueMetrics
+	if err := c.do(http.MethodGet, "/metrics", &metrics); err != nil {
+		return nil, err
+	}
+	return &metrics, nil
+}
+
+func (c *AdminClient) Unregister(name string) error {
+	return c.do(http.MethodDelete, "/servers/"+url.PathEscape(name), nil)
+}
+
+func (c *AdminClient) Drain() error {
+	return c.do(http.MethodPost, "/drain", nil)
+}
+
+func (c *AdminClient) Bans() ([]BanInfo, error) {
+	var bans []BanInfo
+	if err := c.do(http.MethodGet, "/bans", &bans); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+func (c *AdminClient) Ban(host string) error {
+	return c.do(http.MethodPut, "/bans/"+url.PathEscape(host), nil)
+}
+
+func (c *AdminClient) Unban(host string) error {
+	return c.do(http.MethodDelete, "/bans/"+url.PathEscape(host), nil)
+}
+
+func (c *AdminClient) Credentials() ([]CredentialInfo, error) {
+	var credentials []CredentialInfo
+	if err := c.do(http.MethodGet, "/credentials", &credentials); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// SetCredential requires servers to present a token to register under a name.
+func (c *AdminClient) SetCredential(name, token string) error {
+	return c.send(http.MethodPut, "/credentials/"+url.PathEscape(name), strings.NewReader(token), nil)
+}
+
+func (c *AdminClient) RemoveCredential(name string) error {
+	return c.do(http.MethodDelete, "/credentials/"+url.PathEscape(name), nil)
+}
+
+func (c *AdminClient) do(method, path string, v interface{}) error {
+	return c.send(method, path, nil, v)
+}
+
+func (c *AdminClient) send(method, path string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("error creating request: %s", err.Error())
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("relay returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding response: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/backoff"
+)
+
+// ErrUnknownTunnel is returned when a tunnel name is not managed by the agent.
+var ErrUnknownTunnel = errors.New("unknown tunnel")
+
+// Service is a client or server that runs until its context is done.
+type Service interface {
+	Serve(ctx context.Context) error
+}
+
+// CircuitService is a service that reports the state of its circuit to the relay.
+type CircuitService interface {
+	Circuit() backoff.State
+}
+
+type State string
+
+const (
+	StateRunning    State = "running"
+	StateRestarting State = "restarting"
+	StateStopped    State = "stopped"
+)
+
+type TunnelStatus struct {
+	Name      string        `json:"name"`
+	Network   string        `json:"network"`
+	State     State         `json:"state"`
+	Since     time.Time     `json:"since"`
+	Restarts  int           `json:"restarts"`
+	LastError string        `json:"lastError,omitempty"`
+	Circuit   backoff.State `json:"circuit,omitempty"`
+}
+
+type tunnel struct {
+	service Service
+	status  TunnelStatus
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Agent runs a set of tunnels, each with its own lifecycle. A tunnel that
+// fails is restarted without affecting the others.
+type Agent struct {
+	retryDuration time.Duration
+	debug         bool
+	mu            sync.Mutex
+	tunnels       map[string]*tunnel
+	ctx           context.Context
+}
+
+type AgentOpts struct {
+	RetryDuration time.Duration
+	Debug         bool
+}
+
+func NewAgent(opts AgentOpts) *Agent {
+	retryDuration := opts.RetryDuration
+	if retryDuration == 0 {
+		retryDuration = 5 * time.Second
+	}
+
+	return &Agent{
+		retryDuration: retryDuration,
+		debug:         opts.Debug,
+		tunnels:       make(map[string]*tunnel),
+	}
+}
+
+// Add adds a tunnel to the agent. Tunnels added before Run are started by
+// Run, tunnels added afterwards must be started with Start.
+func (a *Agent) Add(name, network string, service Service) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.tunnels[name]; ok {
+		return fmt.Errorf("tunnel %s already exists", name)
+	}
+	a.tunnels[name] = &tunnel{
+		service: service,
+		status: TunnelStatus{
+			Name:    name,
+			Network: network,
+			State:   StateStopped,
+			Since:   time.Now(),
+		},
+	}
+	return nil
+}
+
+func (a *Agent) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	a.Serve(ctx)
+	return errors.New("interrupted")
+}
+
+// Serve starts every tunnel and stops them all once the context is done.
+func (a *Agent) Serve(ctx context.Context) error {
+	a.mu.Lock()
+	a.ctx = ctx
+	names := make([]string, 0, len(a.tunnels))
+	for name := range a.tunnels {
+		names = append(names, name)
+	}
+	a.mu.Unlock()
+
+	for _, name := range names {
+		if err := a.Start(name); err != nil {
+			return err
+		}
+	}
+
+	<-ctx.Done()
+
+	// wait for every tunnel, including ones started after Serve, to exit
+	a.mu.Lock()
+	names = names[:0]
+	for name := range a.tunnels {
+		names = append(names, name)
+	}
+	a.mu.Unlock()
+	for _, name := range names {
+		a.Stop(name)
+	}
+	return ctx.Err()
+}
+
+// Start starts a stopped tunnel.
+func (a *Agent) Start(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ctx == nil {
+		return errors.New("agent is not running")
+	}
+
+	t, ok := a.tunnels[name]
+	if !ok {
+		return fmt.Errorf("%s: %w", name, ErrUnknownTunnel)
+	}
+	if t.cancel != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(a.ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	a.setState(t, StateRunning, nil)
+
+	go a.supervise(ctx, t)
+	return nil
+}
+
+// Stop stops a running tunnel and waits for it to exit.
+func (a *Agent) Stop(name string) error {
+	a.mu.Lock()
+	t, ok := a.tunnels[name]
+	if !ok {
+		a.mu.Unlock()
+		return fmt.Errorf("%s: %w", name, ErrUnknownTunnel)
+	}
+	cancel, done := t.cancel, t.done
+	a.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+	return nil
+}
+
+// Status returns the status of every tunnel ordered by name.
+func (a *Agent) Status() []TunnelStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	statuses := make([]TunnelStatus, 0, len(a.tunnels))
+	for _, t := range a.tunnels {
+		status := t.status
+		if s, ok := t.service.(CircuitService); ok {
+			status.Circuit = s.Circuit()
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// supervise runs a tunnel and restarts it when it fails.
+func (a *Agent) supervise(ctx context.Context, t *tunnel) {
+	defer func() {
+		a.mu.Lock()
+		t.cancel = nil
+		a.setState(t, StateStopped, nil)
+		a.mu.Unlock()
+		close(t.done)
+	}()
+
+	for {
+		err := t.service.Serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+
+		a.mu.Lock()
+		t.status.Restarts++
+		a.setState(t, StateRestarting, err)
+		a.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.retryDuration):
+		}
+
+		a.mu.Lock()
+		a.setState(t, StateRunning, nil)
+		a.mu.Unlock()
+	}
+}
+
+// setState records a state change. The caller must hold a.mu.
+func (a *Agent) setState(t *tunnel, state State, err error) {
+	t.status.State = state
+	t.status.Since = time.Now()
+	if err != nil {
+		t.status.LastError = err.Error()
+		fmt.Fprintf(os.Stderr, "[%s] %s: %s\n", t.status.Name, state, err.Error())
+		return
+	}
+	if a.debug {
+		log.Printf("[%s] %s\n", t.status.Name, state)
+	}
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cbodonnell/net/pkg/admin"
+)
+
+// StatusServer reports the status of an agent's tunnels over HTTP
+// and allows them to be stopped and started individually.
+type StatusServer struct {
+	address string
+	agent   *Agent
+	debug   bool
+}
+
+type StatusServerOpts struct {
+	Address string
+	Agent   *Agent
+	Debug   bool
+}
+
+func NewStatusServer(opts StatusServerOpts) *StatusServer {
+	return &StatusServer{
+		address: opts.Address,
+		agent:   opts.Agent,
+		debug:   opts.Debug,
+	}
+}
+
+func (s *StatusServer) Run() error {
+	listener, err := admin.Listen(s.address)
+	if err != nil {
+		return fmt.Errorf("error listening for status requests: %s", err.Error())
+	}
+	defer listener.Close()
+
+	if s.debug {
+		log.Printf("Listening for status requests on %s\n", listener.Addr().String())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", s.handleTunnels)
+	mux.HandleFunc("/tunnels/", s.handleTunnel)
+
+	return http.Serve(listener, mux)
+}
+
+func (s *StatusServer) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.agent.Status()); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing status response: %s\n", err.Error())
+	}
+}
+
+// handleTunnel handles POST /tunnels/{name}/start and POST /tunnels/{name}/stop.
+func (s *StatusServer) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/tunnels/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := path[:i], path[i+1:]
+
+	var err error
+	switch action {
+	case "start":
+		err = s.agent.Start(name)
+	case "stop":
+		err = s.agent.Stop(name)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUnknownTunnel) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+package backoff
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// State is the state of the circuit to the relay.
+type State string
+
+const (
+	// StateClosed is the normal state, attempts back off exponentially.
+	StateClosed State = "closed"
+	// StateOpen follows threshold failures in a row, the next attempt
+	// waits for the longest delay.
+	StateOpen State = "open"
+	// StateHalfOpen is an open circuit whose delay has passed, the next
+	// attempt decides whether it closes or opens again.
+	StateHalfOpen State = "half-open"
+)
+
+// Backoff computes how long to wait before trying to reach the relay again.
+// Delays double from min up to max and are jittered, so that agents cut off
+// by the same relay restart don't all come back at the same moment.
+//
+// It is also a circuit breaker, which opens after threshold failures in a row
+// and closes again on the first success.
+type Backoff struct {
+	min       time.Duration
+	max       time.Duration
+	threshold int
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+}
+
+type BackoffOpts struct {
+	Min       string
+	Max       string
+	Threshold uint
+}
+
+func NewBackoff(opts BackoffOpts) (*Backoff, error) {
+	min := time.Second
+	if opts.Min != "" {
+		var err error
+		min, err = time.ParseDuration(opts.Min)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing retry duration: %s", err.Error())
+		}
+	}
+
+	max := time.Second * 30
+	if opts.Max != "" {
+		var err error
+		max, err = time.ParseDuration(opts.Max)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing max retry duration: %s", err.Error())
+		}
+	}
+	if max < min {
+		max = min
+	}
+
+	threshold := int(opts.Threshold)
+	if threshold == 0 {
+		threshold = 5
+	}
+
+	return &Backoff{
+		min:       min,
+		max:       max,
+		threshold: threshold,
+	}, nil
+}
+
+// Failure records a failed attempt and returns how long to wait before the next.
+func (b *Backoff) Failure() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+
+	delay := b.max
+	// stop doubling once past max, so the shift can't overflow
+	if b.failures <= 32 {
+		if d := b.min << (b.failures - 1); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+
+	if b.failures >= b.threshold {
+		if !b.open {
+			fmt.Fprintf(os.Stderr, "Circuit open after %d failures\n", b.failures)
+		}
+		b.open = true
+		delay = b.max
+	}
+
+	// wait between half and all of the delay
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	if b.open {
+		b.openUntil = time.Now().Add(delay)
+	}
+	return delay
+}
+
+// Success records a successful attempt, resetting the delay and closing the circuit.
+func (b *Backoff) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		fmt.Println("Circuit closed")
+	}
+	b.failures = 0
+	b.open = false
+}
+
+// State returns the state of the circuit.
+func (b *Backoff) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case !b.open:
+		return StateClosed
+	case time.Now().Before(b.openUntil):
+		return StateOpen
+	default:
+		return StateHalfOpen
+	}
+}
+
+// Failures returns the number of failures in a row.
+func (b *Backoff) Failures() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
+
+// Best returns the best of several circuit states, since an agent with
+// several relays is connected as long as one circuit is closed.
+func Best(states ...State) State {
+	best := StateOpen
+	for _, state := range states {
+		switch {
+		case state == StateClosed:
+			return StateClosed
+		case state == StateHalfOpen:
+			best = StateHalfOpen
+		}
+	}
+	return best
+}
+
+// Circuits are the backoffs of an agent that serves through several relays,
+// one for each relay, since relays fail independently. Agents embed it to
+// report the state of their circuits.
+type Circuits struct {
+	backoffs map[string]*Backoff
+}
+
+func NewCircuits(addresses []string, opts BackoffOpts) (*Circuits, error) {
+	c := &Circuits{backoffs: make(map[string]*Backoff, len(addresses))}
+	for _, address := range addresses {
+		b, err := NewBackoff(opts)
+		if err != nil {
+			return nil, err
+		}
+		c.backoffs[address] = b
+	}
+	return c, nil
+}
+
+// For returns the backoff of a relay.
+func (c *Circuits) For(address string) *Backoff {
+	return c.backoffs[address]
+}
+
+// Circuit returns the best state of the circuits to the relays, or nothing
+// if the agent has no relays.
+func (c *Circuits) Circuit() State {
+	if len(c.backoffs) == 0 {
+		return ""
+	}
+	states := make([]State, 0, len(c.backoffs))
+	for _, b := range c.backoffs {
+		states = append(states, b.State())
+	}
+	return Best(states...)
+}
@@ -0,0 +1,239 @@
+package balance
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// affinityTimeout is how long a sticky client is remembered after it was
+// last picked for, so that the clients that stop coming don't pile up.
+const affinityTimeout = time.Hour
+
+// Policy decides which of the servers registered under a name gets a client.
+type Policy string
+
+const (
+	RoundRobin       Policy = "round-robin"
+	LeastConnections Policy = "least-conn"
+	Weighted         Policy = "weighted"
+)
+
+// ParsePolicy parses a policy name, defaulting to round-robin.
+func ParsePolicy(s string) (Policy, error) {
+	switch Policy(s) {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastConnections, Weighted:
+		return Policy(s), nil
+	default:
+		return "", fmt.Errorf("unknown balancing policy: %s", s)
+	}
+}
+
+// ClientID identifies a client to sticky pools by its IP, since its port
+// changes every connection.
+func ClientID(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// Backend is one server in a pool.
+type Backend struct {
+	ID     string
+	Weight int
+	// Conns is the number of clients currently sent to the backend.
+	Conns int
+	// current is the backend's running score for smooth weighted round-robin
+	current int
+}
+
+// Pool distributes clients across the servers registered under one name.
+// It is not safe for concurrent use, callers guard it with their own lock.
+type Pool struct {
+	policy   Policy
+	sticky   bool
+	backends []*Backend
+	next     int
+	affinity map[string]affinity
+	// swept is when expired clients were last forgotten
+	swept time.Time
+}
+
+// affinity is the backend a sticky client was sent to and when.
+type affinity struct {
+	id   string
+	seen time.Time
+}
+
+func NewPool(policy Policy, sticky bool) *Pool {
+	return &Pool{
+		policy:   policy,
+		sticky:   sticky,
+		affinity: make(map[string]affinity),
+		swept:    time.Now(),
+	}
+}
+
+// Add adds a backend, or updates the weight of one that is already in the pool.
+func (p *Pool) Add(id string, weight int) *Backend {
+	if weight < 1 {
+		weight = 1
+	}
+	if backend, ok := p.Get(id); ok {
+		backend.Weight = weight
+		return backend
+	}
+	backend := &Backend{ID: id, Weight: weight}
+	p.backends = append(p.backends, backend)
+	return backend
+}
+
+// Remove removes a backend and forgets the clients stuck to it.
+func (p *Pool) Remove(id string) {
+	for i, backend := range p.backends {
+		if backend.ID == id {
+			p.backends = append(p.backends[:i], p.backends[i+1:]...)
+			break
+		}
+	}
+	for client, a := range p.affinity {
+		if a.id == id {
+			delete(p.affinity, client)
+		}
+	}
+}
+
+func (p *Pool) Get(id string) (*Backend, bool) {
+	for _, backend := range p.backends {
+		if backend.ID == id {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Pool) Len() int {
+	return len(p.backends)
+}
+
+// Backends returns the backends in the order they were added.
+func (p *Pool) Backends() []*Backend {
+	return append([]*Backend(nil), p.backends...)
+}
+
+// Pick chooses a backend for a client among those available reports true
+// for, or all backends if available is nil. With stickiness, a client keeps
+// getting the backend it got before for as long as that backend is available.
+func (p *Pool) Pick(client string, available func(*Backend) bool) (*Backend, bool) {
+	candidates := make([]*Backend, 0, len(p.backends))
+	for _, backend := range p.backends {
+		if available == nil || available(backend) {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	if p.sticky && client != "" {
+		p.expire()
+		if a, ok := p.affinity[client]; ok && time.Since(a.seen) <= affinityTimeout {
+			for _, backend := range candidates {
+				if backend.ID == a.id {
+					p.affinity[client] = affinity{id: a.id, seen: time.Now()}
+					return backend, true
+				}
+			}
+		}
+	}
+
+	var backend *Backend
+	switch p.policy {
+	case LeastConnections:
+		backend = p.leastConnections(candidates)
+	case Weighted:
+		backend = p.weighted(candidates)
+	default:
+		backend = p.roundRobin(candidates)
+	}
+
+	if p.sticky && client != "" {
+		p.affinity[client] = affinity{id: backend.ID, seen: time.Now()}
+	}
+	return backend, true
+}
+
+// expire forgets the sticky clients that haven't been seen for the affinity
+// timeout, checking at most once per timeout.
+func (p *Pool) expire() {
+	if time.Since(p.swept) < affinityTimeout {
+		return
+	}
+	p.swept = time.Now()
+	for client, a := range p.affinity {
+		if time.Since(a.seen) > affinityTimeout {
+			delete(p.affinity, client)
+		}
+	}
+}
+
+// Acquire counts a client sent to a backend.
+func (p *Pool) Acquire(id string) {
+	if backend, ok := p.Get(id); ok {
+		backend.Conns++
+	}
+}
+
+// Release counts a client that is done with a backend.
+func (p *Pool) Release(id string) {
+	if backend, ok := p.Get(id); ok && backend.Conns > 0 {
+		backend.Conns--
+	}
+}
+
+func (p *Pool) roundRobin(candidates []*Backend) *Backend {
+	backend := candidates[p.next%len(candidates)]
+	p.next++
+	return backend
+}
+
+// leastConnections picks the backend with the fewest clients for its weight,
+// starting from a rotating offset so that ties are spread out.
+func (p *Pool) leastConnections(candidates []*Backend) *Backend {
+	offset := p.next % len(candidates)
+	p.next++
+
+	best := candidates[offset]
+	for i := 1; i < len(candidates); i++ {
+		backend := candidates[(offset+i)%len(candidates)]
+		if backend.Conns*best.Weight < best.Conns*backend.Weight {
+			best = backend
+		}
+	}
+	return best
+}
+
+// weighted is smooth weighted round-robin, which interleaves backends in
+// proportion to their weights instead of sending bursts to the heaviest.
+func (p *Pool) weighted(candidates []*Backend) *Backend {
+	total := 0
+	var best *Backend
+	for _, backend := range candidates {
+		backend.current += backend.Weight
+		total += backend.Weight
+		if best == nil || backend.current > best.current {
+			best = backend
+		}
+	}
+	best.current -= total
+	return best
+}
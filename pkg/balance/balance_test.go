@@ -0,0 +1,239 @@
+package balance
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testBackend struct {
+	id     string
+	weight int
+	conns  int
+}
+
+func newTestPool(policy Policy, sticky bool, backends []testBackend) *Pool {
+	p := NewPool(policy, sticky)
+	for _, b := range backends {
+		backend := p.Add(b.id, b.weight)
+		backend.Conns = b.conns
+	}
+	return p
+}
+
+// picks returns the ids of the backends picked for n clients without
+// stickiness, in order.
+func picks(p *Pool, n int) string {
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		backend, ok := p.Pick("", nil)
+		if !ok {
+			ids = append(ids, "-")
+			continue
+		}
+		ids = append(ids, backend.ID)
+	}
+	return strings.Join(ids, "")
+}
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		backends []testBackend
+		n        int
+		want     string
+	}{
+		{"round-robin", RoundRobin, []testBackend{{"a", 1, 0}, {"b", 1, 0}, {"c", 1, 0}}, 6, "abcabc"},
+		{"round-robin ignores weights", RoundRobin, []testBackend{{"a", 5, 0}, {"b", 1, 0}}, 4, "abab"},
+		{"least-conn", LeastConnections, []testBackend{{"a", 1, 3}, {"b", 1, 0}, {"c", 1, 1}}, 3, "bbb"},
+		{"least-conn by weight", LeastConnections, []testBackend{{"a", 4, 4}, {"b", 1, 2}}, 2, "aa"},
+		{"least-conn spreads ties", LeastConnections, []testBackend{{"a", 1, 0}, {"b", 1, 0}}, 4, "abab"},
+		{"weighted", Weighted, []testBackend{{"a", 5, 0}, {"b", 1, 0}, {"c", 1, 0}}, 7, "aabacaa"},
+		{"weighted equal", Weighted, []testBackend{{"a", 1, 0}, {"b", 1, 0}}, 4, "abab"},
+		{"empty", RoundRobin, nil, 2, "--"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(tt.policy, false, tt.backends)
+			if got := picks(p, tt.n); got != tt.want {
+				t.Fatalf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends []testBackend
+		want     map[string]int
+	}{
+		{"3:1", []testBackend{{"a", 3, 0}, {"b", 1, 0}}, map[string]int{"a": 300, "b": 100}},
+		{"5:2:1", []testBackend{{"a", 5, 0}, {"b", 2, 0}, {"c", 1, 0}}, map[string]int{"a": 250, "b": 100, "c": 50}},
+		{"zero weight counts as one", []testBackend{{"a", 0, 0}, {"b", 1, 0}}, map[string]int{"a": 200, "b": 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(Weighted, false, tt.backends)
+			n := 0
+			for _, count := range tt.want {
+				n += count
+			}
+			got := make(map[string]int)
+			for _, id := range picks(p, n) {
+				got[string(id)]++
+			}
+			for id, count := range tt.want {
+				if got[id] != count {
+					t.Fatalf("picked %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPickAvailable(t *testing.T) {
+	p := newTestPool(RoundRobin, false, []testBackend{{"a", 1, 0}, {"b", 1, 0}})
+	onlyB := func(backend *Backend) bool { return backend.ID == "b" }
+	for i := 0; i < 3; i++ {
+		if backend, ok := p.Pick("", onlyB); !ok || backend.ID != "b" {
+			t.Fatalf("picked %v, want b", backend)
+		}
+	}
+	if _, ok := p.Pick("", func(*Backend) bool { return false }); ok {
+		t.Fatal("picked a backend when none is available")
+	}
+}
+
+func TestSticky(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		// remove removes the client's backend after its first pick
+		remove bool
+		// unavailable makes the client's backend unavailable for the second pick
+		unavailable bool
+		want        bool
+	}{
+		{"round-robin", RoundRobin, false, false, true},
+		{"least-conn", LeastConnections, false, false, true},
+		{"weighted", Weighted, false, false, true},
+		{"backend removed", RoundRobin, true, false, false},
+		{"backend unavailable", RoundRobin, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(tt.policy, true, []testBackend{{"a", 1, 0}, {"b", 1, 0}, {"c", 1, 0}})
+			first, _ := p.Pick("10.0.0.1", nil)
+			p.Acquire(first.ID)
+			// other clients move the policy along
+			p.Pick("10.0.0.2", nil)
+			p.Pick("10.0.0.3", nil)
+
+			var available func(*Backend) bool
+			if tt.remove {
+				p.Remove(first.ID)
+			}
+			if tt.unavailable {
+				available = func(backend *Backend) bool { return backend.ID != first.ID }
+			}
+			second, ok := p.Pick("10.0.0.1", available)
+			if !ok {
+				t.Fatal("no backend picked")
+			}
+			if got := second.ID == first.ID; got != tt.want {
+				t.Fatalf("picked %s then %s, want the same backend: %v", first.ID, second.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestStickyExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		// seen is how long ago the client was last picked for
+		seen time.Duration
+		// swept is how long ago the pool last forgot expired clients
+		swept     time.Duration
+		wantStuck bool
+		wantKept  bool
+	}{
+		{"recent", time.Minute, time.Minute, true, true},
+		{"expired before the sweep", affinityTimeout + time.Minute, time.Minute, false, true},
+		{"expired and swept", affinityTimeout + time.Minute, affinityTimeout + time.Minute, false, false},
+		{"recent at the sweep", time.Minute, affinityTimeout + time.Minute, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(RoundRobin, true, []testBackend{{"a", 1, 0}, {"b", 1, 0}})
+			now := time.Now()
+			// a client stuck to b, while the round-robin points at a
+			p.affinity["10.0.0.1"] = affinity{id: "b", seen: now.Add(-tt.seen)}
+			p.affinity["10.0.0.2"] = affinity{id: "a", seen: now.Add(-tt.seen)}
+			p.swept = now.Add(-tt.swept)
+
+			backend, _ := p.Pick("10.0.0.1", nil)
+			if got := backend.ID == "b"; got != tt.wantStuck {
+				t.Fatalf("picked %s, want stuck to b: %v", backend.ID, tt.wantStuck)
+			}
+			if _, got := p.affinity["10.0.0.2"]; got != tt.wantKept {
+				t.Fatalf("other client remembered: %v, want %v", got, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	p := newTestPool(LeastConnections, false, []testBackend{{"a", 1, 0}})
+	p.Acquire("a")
+	p.Acquire("a")
+	p.Release("a")
+	p.Release("a")
+	p.Release("a")
+	p.Acquire("missing")
+	if backend, _ := p.Get("a"); backend.Conns != 0 {
+		t.Fatalf("got %d connections, want 0", backend.Conns)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Policy
+		wantErr bool
+	}{
+		{"", RoundRobin, false},
+		{"round-robin", RoundRobin, false},
+		{"least-conn", LeastConnections, false},
+		{"weighted", Weighted, false},
+		{"random", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePolicy(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePolicy(%q) = %q, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestClientID(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{"tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}, "10.0.0.1"},
+		{"udp", &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, "10.0.0.1"},
+		{"ipv6", &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 5000}, "fd00::1"},
+		{"other network", &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, "/tmp/socket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClientID(tt.addr); got != tt.want {
+				t.Fatalf("ClientID(%v) = %s, want %s", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
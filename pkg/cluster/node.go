@@ -0,0 +1,280 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when no other relay holds a name.
+var ErrNotFound = errors.New("not found")
+
+// Node is a relay's membership in a cluster. It announces the names the
+// relay has servers for, finds the relay holding a name it doesn't, and
+// serves the endpoints other relays forward requests to.
+type Node struct {
+	registry  Registry
+	network   string
+	listen    string
+	self      string
+	address   string
+	interval  time.Duration
+	mux       *http.ServeMux
+	client    *http.Client
+	secret    string
+	notify    chan struct{}
+	debug     bool
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+type NodeOpts struct {
+	Registry      Registry
+	Network       string
+	ListenAddress string
+	AdvertiseHost string
+	ClientPort    uint
+	Peers         []string
+	Secret        string
+	Debug         bool
+}
+
+// NewNode creates a node listening for other relays on the listen address.
+// It is known to them by the advertise host, which defaults to the host of
+// the listen address or else the hostname. Without a registry, the relays
+// share one by pushing changes to their peers. Relays only take requests
+// that carry the cluster's secret, which may only be left out when the
+// relays listen on loopback.
+func NewNode(opts NodeOpts) (*Node, error) {
+	host, port, err := net.SplitHostPort(opts.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster address: %s", err.Error())
+	}
+	if opts.Secret == "" && !isLoopback(host) {
+		return nil, fmt.Errorf("a cluster secret is required to listen for the cluster on %s", opts.ListenAddress)
+	}
+
+	advertise := opts.AdvertiseHost
+	if advertise == "" {
+		advertise = host
+	}
+	if advertise == "" {
+		if advertise, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("error getting hostname to advertise: %s", err.Error())
+		}
+	}
+
+	mux := http.NewServeMux()
+	registry := opts.Registry
+	if registry == nil {
+		peers := NewPeers(PeersOpts{Peers: opts.Peers, Secret: opts.Secret, Debug: opts.Debug})
+		peers.Register(mux)
+		registry = peers
+	}
+
+	return &Node{
+		registry:  registry,
+		network:   opts.Network,
+		listen:    opts.ListenAddress,
+		self:      net.JoinHostPort(advertise, port),
+		address:   net.JoinHostPort(advertise, strconv.Itoa(int(opts.ClientPort))),
+		interval:  time.Second * 5,
+		mux:       mux,
+		client:    &http.Client{Timeout: time.Second * 5},
+		secret:    opts.Secret,
+		notify:    make(chan struct{}, 1),
+		debug:     opts.Debug,
+		announced: make(map[string]bool),
+	}, nil
+}
+
+// Handle adds a handler for requests forwarded by other relays. It must be
+// called before Run.
+func (n *Node) Handle(pattern string, handler http.HandlerFunc) {
+	n.mux.HandleFunc(pattern, handler)
+}
+
+// Run serves other relays and announces the names returned by names, every
+// interval and whenever Changed is called.
+func (n *Node) Run(names func() []string) error {
+	listener, err := net.Listen("tcp", n.listen)
+	if err != nil {
+		return fmt.Errorf("error listening for the cluster: %s", err.Error())
+	}
+	if n.debug {
+		fmt.Printf("Listening for the cluster on %s as %s\n", listener.Addr().String(), n.self)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- http.Serve(listener, authorize(n.secret, n.mux))
+	}()
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	for {
+		n.announce(names())
+		select {
+		case err := <-errChan:
+			return err
+		case <-ticker.C:
+		case <-n.notify:
+		}
+	}
+}
+
+// Changed announces the names again without waiting for the interval.
+// It does nothing on a nil node, so relays can call it outside a cluster.
+func (n *Node) Changed() {
+	if n == nil {
+		return
+	}
+	select {
+	case n.notify <- struct{}{}:
+	default:
+	}
+}
+
+// announce announces the names the relay has, and withdraws the ones it
+// announced before but no longer has. Entries live for a few intervals, so
+// a relay that stops announcing them is forgotten.
+func (n *Node) announce(names []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	current := make(map[string]bool, len(names))
+	expires := time.Now().Add(n.interval * 3)
+	for _, name := range names {
+		current[name] = true
+		err := n.registry.Announce(Entry{
+			Network: n.network,
+			Name:    name,
+			Relay:   n.self,
+			Address: n.address,
+			Expires: expires,
+		})
+		if err != nil {
+			fmt.Printf("[CLUSTER] failed to announce %s: %s\n", name, err.Error())
+		}
+	}
+	for name := range n.announced {
+		if current[name] {
+			continue
+		}
+		if err := n.registry.Withdraw(n.network, name, n.self); err != nil {
+			fmt.Printf("[CLUSTER] failed to withdraw %s: %s\n", name, err.Error())
+		}
+	}
+	n.announced = current
+}
+
+// Locate finds another relay with servers registered under a name.
+func (n *Node) Locate(name string) (Entry, error) {
+	entries, err := n.registry.Lookup(n.network, name)
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Relay != n.self {
+			return entry, nil
+		}
+	}
+	return Entry{}, ErrNotFound
+}
+
+// Call posts a request to another relay's handler and decodes its response.
+// A 404 from the relay is returned as ErrNotFound.
+func (n *Node) Call(relay, path string, request, response interface{}) error {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	res, err := post(n.client, n.secret, fmt.Sprintf("http://%s%s", relay, path), b)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s returned %s: %s", relay, res.Status, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+// Sign returns what proves to another relay in the cluster that the fields
+// come from this one, an HMAC of them with the cluster secret, or "-" if
+// there is no secret.
+func (n *Node) Sign(fields ...string) string {
+	if n.secret == "" {
+		return "-"
+	}
+	mac := hmac.New(sha256.New, []byte(n.secret))
+	mac.Write([]byte(strings.Join(fields, " ")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the fields were signed by a relay in the cluster.
+// Without a secret, the relays all listen on loopback, and only what comes
+// from loopback is trusted.
+func (n *Node) Verify(signature string, from net.Addr, fields ...string) bool {
+	if n.secret == "" {
+		host, _, err := net.SplitHostPort(from.String())
+		return err == nil && isLoopback(host)
+	}
+	return hmac.Equal([]byte(signature), []byte(n.Sign(fields...)))
+}
+
+// post sends a request to another relay, with the cluster secret if there
+// is one.
+func post(client *http.Client, secret, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	return client.Do(req)
+}
+
+// authorize only lets through requests that carry the cluster secret, if
+// there is one.
+func authorize(secret string, next http.Handler) http.Handler {
+	if secret == "" {
+		return next
+	}
+	want := []byte("Bearer " + secret)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
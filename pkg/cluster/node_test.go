@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, registry Registry, listen, secret string) *Node {
+	t.Helper()
+	node, err := NewNode(NodeOpts{
+		Registry:      registry,
+		Network:       "tcp",
+		ListenAddress: listen,
+		ClientPort:    3333,
+		Secret:        secret,
+	})
+	if err != nil {
+		t.Fatalf("NewNode: %v", err)
+	}
+	return node
+}
+
+func TestSignVerify(t *testing.T) {
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	remote := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 5000}
+	fields := []string{"web", "198.51.100.1:4000", "10.0.0.1:3333", "request", "5", "1700000000"}
+
+	tests := []struct {
+		name     string
+		signer   string
+		verifier string
+		signed   []string
+		verified []string
+		from     net.Addr
+		want     bool
+	}{
+		{"same secret", "secret", "secret", fields, fields, remote, true},
+		{"other secret", "secret", "other", fields, fields, remote, false},
+		{"changed field", "secret", "secret", fields, append(append([]string(nil), fields[:4]...), "6", fields[5]), remote, false},
+		{"unsigned", "", "secret", fields, fields, loopback, false},
+		{"no secret from loopback", "", "", fields, fields, loopback, true},
+		{"no secret from elsewhere", "", "", fields, fields, remote, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := newTestNode(t, NewMemory(), "127.0.0.1:7001", tt.signer)
+			verifier := newTestNode(t, NewMemory(), "127.0.0.1:7002", tt.verifier)
+			signature := signer.Sign(tt.signed...)
+			if got := verifier.Verify(signature, tt.from, tt.verified...); got != tt.want {
+				t.Fatalf("Verify = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretRequired(t *testing.T) {
+	if _, err := NewNode(NodeOpts{ListenAddress: "0.0.0.0:7001"}); err == nil {
+		t.Fatal("expected a secret to be required off loopback")
+	}
+}
+
+func TestLocate(t *testing.T) {
+	registry := NewMemory()
+	a := newTestNode(t, registry, "127.0.0.1:7001", "secret")
+	b := newTestNode(t, registry, "127.0.0.1:7002", "secret")
+
+	a.announce([]string{"web"})
+	if _, err := a.Locate("web"); err != ErrNotFound {
+		t.Fatalf("a relay located itself: %v", err)
+	}
+	entry, err := b.Locate("web")
+	if err != nil {
+		t.Fatalf("Locate: %v", err)
+	}
+	if entry.Relay != "127.0.0.1:7001" || entry.Address != "127.0.0.1:3333" {
+		t.Fatalf("got %+v, want relay a", entry)
+	}
+
+	// a name the relay no longer has is withdrawn
+	a.announce(nil)
+	if _, err := b.Locate("web"); err != ErrNotFound {
+		t.Fatalf("got %v after withdrawing, want ErrNotFound", err)
+	}
+
+	// entries that expire are forgotten
+	registry.Announce(Entry{Network: "tcp", Name: "old", Relay: "127.0.0.1:7001", Expires: time.Now().Add(-time.Second)})
+	if _, err := b.Locate("old"); err != ErrNotFound {
+		t.Fatalf("got %v for an expired entry, want ErrNotFound", err)
+	}
+}
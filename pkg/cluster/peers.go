@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Peers is a registry shared by pushing every change to each of the other
+// relays in the cluster, which keep a copy in memory. Every relay lists all
+// the others as peers, and entries that stop being announced expire, so a
+// relay that missed a change catches up with the next announcement.
+type Peers struct {
+	store  *Memory
+	peers  []string
+	client *http.Client
+	secret string
+	debug  bool
+}
+
+type PeersOpts struct {
+	Peers  []string
+	Secret string
+	Debug  bool
+}
+
+func NewPeers(opts PeersOpts) *Peers {
+	return &Peers{
+		store:  NewMemory(),
+		peers:  opts.Peers,
+		client: &http.Client{Timeout: time.Second * 5},
+		secret: opts.Secret,
+		debug:  opts.Debug,
+	}
+}
+
+func (p *Peers) Announce(entry Entry) error {
+	p.store.Announce(entry)
+	p.push("/registry/announce", entry)
+	return nil
+}
+
+func (p *Peers) Withdraw(network, name, relay string) error {
+	p.store.Withdraw(network, name, relay)
+	p.push("/registry/withdraw", Entry{Network: network, Name: name, Relay: relay})
+	return nil
+}
+
+func (p *Peers) Lookup(network, name string) ([]Entry, error) {
+	return p.store.Lookup(network, name)
+}
+
+// push sends a change to every peer in the background.
+func (p *Peers) push(path string, entry Entry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	for _, peer := range p.peers {
+		go func(peer string) {
+			res, err := post(p.client, p.secret, fmt.Sprintf("http://%s%s", peer, path), b)
+			if err != nil {
+				if p.debug {
+					fmt.Printf("[CLUSTER] failed to push to %s: %s\n", peer, err.Error())
+				}
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNoContent && p.debug {
+				fmt.Printf("[CLUSTER] %s refused a push: %s\n", peer, res.Status)
+			}
+		}(peer)
+	}
+}
+
+// Register adds the handlers peers push changes to.
+func (p *Peers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/registry/announce", p.handle(func(entry Entry) { p.store.Announce(entry) }))
+	mux.HandleFunc("/registry/withdraw", p.handle(func(entry Entry) {
+		p.store.Withdraw(entry.Network, entry.Name, entry.Relay)
+	}))
+}
+
+func (p *Peers) handle(apply func(Entry)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var entry Entry
+		if err := json.NewDecoder(req.Body).Decode(&entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply(entry)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
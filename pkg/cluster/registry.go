@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry records that a relay has servers registered under a name.
+type Entry struct {
+	Network string    `json:"network"`
+	Name    string    `json:"name"`
+	Relay   string    `json:"relay"`
+	Address string    `json:"address"`
+	Expires time.Time `json:"expires"`
+}
+
+func (e Entry) key() string {
+	return e.Network + "/" + e.Name + "/" + e.Relay
+}
+
+// Registry is the map of names to relays shared by a cluster. Relay is the
+// cluster address of the relay holding the servers, and Address is where
+// that relay's clients connect.
+type Registry interface {
+	// Announce records an entry until it expires, replacing an older one
+	// from the same relay.
+	Announce(entry Entry) error
+	// Withdraw removes a relay's entry for a name.
+	Withdraw(network, name, relay string) error
+	// Lookup returns the entries for a name that haven't expired, ordered by relay.
+	Lookup(network, name string) ([]Entry, error)
+}
+
+// Memory is a registry held in memory. Relays running in the same process
+// can share one to form a cluster without talking to each other.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]Entry)}
+}
+
+func (m *Memory) Announce(entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[entry.key()] = entry
+	return nil
+}
+
+func (m *Memory) Withdraw(network, name, relay string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, Entry{Network: network, Name: name, Relay: relay}.key())
+	return nil
+}
+
+func (m *Memory) Lookup(network, name string) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var entries []Entry
+	for key, entry := range m.entries {
+		if now.After(entry.Expires) {
+			delete(m.entries, key)
+			continue
+		}
+		if entry.Network == network && entry.Name == name {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Relay < entries[j].Relay })
+	return entries, nil
+}
@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// maxFrameSize is the largest plaintext sealed into a single frame.
+const maxFrameSize = 16 * 1024
+
+// Conn encrypts a byte stream. Everything written is sealed into
+// length-prefixed frames, and everything read is opened from them. An empty
+// frame ends the stream.
+type Conn struct {
+	rw      io.ReadWriteCloser
+	cipher  Cipher
+	readBuf []byte
+	eof     bool
+}
+
+func NewConn(rw io.ReadWriteCloser, cipher Cipher) *Conn {
+	return &Conn{rw: rw, cipher: cipher}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+	if len(c.readBuf) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.rw, header); err != nil {
+			return 0, err
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(c.rw, frame); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		message, err := c.cipher.Decrypt(frame)
+		if err != nil {
+			return 0, err
+		}
+		if len(message) == 0 {
+			c.eof = true
+			return 0, io.EOF
+		}
+		c.readBuf = message
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if err := c.writeFrame(b[written : written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite sends the empty frame that ends the stream, and leaves the
+// underlying stream open for the other side to finish, since a stream like
+// a WebSocket can't be half-closed.
+func (c *Conn) CloseWrite() error {
+	return c.writeFrame(nil)
+}
+
+func (c *Conn) writeFrame(b []byte) error {
+	frame, err := c.cipher.Encrypt(b)
+	if err != nil {
+		return err
+	}
+	if len(frame) > 0xffff {
+		return errors.New("frame too large")
+	}
+	buf := make([]byte, 2+len(frame))
+	binary.BigEndian.PutUint16(buf, uint16(len(frame)))
+	copy(buf[2:], frame)
+	_, err = c.rw.Write(buf)
+	return err
+}
+
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
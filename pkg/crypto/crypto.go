@@ -15,6 +15,8 @@ type Cipher interface {
 	DecryptStream(dst io.Writer, src io.Reader) error
 	EncryptRoundTrip(dst, src io.ReadWriter) error
 	DecryptRoundTrip(dst, src io.ReadWriter) error
+	// Overhead is the number of bytes Encrypt adds to a message.
+	Overhead() int
 }
 
 type AESCipher struct {
@@ -87,6 +89,10 @@ func (e *AESCipher) Decrypt(encryptedMessage []byte) ([]byte, error) {
 	return message, nil
 }
 
+func (e *AESCipher) Overhead() int {
+	return e.gcm.NonceSize() + e.gcm.Overhead()
+}
+
 func (e *AESCipher) EncryptStream(dst io.Writer, src io.Reader) error {
 	buf := make([]byte, e.bufSize)
 	n, err := src.Read(buf)
@@ -0,0 +1,142 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Checker probes a backend once, returning an error if it is unhealthy.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// NewChecker creates a checker for the backend at address from a check spec:
+//
+//	tcp              connect to the backend
+//	udp              send an empty datagram, failing if the port is closed
+//	udp:<payload>    send the payload and wait for any reply
+//	http[:<path>]    GET the path on the backend, failing on 4xx and 5xx
+//	http(s)://...    GET the URL instead of the backend
+func NewChecker(spec, address string) (Checker, error) {
+	switch {
+	case spec == "tcp":
+		return &TCPChecker{Address: address}, nil
+	case spec == "udp":
+		return &UDPChecker{Address: address}, nil
+	case strings.HasPrefix(spec, "udp:"):
+		return &UDPChecker{Address: address, Payload: []byte(strings.TrimPrefix(spec, "udp:"))}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &HTTPChecker{URL: spec}, nil
+	case spec == "http":
+		return &HTTPChecker{URL: fmt.Sprintf("http://%s/", address)}, nil
+	case strings.HasPrefix(spec, "http:"):
+		path := strings.TrimPrefix(spec, "http:")
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return &HTTPChecker{URL: fmt.Sprintf("http://%s%s", address, path)}, nil
+	default:
+		return nil, fmt.Errorf("unknown health check: %s", spec)
+	}
+}
+
+// TCPChecker is healthy if the backend accepts a connection.
+type TCPChecker struct {
+	Address string
+}
+
+func (c *TCPChecker) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// UDPChecker sends a datagram to the backend. Without a payload it only
+// fails if the port is closed, since most UDP services don't answer
+// datagrams they don't understand. With a payload it waits for a reply.
+type UDPChecker struct {
+	Address string
+	Payload []byte
+}
+
+func (c *UDPChecker) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(c.Payload); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("port closed: %s", err.Error())
+	case isTimeout(err) && len(c.Payload) == 0:
+		// silence is all we can expect without a payload
+		return nil
+	default:
+		return err
+	}
+}
+
+// HTTPChecker is healthy if a GET of the URL succeeds with a status below 400.
+type HTTPChecker struct {
+	URL string
+}
+
+func (c *HTTPChecker) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", c.URL, res.Status)
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseDuration parses a duration, returning the fallback if the value is empty.
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", value)
+	}
+	return d, nil
+}
@@ -0,0 +1,178 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Monitor checks a backend periodically and tracks whether it is healthy.
+// The backend starts out unhealthy until the first check passes, after
+// which it takes threshold checks in a row to change its state.
+//
+// A nil Monitor is always healthy, so servers can use one unconditionally.
+type Monitor struct {
+	checker   Checker
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	debug     bool
+	mu        sync.Mutex
+	healthy   bool
+	checked   bool
+	streak    int
+	// up is closed when the backend becomes healthy, down when it becomes unhealthy
+	up   chan struct{}
+	down chan struct{}
+}
+
+type MonitorOpts struct {
+	Check     string
+	Address   string
+	Interval  string
+	Timeout   string
+	Threshold uint
+	Debug     bool
+}
+
+// NewMonitor creates a monitor for the backend at the address, or returns
+// nil if no check is configured.
+func NewMonitor(opts MonitorOpts) (*Monitor, error) {
+	if opts.Check == "" {
+		return nil, nil
+	}
+
+	checker, err := NewChecker(opts.Check, opts.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := parseDuration(opts.Interval, time.Second*5)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing health interval: %s", err.Error())
+	}
+
+	timeout, err := parseDuration(opts.Timeout, time.Second*2)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing health timeout: %s", err.Error())
+	}
+
+	threshold := int(opts.Threshold)
+	if threshold == 0 {
+		threshold = 2
+	}
+
+	down := make(chan struct{})
+	close(down)
+
+	return &Monitor{
+		checker:   checker,
+		interval:  interval,
+		timeout:   timeout,
+		threshold: threshold,
+		debug:     opts.Debug,
+		up:        make(chan struct{}),
+		down:      down,
+	}, nil
+}
+
+// Run checks the backend until the context is done.
+func (m *Monitor) Run(ctx context.Context) {
+	if m == nil {
+		return
+	}
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	err := m.checker.Check(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	healthy := err == nil
+	if healthy == m.healthy {
+		if m.debug && err != nil {
+			fmt.Printf("Health check failed: %s\n", err.Error())
+		}
+		m.streak = 0
+		m.checked = true
+		return
+	}
+	m.streak++
+	if m.checked && m.streak < m.threshold {
+		if m.debug && err != nil {
+			fmt.Printf("Health check failed (%d/%d): %s\n", m.streak, m.threshold, err.Error())
+		}
+		return
+	}
+
+	m.checked = true
+	m.streak = 0
+	m.healthy = healthy
+	if healthy {
+		fmt.Println("Backend is healthy")
+		close(m.up)
+		m.down = make(chan struct{})
+	} else {
+		fmt.Printf("Backend is unhealthy: %s\n", err.Error())
+		close(m.down)
+		m.up = make(chan struct{})
+	}
+}
+
+// Healthy reports whether the backend is healthy.
+func (m *Monitor) Healthy() bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthy
+}
+
+// Wait blocks until the backend is healthy or the context is done.
+func (m *Monitor) Wait(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	up := m.up
+	healthy := m.healthy
+	m.mu.Unlock()
+
+	if !healthy {
+		fmt.Println("Waiting for the backend to be healthy")
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-up:
+		return nil
+	}
+}
+
+// Down returns a channel that is closed once the backend is unhealthy.
+// It is already closed if the backend is unhealthy now.
+func (m *Monitor) Down() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.down
+}
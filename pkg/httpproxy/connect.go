@@ -0,0 +1,57 @@
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Connect asks an HTTP proxy on conn for a tunnel to a host:port, with
+// basic authentication if there is a username. It returns the tunnel, which
+// holds on to anything the proxy sent after its response.
+func Connect(conn net.Conn, target, username, password string) (net.Conn, error) {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := fmt.Fprintf(conn, "%s\r\n", request); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("error reading proxy response: %s", err.Error())
+	}
+	// the body of a successful response is the tunnel, so it isn't read
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy failed to connect to %s: %s", target, resp.Status)
+	}
+
+	if reader.Buffered() == 0 {
+		return conn, nil
+	}
+	return &tunnel{Conn: conn, reader: reader}, nil
+}
+
+// tunnel is a connection through a proxy whose first bytes were read along
+// with the proxy's response.
+type tunnel struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (t *tunnel) Read(b []byte) (int, error) {
+	return t.reader.Read(b)
+}
+
+// CloseWrite closes the sending side of the connection if it can.
+func (t *tunnel) CloseWrite() error {
+	if cw, ok := t.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return t.Conn.Close()
+}
@@ -0,0 +1,136 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// Request is a request to an HTTP proxy. A CONNECT request asks for a
+// tunnel to a host:port. Any other request names an absolute URI, and is
+// sent on to the host in origin form, as the only request on the connection.
+type Request struct {
+	conn    net.Conn
+	target  string
+	connect bool
+	reader  io.Reader
+}
+
+// ReadRequest reads a request from an HTTP proxy client. Requests that
+// can't be proxied are answered with an error.
+func ReadRequest(conn net.Conn) (*Request, error) {
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("error reading request: %s", err.Error())
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/") {
+		writeStatus(conn, "400 Bad Request")
+		return nil, fmt.Errorf("invalid request line: %q", line)
+	}
+	method, uri, proto := parts[0], parts[1], parts[2]
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		writeStatus(conn, "400 Bad Request")
+		return nil, fmt.Errorf("error reading request headers: %s", err.Error())
+	}
+
+	r := &Request{conn: conn}
+	var head bytes.Buffer
+	if method == "CONNECT" {
+		if _, _, err := net.SplitHostPort(uri); err != nil {
+			writeStatus(conn, "400 Bad Request")
+			return nil, fmt.Errorf("invalid CONNECT target %s: %s", uri, err.Error())
+		}
+		r.target = uri
+		r.connect = true
+	} else {
+		u, err := url.Parse(uri)
+		if err != nil || u.Host == "" {
+			writeStatus(conn, "400 Bad Request")
+			return nil, fmt.Errorf("not a proxy request: %s %s", method, uri)
+		}
+		if u.Scheme != "http" {
+			writeStatus(conn, "400 Bad Request")
+			return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+		}
+		r.target = u.Host
+		if u.Port() == "" {
+			r.target = net.JoinHostPort(u.Hostname(), "80")
+		}
+
+		// the connection only carries this request, since the next one may
+		// be for another host
+		header.Del("Proxy-Connection")
+		header.Del("Proxy-Authorization")
+		header.Set("Connection", "close")
+		if header.Get("Host") == "" {
+			header.Set("Host", u.Host)
+		}
+		fmt.Fprintf(&head, "%s %s %s\r\n", method, u.RequestURI(), proto)
+		for key, values := range header {
+			for _, value := range values {
+				fmt.Fprintf(&head, "%s: %s\r\n", key, value)
+			}
+		}
+		head.WriteString("\r\n")
+	}
+
+	// anything the client sent after the headers was read into the buffer,
+	// and is sent along with the rewritten request
+	buffered, _ := br.Peek(br.Buffered())
+	head.Write(buffered)
+	r.reader = io.MultiReader(&head, conn)
+	return r, nil
+}
+
+func (r *Request) Target() string {
+	return r.target
+}
+
+// Accept tells a CONNECT client that its tunnel is ready. Other clients
+// get the response from the host.
+func (r *Request) Accept() error {
+	if !r.connect {
+		return nil
+	}
+	_, err := io.WriteString(r.conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return err
+}
+
+func (r *Request) Fail() {
+	writeStatus(r.conn, "502 Bad Gateway")
+}
+
+func (r *Request) Read(b []byte) (int, error) {
+	return r.reader.Read(b)
+}
+
+func (r *Request) Write(b []byte) (int, error) {
+	return r.conn.Write(b)
+}
+
+func (r *Request) Close() error {
+	return r.conn.Close()
+}
+
+// CloseWrite closes the sending side of the client connection if it can.
+func (r *Request) CloseWrite() error {
+	if cw, ok := r.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return r.conn.Close()
+}
+
+func writeStatus(w io.Writer, status string) {
+	fmt.Fprintf(w, "HTTP/1.1 %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status)
+}
@@ -1,7 +1,10 @@
 package net
 
+import "context"
+
 type Client interface {
 	Run() error
+	Serve(ctx context.Context) error
 }
 
 type Relay interface {
@@ -10,4 +13,5 @@ type Relay interface {
 
 type Server interface {
 	Run() error
+	Serve(ctx context.Context) error
 }
@@ -0,0 +1,60 @@
+package pipe
+
+import (
+	"io"
+	"sync"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Join copies data in both directions between a and b until both directions
+// are finished, then closes both. When one side stops sending, the other side
+// is half-closed if it supports it so that it can still send its response.
+func Join(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go join(a, b, &wg)
+	go join(b, a, &wg)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+func join(dst, src io.ReadWriteCloser, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if _, err := io.Copy(dst, src); err != nil {
+		// the other direction can't complete either
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+}
+
+// Prefixed returns a stream that reads from r, which holds what was already
+// read from the stream followed by the rest of it, and writes to the stream.
+func Prefixed(stream io.ReadWriteCloser, r io.Reader) io.ReadWriteCloser {
+	return &prefixed{ReadWriteCloser: stream, reader: r}
+}
+
+type prefixed struct {
+	io.ReadWriteCloser
+	reader io.Reader
+}
+
+func (p *prefixed) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *prefixed) CloseWrite() error {
+	if cw, ok := p.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return p.Close()
+}
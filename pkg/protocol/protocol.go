@@ -0,0 +1,25 @@
+// Package protocol reads and writes the header lines that agents and relays
+// exchange, which all take the form "ACTION: value".
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteLine writes a header line of the form "ACTION: value".
+func WriteLine(w io.Writer, action, value string) error {
+	_, err := fmt.Fprintf(w, "%s: %s\n", action, value)
+	return err
+}
+
+// ParseLine splits a header line into its action and value, ignoring the
+// surrounding whitespace and line ending.
+func ParseLine(line string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid header: %s", line)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		wantAction string
+		wantValue  string
+		wantErr    bool
+	}{
+		{"CONNECT: web", "CONNECT", "web", false},
+		{"CONNECT: web\n", "CONNECT", "web", false},
+		{"CONNECT: web\r\n", "CONNECT", "web", false},
+		{"FORWARD: web 1.2.3.4:5 request", "FORWARD", "web 1.2.3.4:5 request", false},
+		{"SESSION: [::1]:4000", "SESSION", "[::1]:4000", false},
+		{"CONNECT web", "", "", true},
+		{"CONNECT:", "", "", true},
+		{"", "", "", true},
+	}
+	for _, tt := range tests {
+		action, value, err := ParseLine(tt.line)
+		if (err != nil) != tt.wantErr || action != tt.wantAction || value != tt.wantValue {
+			t.Errorf("ParseLine(%q) = %q, %q, %v", tt.line, action, value, err)
+		}
+	}
+}
+
+func TestWriteLine(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteLine(&b, "SUCCESS", "web"); err != nil {
+		t.Fatalf("WriteLine: %v", err)
+	}
+	action, value, err := ParseLine(b.String())
+	if err != nil || action != "SUCCESS" || value != "web" {
+		t.Fatalf("read back %q, %q, %v from %q", action, value, err, b.String())
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Allowlist is the destinations a server dials for its clients. Each entry
+// is a host with an optional port, where the host is a name, a wildcard
+// like *.example.com, an address, a CIDR range or * for any host. Without
+// a port, any port is allowed.
+type Allowlist struct {
+	rules []rule
+}
+
+type rule struct {
+	name    string
+	network *net.IPNet
+	port    string
+}
+
+func ParseAllowlist(entries []string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range entries {
+		r, err := parseRule(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist entry %q: %s", entry, err.Error())
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+func parseRule(entry string) (rule, error) {
+	host, port := entry, ""
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		host, port = h, p
+		if port == "*" {
+			port = ""
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return rule{}, fmt.Errorf("invalid port %s", port)
+		}
+	}
+	if host == "" {
+		return rule{}, fmt.Errorf("host is required")
+	}
+
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		return rule{network: network, port: port}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return rule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, port: port}, nil
+	}
+	return rule{name: strings.ToLower(host), port: port}, nil
+}
+
+func (r rule) matchesPort(port string) bool {
+	return r.port == "" || r.port == port
+}
+
+func (r rule) matchesName(host string) bool {
+	switch {
+	case r.name == "":
+		return false
+	case r.name == "*":
+		return true
+	case strings.HasPrefix(r.name, "*."):
+		return strings.HasSuffix(host, r.name[1:])
+	default:
+		return host == r.name
+	}
+}
+
+// allowsName reports whether a destination is allowed by its name.
+func (a *Allowlist) allowsName(host, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range a.rules {
+		if r.matchesPort(port) && r.matchesName(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedIP returns an address of the host that the allowlist permits,
+// resolving it if it is a name.
+func (a *Allowlist) allowedIP(host, port string) (net.IP, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		for _, r := range a.rules {
+			if r.network != nil && r.matchesPort(port) && r.network.Contains(ip) {
+				return ip, nil
+			}
+		}
+	}
+	return nil, ErrNotAllowed
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		wantErr bool
+	}{
+		{"names", []string{"example.com", "*.example.com:443", "*"}, false},
+		{"addresses", []string{"10.0.0.1", "10.0.0.0/8:22", "[::1]:8080", "fd00::/8"}, false},
+		{"any port", []string{"example.com:*"}, false},
+		{"empty host", []string{":80"}, true},
+		{"bad port", []string{"example.com:http"}, true},
+		{"port out of range", []string{"example.com:65536"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseAllowlist(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAllowlist(%q) = %v, want error: %v", tt.entries, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowsName(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		host    string
+		port    string
+		want    bool
+	}{
+		{"exact name", []string{"example.com"}, "example.com", "80", true},
+		{"other name", []string{"example.com"}, "example.org", "80", false},
+		{"case and trailing dot", []string{"Example.com"}, "EXAMPLE.com.", "80", true},
+		{"wildcard subdomain", []string{"*.example.com"}, "api.example.com", "443", true},
+		{"wildcard nested subdomain", []string{"*.example.com"}, "a.b.example.com", "443", true},
+		{"wildcard excludes the domain", []string{"*.example.com"}, "example.com", "443", false},
+		{"wildcard excludes lookalikes", []string{"*.example.com"}, "badexample.com", "443", false},
+		{"any host", []string{"*"}, "anything.test", "22", true},
+		{"allowed port", []string{"example.com:443"}, "example.com", "443", true},
+		{"other port", []string{"example.com:443"}, "example.com", "80", false},
+		{"any port", []string{"example.com:*"}, "example.com", "8080", true},
+		{"address rules don't match names", []string{"10.0.0.0/8"}, "example.com", "80", false},
+		{"second rule", []string{"example.org", "example.com:22"}, "example.com", "22", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := ParseAllowlist(tt.entries)
+			if err != nil {
+				t.Fatalf("ParseAllowlist: %v", err)
+			}
+			if got := a.allowsName(tt.host, tt.port); got != tt.want {
+				t.Fatalf("allowsName(%s, %s) = %v, want %v", tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		host    string
+		port    string
+		want    string
+	}{
+		{"address", []string{"10.0.0.1"}, "10.0.0.1", "80", "10.0.0.1"},
+		{"other address", []string{"10.0.0.1"}, "10.0.0.2", "80", ""},
+		{"in range", []string{"10.0.0.0/8"}, "10.20.30.40", "22", "10.20.30.40"},
+		{"out of range", []string{"10.0.0.0/8"}, "192.168.1.1", "22", ""},
+		{"range with port", []string{"192.168.0.0/16:22"}, "192.168.1.1", "22", "192.168.1.1"},
+		{"range with other port", []string{"192.168.0.0/16:22"}, "192.168.1.1", "80", ""},
+		{"ipv6 range", []string{"fd00::/8"}, "fd12::1", "443", "fd12::1"},
+		{"ipv6 outside range", []string{"fd00::/8"}, "2001:db8::1", "443", ""},
+		{"name rules don't match addresses", []string{"*"}, "10.0.0.1", "80", ""},
+		{"resolved name", []string{"127.0.0.0/8"}, "localhost", "80", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := ParseAllowlist(tt.entries)
+			if err != nil {
+				t.Fatalf("ParseAllowlist: %v", err)
+			}
+			ip, err := a.allowedIP(tt.host, tt.port)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNotAllowed) {
+					t.Fatalf("allowedIP(%s, %s) = %v, %v, want ErrNotAllowed", tt.host, tt.port, ip, err)
+				}
+				return
+			}
+			if err != nil || !ip.Equal(net.ParseIP(tt.want)) {
+				t.Fatalf("allowedIP(%s, %s) = %v, %v, want %s", tt.host, tt.port, ip, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name    string
+		allow   []string
+		header  string
+		wantErr error
+	}{
+		{"allowed address", []string{"127.0.0.1:" + port}, "DIAL: 127.0.0.1:" + port + "\n", nil},
+		{"allowed range", []string{"127.0.0.0/8"}, "DIAL: 127.0.0.1:" + port + "\n", nil},
+		{"not allowed", []string{"10.0.0.0/8"}, "DIAL: 127.0.0.1:" + port + "\n", ErrNotAllowed},
+		{"not allowed port", []string{"127.0.0.1:1"}, "DIAL: 127.0.0.1:" + port + "\n", ErrNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDialer(DialerOpts{Allow: tt.allow})
+			if err != nil {
+				t.Fatalf("NewDialer: %v", err)
+			}
+			conn, err := d.Dial(bufio.NewReader(strings.NewReader(tt.header)))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			conn.Close()
+		})
+	}
+
+	d, _ := NewDialer(DialerOpts{Allow: []string{"*"}})
+	if _, err := d.Dial(bufio.NewReader(strings.NewReader("CONNECT: 127.0.0.1:" + port + "\n"))); err == nil {
+		t.Fatal("expected an error for a header that isn't DIAL")
+	}
+	if _, err := NewDialer(DialerOpts{}); err == nil {
+		t.Fatal("expected an allowlist to be required")
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/pipe"
+)
+
+// A client that lets its users choose where to connect sends the
+// destination to the server ahead of the data, as a "DIAL: host:port" line
+// inside the encrypted stream. The server dials the destination on its own
+// network if its allowlist permits it.
+
+const dialPrefix = "DIAL: "
+
+// Request is a connection from a client of a local proxy, asking to be
+// connected to a destination through the tunnel. What the client sends once
+// it is accepted, including anything read along with the request, is read
+// from the request.
+type Request interface {
+	io.ReadWriteCloser
+	// Target is the host:port the client wants to reach.
+	Target() string
+	// Accept tells the client that its connection is ready.
+	Accept() error
+	// Fail tells the client that its connection couldn't be made.
+	Fail()
+}
+
+// ErrNotAllowed is returned for destinations the allowlist doesn't permit.
+var ErrNotAllowed = errors.New("destination not allowed")
+
+// Header returns the line that asks the server to dial a destination.
+func Header(target string) []byte {
+	return []byte(dialPrefix + target + "\n")
+}
+
+// readTarget reads the destination from the header.
+func readTarget(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("error reading destination: %s", err.Error())
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, dialPrefix) {
+		return "", fmt.Errorf("invalid destination: %q", line)
+	}
+	return strings.TrimPrefix(line, dialPrefix), nil
+}
+
+// Dialer connects clients to the destinations they ask for.
+type Dialer struct {
+	allow   *Allowlist
+	timeout time.Duration
+	debug   bool
+}
+
+type DialerOpts struct {
+	Allow []string
+	Debug bool
+}
+
+func NewDialer(opts DialerOpts) (*Dialer, error) {
+	if len(opts.Allow) == 0 {
+		return nil, errors.New("an allowlist is required to dial destinations")
+	}
+	allow, err := ParseAllowlist(opts.Allow)
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{
+		allow:   allow,
+		timeout: time.Second * 10,
+		debug:   opts.Debug,
+	}, nil
+}
+
+// Dial reads the destination from the header at the start of r and connects
+// to it. The rest of what the client sent is left in r.
+func (d *Dialer) Dial(r *bufio.Reader) (net.Conn, error) {
+	target, err := readTarget(r)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %s: %s", target, err.Error())
+	}
+
+	// a destination allowed by name is dialed by name, and one allowed by
+	// address is dialed at the address that was checked, so that the name
+	// can't resolve somewhere else in between
+	address := target
+	if !d.allow.allowsName(host, port) {
+		ip, err := d.allow.allowedIP(host, port)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", target, err)
+		}
+		address = net.JoinHostPort(ip.String(), port)
+	}
+
+	if d.debug {
+		log.Printf("Dialing %s for a client\n", target)
+	}
+	conn, err := net.DialTimeout("tcp", address, d.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %s", target, err.Error())
+	}
+	return conn, nil
+}
+
+// Accept reads the destination from the start of a client stream and
+// connects to it, returning the connection and the client stream to join
+// it with.
+func (d *Dialer) Accept(client io.ReadWriteCloser) (net.Conn, io.ReadWriteCloser, error) {
+	reader := bufio.NewReader(client)
+	conn, err := d.Dial(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, pipe.Prefixed(client, reader), nil
+}
@@ -0,0 +1,257 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The PROXY protocol carries the address a client connected from, and the
+// address it connected to, ahead of its data on a proxied connection.
+// Version 1 is a line of text and version 2 is binary.
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Size is the longest a version 1 header can be.
+const maxV1Size = 107
+
+// headerTimeout is how long a connection has to send its header.
+const headerTimeout = time.Second * 10
+
+// Version is a version of the protocol to write.
+type Version int
+
+const (
+	V1 Version = 1
+	V2 Version = 2
+)
+
+// ParseVersion parses "v1" or "v2", and returns 0 for an empty string.
+func ParseVersion(s string) (Version, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return V1, nil
+	case "v2", "2":
+		return V2, nil
+	default:
+		return 0, fmt.Errorf("unknown PROXY protocol version: %s", s)
+	}
+}
+
+// WriteHeader writes a header for a connection from source to destination,
+// given as host:port addresses. Addresses that aren't IPs of the same
+// family are written as unknown.
+func WriteHeader(w io.Writer, version Version, source, destination string) error {
+	src, dst := parseAddr(source), parseAddr(destination)
+	if src != nil && dst != nil && (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		src, dst = nil, nil
+	}
+
+	var header []byte
+	switch version {
+	case V1:
+		header = v1Header(src, dst)
+	case V2:
+		header = v2Header(src, dst)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version: %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+func v1Header(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP.String(), dst.IP.String(), src.Port, dst.Port))
+}
+
+func v2Header(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+	switch {
+	case src == nil || dst == nil:
+		buf.Write([]byte{0x00, 0, 0})
+	case src.IP.To4() != nil:
+		buf.WriteByte(0x11)
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+		buf.Write(src.IP.To4())
+		buf.Write(dst.IP.To4())
+		binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	default:
+		buf.WriteByte(0x21)
+		binary.Write(&buf, binary.BigEndian, uint16(36))
+		buf.Write(src.IP.To16())
+		buf.Write(dst.IP.To16())
+		binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	}
+	return buf.Bytes()
+}
+
+func parseAddr(address string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
+
+// ReadHeader reads a version 1 or 2 header, returning the source and
+// destination it carries, or nil for a connection that isn't proxied.
+func ReadHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil && len(start) < len("PROXY ") {
+		return nil, nil, fmt.Errorf("error reading PROXY header: %s", err.Error())
+	}
+	if bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, nil, errors.New("missing PROXY header")
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Size {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading PROXY header: %s", err.Error())
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY header is too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY header: %q", strings.TrimSpace(string(line)))
+	}
+	src := parseAddr(net.JoinHostPort(fields[2], fields[4]))
+	dst := parseAddr(net.JoinHostPort(fields[3], fields[5]))
+	if src == nil || dst == nil || !inFamily(fields[1], fields[2]) || !inFamily(fields[1], fields[3]) {
+		return nil, nil, fmt.Errorf("invalid PROXY header: %q", strings.TrimSpace(string(line)))
+	}
+	return src, dst, nil
+}
+
+// inFamily reports whether an address in a version 1 header is written the
+// way its family says, dotted for TCP4 and with colons for TCP6.
+func inFamily(family, ip string) bool {
+	return strings.Contains(ip, ":") == (family == "TCP6")
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY header: %s", err.Error())
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY header: %s", err.Error())
+	}
+
+	// a LOCAL command, like a health check from the proxy, isn't proxied
+	if header[12]&0x0f == 0x00 {
+		return nil, nil, nil
+	}
+
+	var size int
+	switch header[13] {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("PROXY header is too short")
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return src, dst, nil
+}
+
+// Conn is a connection that started with a header. Its remote address is
+// the source the header carried, and its local address the destination.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+// Accept reads the header a load balancer sends at the start of a
+// connection, which it must send.
+func Accept(conn net.Conn) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	src, dst, err := ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &Conn{Conn: conn, reader: reader, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	if src != nil {
+		c.remote, c.local = src, dst
+	}
+	return c, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// CloseWrite closes the sending side of the connection if it can.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
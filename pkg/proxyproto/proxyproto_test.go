@@ -0,0 +1,152 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		destination string
+		// proxied is false for addresses that are written as unknown
+		proxied bool
+	}{
+		{"ipv4", "192.0.2.1:56324", "198.51.100.7:443", true},
+		{"ipv6", "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"ipv4 mapped", "[::ffff:192.0.2.1]:1", "198.51.100.7:2", true},
+		{"mixed families", "192.0.2.1:56324", "[2001:db8::2]:443", false},
+		{"not an ip", "client.example.com:56324", "198.51.100.7:443", false},
+		{"no port", "192.0.2.1", "198.51.100.7:443", false},
+		{"port out of range", "192.0.2.1:70000", "198.51.100.7:443", false},
+	}
+	for _, version := range []Version{V1, V2} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("v%d %s", version, tt.name), func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := WriteHeader(&buf, version, tt.source, tt.destination); err != nil {
+					t.Fatalf("WriteHeader: %v", err)
+				}
+				buf.WriteString("data")
+
+				r := bufio.NewReader(&buf)
+				src, dst, err := ReadHeader(r)
+				if err != nil {
+					t.Fatalf("ReadHeader: %v", err)
+				}
+				if !tt.proxied {
+					if src != nil || dst != nil {
+						t.Fatalf("got %v %v, want unknown", src, dst)
+					}
+				} else {
+					if !sameAddr(src, tt.source) || !sameAddr(dst, tt.destination) {
+						t.Fatalf("got %v %v, want %s %s", src, dst, tt.source, tt.destination)
+					}
+				}
+
+				rest, _ := io.ReadAll(r)
+				if string(rest) != "data" {
+					t.Fatalf("data after header is %q", rest)
+				}
+			})
+		}
+	}
+}
+
+func sameAddr(addr net.Addr, want string) bool {
+	w := parseAddr(want)
+	a, ok := addr.(*net.TCPAddr)
+	return ok && w != nil && a.IP.Equal(w.IP) && a.Port == w.Port
+}
+
+func TestReadHeaderUnproxied(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"v1 unknown", "PROXY UNKNOWN\r\n"},
+		{"v1 unknown with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.7 1 2\r\n"},
+		{"v2 local", string(v2Signature) + "\x20\x00\x00\x00"},
+		{"v2 local with addresses", string(v2Signature) + "\x20\x11\x00\x0c" + strings.Repeat("\x01", 12)},
+		{"v2 unspecified family", string(v2Signature) + "\x21\x00\x00\x00"},
+		{"v2 unix family", string(v2Signature) + "\x21\x31\x00\x04abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "data"))
+			src, dst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			if src != nil || dst != nil {
+				t.Fatalf("got %v %v, want no addresses", src, dst)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "data" {
+				t.Fatalf("data after header is %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	v4 := "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc6\x33\x64\x07" + "\x00\x01\x00\x02"
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"empty", ""},
+		{"no header", "GET / HTTP/1.1\r\n\r\n"},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 198.51.100.7 1"},
+		{"v1 without crlf", "PROXY TCP4 192.0.2.1 198.51.100.7 1 2\n"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", maxV1Size) + "\r\n"},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.7 1\r\n"},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.7 1 65536\r\n"},
+		{"v1 bad address", "PROXY TCP4 192.0.2 198.51.100.7 1 2\r\n"},
+		{"v1 unknown family", "PROXY UDP4 192.0.2.1 198.51.100.7 1 2\r\n"},
+		{"v1 tcp4 with ipv6", "PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n"},
+		{"v1 tcp6 with ipv4", "PROXY TCP6 192.0.2.1 198.51.100.7 1 2\r\n"},
+		{"v1 tcp4 mixed", "PROXY TCP4 192.0.2.1 2001:db8::2 1 2\r\n"},
+		{"v2 signature only", string(v2Signature)},
+		{"v2 truncated header", string(v2Signature) + "\x21\x11"},
+		{"v2 truncated body", string(v2Signature) + v4[:10]},
+		{"v2 body too short", string(v2Signature) + "\x21\x11\x00\x04\xc0\x00\x02\x01"},
+		{"v2 wrong version", string(v2Signature) + "\x11" + v4[1:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.header)))
+			if err == nil {
+				t.Fatal("ReadHeader succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		WriteHeader(client, V2, "192.0.2.1:56324", "198.51.100.7:443")
+		client.Write([]byte("data"))
+	}()
+
+	conn, err := Accept(server)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	if !sameAddr(conn.RemoteAddr(), "192.0.2.1:56324") || !sameAddr(conn.LocalAddr(), "198.51.100.7:443") {
+		t.Fatalf("got %v %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
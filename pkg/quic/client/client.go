@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/protocol"
+	"github.com/cbodonnell/net/pkg/quic/transport"
+	"github.com/cbodonnell/net/pkg/relays"
+	"github.com/quic-go/quic-go"
+)
+
+type QUICClient struct {
+	port        uint
+	relay       *relayConn
+	serverName  string
+	cipher      crypto.Cipher
+	dialTimeout time.Duration
+	debug       bool
+}
+
+type QUICClientOpts struct {
+	Port         uint
+	RelayAddress string
+	ServerName   string
+	Key          []byte
+	DialTimeout  string
+	Debug        bool
+}
+
+func NewQUICClient(opts QUICClientOpts) (*QUICClient, error) {
+	cipher, err := crypto.NewAESCipher(crypto.AESCipherOpts{Key: opts.Key})
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
+	}
+
+	dialTimeout := time.Second * 5
+	if opts.DialTimeout != "" {
+		dialTimeout, err = time.ParseDuration(opts.DialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing dial timeout: %s", err.Error())
+		}
+	}
+
+	relayList, err := relays.Parse(opts.RelayAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing relay address: %s", err.Error())
+	}
+
+	return &QUICClient{
+		port:        opts.Port,
+		relay:       sharedRelay(opts.RelayAddress, relayList),
+		serverName:  opts.ServerName,
+		cipher:      cipher,
+		dialTimeout: dialTimeout,
+		debug:       opts.Debug,
+	}, nil
+}
+
+func (c *QUICClient) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := c.Serve(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return errors.New("interrupted")
+}
+
+// Serve listens for client connections until the context is done and
+// carries each one to the server on its own stream.
+func (c *QUICClient) Serve(ctx context.Context) error {
+	portString := fmt.Sprintf(":%d", c.port)
+	if c.debug {
+		log.Printf("Listening for client on %s\n", portString)
+	}
+
+	listener, err := net.Listen("tcp", portString)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	c.relay.acquire()
+	defer c.relay.release()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		clientConn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error accepting from client: %s", err.Error())
+		}
+		go func() {
+			if err := c.handleRequest(ctx, clientConn); err != nil {
+				fmt.Fprintf(os.Stderr, "error handling request: %s\n", err.Error())
+			}
+		}()
+	}
+}
+
+func (c *QUICClient) handleRequest(ctx context.Context, clientConn net.Conn) error {
+	serverConn, err := c.DialStream(ctx)
+	if err != nil {
+		clientConn.Close()
+		return err
+	}
+
+	if c.debug {
+		log.Printf("Streaming %s to %s\n", clientConn.RemoteAddr().String(), c.serverName)
+	}
+
+	pipe.Join(clientConn, serverConn)
+	return nil
+}
+
+// DialStream opens an encrypted stream to the server.
+func (c *QUICClient) DialStream(ctx context.Context) (*crypto.Conn, error) {
+	conn, err := c.dialStream(ctx)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// the early data was dropped, send it again on the full connection
+		conn, err = c.dialStream(ctx)
+	}
+	return conn, err
+}
+
+func (c *QUICClient) dialStream(ctx context.Context) (*crypto.Conn, error) {
+	stream, conn, err := c.openStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := protocol.WriteLine(stream, "CONNECT", c.serverName); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("error writing to relay: %s", err.Error())
+	}
+
+	stream.SetReadDeadline(time.Now().Add(c.dialTimeout))
+	line, err := transport.ReadLine(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		switch {
+		case errors.Is(err, quic.Err0RTTRejected):
+			// a rejected stream is already gone, and its id is reused on the next connection
+			c.relay.recover(conn, err)
+		case connectionError(err):
+			stream.Close()
+			c.relay.closeConn(conn)
+		default:
+			// only the stream failed, like when the relay is slow to answer,
+			// and the connection carries on for the other streams
+			stream.Close()
+		}
+		return nil, fmt.Errorf("error reading from relay: %w", err)
+	}
+
+	result, value, err := protocol.ParseLine(line)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	switch result {
+	case "SUCCESS":
+		return crypto.NewConn(stream, c.cipher), nil
+	case "FAIL":
+		stream.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %s", c.serverName, value)
+	default:
+		stream.Close()
+		return nil, fmt.Errorf("unknown result: %s", result)
+	}
+}
+
+// connectionError reports whether an error ended the whole connection to the
+// relay, rather than only the stream it came from.
+func connectionError(err error) bool {
+	var (
+		transportErr   *quic.TransportError
+		applicationErr *quic.ApplicationError
+		idleErr        *quic.IdleTimeoutError
+		handshakeErr   *quic.HandshakeTimeoutError
+		resetErr       *quic.StatelessResetError
+		versionErr     *quic.VersionNegotiationError
+	)
+	return errors.As(err, &transportErr) ||
+		errors.As(err, &applicationErr) ||
+		errors.As(err, &idleErr) ||
+		errors.As(err, &handshakeErr) ||
+		errors.As(err, &resetErr) ||
+		errors.As(err, &versionErr)
+}
+
+// openStream opens a stream on the connection to the relay, reconnecting
+// once if the connection has gone away.
+func (c *QUICClient) openStream(ctx context.Context) (transport.Stream, quic.Connection, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := c.relay.connect(ctx, c.dialTimeout, c.debug)
+		if err != nil {
+			return transport.Stream{}, nil, err
+		}
+
+		stream, err := conn.OpenStreamSync(ctx)
+		if err == nil {
+			return transport.Stream{Stream: stream}, conn, nil
+		}
+
+		c.relay.recover(conn, err)
+		if attempt > 0 || ctx.Err() != nil {
+			return transport.Stream{}, nil, fmt.Errorf("error opening stream: %w", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/quic/transport"
+	"github.com/cbodonnell/net/pkg/relays"
+	"github.com/quic-go/quic-go"
+)
+
+// relayConn is a connection to a relay. Every client in the process that
+// uses the same relays shares it, since each stream names its own server.
+type relayConn struct {
+	relays    *relays.List
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	conn      quic.Connection
+	// users is the number of clients serving over the connection
+	users int
+}
+
+var (
+	relayConnsMu sync.Mutex
+	relayConns   = make(map[string]*relayConn)
+)
+
+// sharedRelay returns the connection to the relays at an address, creating
+// it for the first client that uses them.
+func sharedRelay(address string, relayList *relays.List) *relayConn {
+	relayConnsMu.Lock()
+	defer relayConnsMu.Unlock()
+
+	r, ok := relayConns[address]
+	if !ok {
+		r = &relayConn{
+			relays:    relayList,
+			tlsConfig: transport.ClientTLSConfig(),
+		}
+		relayConns[address] = r
+	}
+	return r
+}
+
+// acquire counts a client serving over the connection.
+func (r *relayConn) acquire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users++
+}
+
+// release counts a client that stopped serving, and closes the connection
+// once no client is left.
+func (r *relayConn) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.users--
+	if r.users > 0 || r.conn == nil {
+		return
+	}
+	r.conn.CloseWithError(0, "closed")
+	r.conn = nil
+}
+
+// connect returns the connection to the relay, dialing it if needed. A
+// redial to the same relay resumes the TLS session and sends 0-RTT data.
+func (r *relayConn) connect(ctx context.Context, dialTimeout time.Duration, debug bool) (quic.Connection, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != nil && r.conn.Context().Err() == nil {
+		return r.conn, nil
+	}
+
+	// try the relays in order, so that a relay that is down fails over to the next
+	var conn quic.Connection
+	err := r.relays.Try(func(address string) error {
+		if debug {
+			log.Printf("Connecting to %s\n", address)
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+		var err error
+		conn, err = quic.DialAddrEarly(dialCtx, address, r.tlsConfig, transport.Config())
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to relay: %s", err.Error())
+	}
+
+	r.conn = conn
+	return conn, nil
+}
+
+// recover handles a failure on the connection to the relay. If the relay
+// rejected our 0-RTT data, for instance because it restarted and lost the
+// session, the connection continues once the full handshake completes.
+// Otherwise it is closed so that the next stream dials again.
+func (r *relayConn) recover(conn quic.Connection, err error) {
+	early, ok := conn.(quic.EarlyConnection)
+	if !ok || !errors.Is(err, quic.Err0RTTRejected) {
+		r.closeConn(conn)
+		return
+	}
+
+	next := early.NextConnection()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == conn {
+		r.conn = next
+	}
+}
+
+// closeConn closes the connection to the relay if it is still the given one.
+func (r *relayConn) closeConn(conn quic.Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == nil || r.conn != conn {
+		return
+	}
+	r.conn.CloseWithError(0, "closed")
+	r.conn = nil
+}
@@ -0,0 +1,404 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/admin"
+	"github.com/cbodonnell/net/pkg/balance"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/protocol"
+	"github.com/cbodonnell/net/pkg/quic/transport"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICRelay joins client streams to the connection of the server they name.
+// Every agent keeps a single QUIC connection to the relay and opens one
+// stream per session, so sessions don't block each other and don't dial.
+type QUICRelay struct {
+	clientPort   uint
+	serverPort   uint
+	adminAddress string
+	policy       balance.Policy
+	sticky       bool
+	debug        bool
+	mu           sync.Mutex
+	servers      map[string]*service
+	sessions     map[string]*admin.SessionInfo
+	draining     bool
+}
+
+// service is the set of servers registered under one name, by address.
+type service struct {
+	pool          *balance.Pool
+	registrations map[string]*registration
+}
+
+type registration struct {
+	conn       quic.Connection
+	registered time.Time
+}
+
+type QUICRelayOpts struct {
+	ClientPort   uint
+	ServerPort   uint
+	AdminAddress string
+	Policy       string
+	Sticky       bool
+	Debug        bool
+}
+
+func NewQUICRelay(opts QUICRelayOpts) (*QUICRelay, error) {
+	policy, err := balance.ParsePolicy(opts.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QUICRelay{
+		clientPort:   opts.ClientPort,
+		serverPort:   opts.ServerPort,
+		adminAddress: opts.AdminAddress,
+		policy:       policy,
+		sticky:       opts.Sticky,
+		debug:        opts.Debug,
+		servers:      make(map[string]*service),
+		sessions:     make(map[string]*admin.SessionInfo),
+	}, nil
+}
+
+func (r *QUICRelay) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	tlsConfig, err := transport.ServerTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	clientListener, err := quic.ListenAddrEarly(fmt.Sprintf(":%d", r.clientPort), tlsConfig, transport.Config())
+	if err != nil {
+		return fmt.Errorf("error listening on client port: %s", err)
+	}
+	defer clientListener.Close()
+
+	serverListener, err := quic.ListenAddrEarly(fmt.Sprintf(":%d", r.serverPort), tlsConfig, transport.Config())
+	if err != nil {
+		return fmt.Errorf("error listening on server port: %s", err)
+	}
+	defer serverListener.Close()
+
+	if r.debug {
+		log.Printf("Listening for clients on %s\n", clientListener.Addr().String())
+		log.Printf("Listening for servers on %s\n", serverListener.Addr().String())
+	}
+
+	errChan := make(chan error, 3)
+
+	go r.acceptConnections(ctx, clientListener, r.handleClient, errChan)
+	go r.acceptConnections(ctx, serverListener, r.handleServer, errChan)
+
+	if r.adminAddress != "" {
+		adminServer := admin.NewAdminServer(admin.AdminServerOpts{
+			Address: r.adminAddress,
+			Relay:   r,
+			Debug:   r.debug,
+		})
+		go func() {
+			errChan <- adminServer.Run()
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return errors.New("interrupted")
+	case err := <-errChan:
+		return fmt.Errorf("error: %s", err)
+	}
+}
+
+func (r *QUICRelay) acceptConnections(ctx context.Context, listener *quic.EarlyListener, handle func(context.Context, quic.Connection), errChan chan<- error) {
+	for {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			errChan <- fmt.Errorf("error accepting connection: %s", err.Error())
+			return
+		}
+		go handle(ctx, conn)
+	}
+}
+
+// handleServer waits for a server to register on its first stream and keeps
+// the registration until the connection closes.
+func (r *QUICRelay) handleServer(ctx context.Context, conn quic.Connection) {
+	address := conn.RemoteAddr().String()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error accepting control stream from %s: %s\n", address, err.Error())
+		return
+	}
+
+	line, err := transport.ReadLine(stream)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading from %s: %s\n", address, err.Error())
+		conn.CloseWithError(0, "invalid registration")
+		return
+	}
+	action, value, err := protocol.ParseLine(line)
+	if err != nil || action != "REGISTER" {
+		protocol.WriteLine(stream, "FAIL", "NOT ALLOWED")
+		conn.CloseWithError(0, "invalid registration")
+		return
+	}
+	name, weight, err := parseRegistration(value)
+	if err != nil {
+		protocol.WriteLine(stream, "FAIL", "BAD REQUEST")
+		conn.CloseWithError(0, "invalid registration")
+		return
+	}
+
+	r.mu.Lock()
+	if r.draining {
+		r.mu.Unlock()
+		protocol.WriteLine(stream, "FAIL", "DRAINING")
+		conn.CloseWithError(0, "draining")
+		return
+	}
+	svc, ok := r.servers[name]
+	if !ok {
+		svc = &service{
+			pool:          balance.NewPool(r.policy, r.sticky),
+			registrations: make(map[string]*registration),
+		}
+		r.servers[name] = svc
+	}
+	server := &registration{conn: conn, registered: time.Now()}
+	svc.registrations[address] = server
+	svc.pool.Add(address, weight)
+	r.mu.Unlock()
+
+	if r.debug {
+		log.Printf("[REGISTER] %s as %s with weight %d\n", address, name, weight)
+	}
+	protocol.WriteLine(stream, "SUCCESS", name)
+
+	<-conn.Context().Done()
+
+	r.mu.Lock()
+	if svc.registrations[address] == server {
+		r.unregister(name, address)
+	}
+	r.mu.Unlock()
+
+	if r.debug {
+		log.Printf("[UNREGISTER] %s from %s\n", address, name)
+	}
+}
+
+// handleClient joins every stream a client opens to a stream on the server's connection.
+func (r *QUICRelay) handleClient(ctx context.Context, conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := r.handleClientStream(conn, transport.Stream{Stream: stream}); err != nil {
+				fmt.Fprintf(os.Stderr, "error handling client stream: %s\n", err.Error())
+			}
+		}()
+	}
+}
+
+func (r *QUICRelay) handleClientStream(conn quic.Connection, clientStream transport.Stream) error {
+	line, err := transport.ReadLine(clientStream)
+	if err != nil {
+		clientStream.Close()
+		return fmt.Errorf("error reading from client: %s", err.Error())
+	}
+	action, name, err := protocol.ParseLine(line)
+	if err != nil || action != "CONNECT" {
+		protocol.WriteLine(clientStream, "FAIL", "NOT ALLOWED")
+		clientStream.Close()
+		return fmt.Errorf("invalid request from client: %s", line)
+	}
+
+	clientIP := balance.ClientID(conn.RemoteAddr())
+
+	r.mu.Lock()
+	draining := r.draining
+	var server *registration
+	var backend *balance.Backend
+	svc, ok := r.servers[name]
+	if ok && !draining {
+		backend, _ = svc.pool.Pick(clientIP, nil)
+		server = svc.registrations[backend.ID]
+		svc.pool.Acquire(backend.ID)
+	}
+	r.mu.Unlock()
+
+	switch {
+	case draining:
+		protocol.WriteLine(clientStream, "FAIL", "DRAINING")
+		clientStream.Close()
+		return fmt.Errorf("draining, rejected connect to %s", name)
+	case !ok:
+		protocol.WriteLine(clientStream, "FAIL", "NOT REGISTERED")
+		clientStream.Close()
+		return fmt.Errorf("target not registered: %s", name)
+	}
+
+	defer func() {
+		r.mu.Lock()
+		svc.pool.Release(backend.ID)
+		r.mu.Unlock()
+	}()
+
+	stream, err := server.conn.OpenStreamSync(clientStream.Context())
+	if err != nil {
+		protocol.WriteLine(clientStream, "FAIL", "UNAVAILABLE")
+		clientStream.Close()
+		return fmt.Errorf("error opening stream to %s at %s: %s", name, backend.ID, err.Error())
+	}
+	serverStream := transport.Stream{Stream: stream}
+
+	client := fmt.Sprintf("%s/%d", conn.RemoteAddr().String(), clientStream.StreamID())
+	// the stream only reaches the server once something is written to it
+	if err := protocol.WriteLine(serverStream, "SESSION", conn.RemoteAddr().String()); err != nil {
+		serverStream.Close()
+		clientStream.Close()
+		return fmt.Errorf("error writing to %s: %s", name, err.Error())
+	}
+	if err := protocol.WriteLine(clientStream, "SUCCESS", name); err != nil {
+		serverStream.Close()
+		clientStream.Close()
+		return fmt.Errorf("error writing to client: %s", err.Error())
+	}
+
+	r.mu.Lock()
+	r.sessions[client] = &admin.SessionInfo{Client: client, Server: fmt.Sprintf("%s (%s)", name, backend.ID), Started: time.Now()}
+	r.mu.Unlock()
+
+	if r.debug {
+		log.Printf("[CONNECT] %s to %s at %s\n", client, name, backend.ID)
+	}
+
+	pipe.Join(clientStream, serverStream)
+
+	r.mu.Lock()
+	delete(r.sessions, client)
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *QUICRelay) Servers() []admin.ServerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	servers := make([]admin.ServerInfo, 0, len(r.servers))
+	for name, svc := range r.servers {
+		for _, backend := range svc.pool.Backends() {
+			servers = append(servers, admin.ServerInfo{
+				Name:        name,
+				Address:     backend.ID,
+				LastPing:    svc.registrations[backend.ID].registered,
+				Weight:      backend.Weight,
+				Connections: backend.Conns,
+			})
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers
+}
+
+func (r *QUICRelay) Sessions() []admin.SessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]admin.SessionInfo, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions
+}
+
+// Unregister closes the connections of every server registered under a
+// name, or of the one server at an address, ending their sessions.
+func (r *QUICRelay) Unregister(target string) error {
+	r.mu.Lock()
+	var conns []quic.Connection
+	if svc, ok := r.servers[target]; ok {
+		for address, server := range svc.registrations {
+			conns = append(conns, server.conn)
+			r.unregister(target, address)
+		}
+	} else {
+		for name, svc := range r.servers {
+			if server, ok := svc.registrations[target]; ok {
+				conns = append(conns, server.conn)
+				r.unregister(name, target)
+				break
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	if len(conns) == 0 {
+		return fmt.Errorf("%s: %w", target, admin.ErrNotRegistered)
+	}
+	for _, conn := range conns {
+		conn.CloseWithError(0, "unregistered")
+	}
+	return nil
+}
+
+// unregister removes the server at an address, and the name once no server
+// is left under it. The caller must hold r.mu.
+func (r *QUICRelay) unregister(name, address string) {
+	svc, ok := r.servers[name]
+	if !ok {
+		return
+	}
+	delete(svc.registrations, address)
+	svc.pool.Remove(address)
+	if len(svc.registrations) == 0 {
+		delete(r.servers, name)
+	}
+}
+
+// parseRegistration parses a server's name and the weight that may follow it.
+func parseRegistration(value string) (string, int, error) {
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 1:
+		return fields[0], 1, nil
+	case 2:
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil || weight < 1 {
+			return "", 0, fmt.Errorf("invalid weight: %s", fields[1])
+		}
+		return fields[0], weight, nil
+	default:
+		return "", 0, fmt.Errorf("invalid registration: %s", value)
+	}
+}
+
+// Drain rejects new registrations and sessions. Existing sessions continue.
+func (r *QUICRelay) Drain() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+	return nil
+}
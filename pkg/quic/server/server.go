@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/backoff"
+	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/health"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/protocol"
+	"github.com/cbodonnell/net/pkg/quic/transport"
+	"github.com/cbodonnell/net/pkg/relays"
+	"github.com/quic-go/quic-go"
+)
+
+type QUICServer struct {
+	*backoff.Circuits
+	relays        []string
+	serverAddress string
+	serverName    string
+	weight        uint
+	listenAddress string
+	cipher        crypto.Cipher
+	tlsConfig     *tls.Config
+	health        *health.Monitor
+	debug         bool
+}
+
+type QUICServerOpts struct {
+	RelayAddress     string
+	ServerAddress    string
+	ServerName       string
+	Weight           uint
+	ListenAddress    string
+	Key              []byte
+	RetryDuration    string
+	MaxRetryDuration string
+	CircuitThreshold uint
+	HealthCheck      string
+	HealthInterval   string
+	HealthTimeout    string
+	HealthThreshold  uint
+	Debug            bool
+}
+
+func NewQUICServer(opts QUICServerOpts) (*QUICServer, error) {
+	cipher, err := crypto.NewAESCipher(crypto.AESCipherOpts{Key: opts.Key})
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
+	}
+
+	// servers register with every relay, looked up once
+	var relayAddresses []string
+	if opts.RelayAddress != "" {
+		relayList, err := relays.Parse(opts.RelayAddress)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing relay address: %s", err.Error())
+		}
+		relayAddresses = relayList.All()
+	}
+
+	circuits, err := backoff.NewCircuits(relayAddresses, backoff.BackoffOpts{
+		Min:       opts.RetryDuration,
+		Max:       opts.MaxRetryDuration,
+		Threshold: opts.CircuitThreshold,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	monitor, err := health.NewMonitor(health.MonitorOpts{
+		Check:     opts.HealthCheck,
+		Address:   opts.ServerAddress,
+		Interval:  opts.HealthInterval,
+		Timeout:   opts.HealthTimeout,
+		Threshold: opts.HealthThreshold,
+		Debug:     opts.Debug,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating health check: %s", err.Error())
+	}
+
+	return &QUICServer{
+		relays:        relayAddresses,
+		serverAddress: opts.ServerAddress,
+		serverName:    opts.ServerName,
+		weight:        opts.Weight,
+		listenAddress: opts.ListenAddress,
+		cipher:        cipher,
+		Circuits:      circuits,
+		tlsConfig:     transport.ClientTLSConfig(),
+		health:        monitor,
+		debug:         opts.Debug,
+	}, nil
+}
+
+func (s *QUICServer) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := s.Serve(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return errors.New("interrupted")
+}
+
+// Serve registers with the relay and serves the streams it forwards until
+// the context is done. With a listen address, clients may also connect
+// directly, and the relay is optional.
+func (s *QUICServer) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.health.Run(ctx)
+
+	if s.listenAddress != "" {
+		if len(s.relays) == 0 {
+			return s.serveDirect(ctx)
+		}
+		go func() {
+			if err := s.serveDirect(ctx); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Error serving direct connections: %s\n", err.Error())
+			}
+		}()
+	}
+
+	return relays.ServeEach(ctx, s.relays, s.serveRelay)
+}
+
+// serveRelay registers with one relay and serves the streams it forwards
+// until the context is done.
+func (s *QUICServer) serveRelay(ctx context.Context, relayAddress string) error {
+	retryBackoff := s.Circuits.For(relayAddress)
+	for {
+		if err := s.health.Wait(ctx); err != nil {
+			return err
+		}
+		if err := s.registerAndServe(ctx, relayAddress, retryBackoff); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, errUnhealthy) {
+				continue
+			}
+			delay := retryBackoff.Failure()
+			fmt.Fprintf(os.Stderr, "Error registering and serving: %s\n", err.Error())
+			fmt.Fprintf(os.Stderr, "Retrying in %s\n", delay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// errUnhealthy is returned by registerAndServe when the backend becomes unhealthy.
+var errUnhealthy = errors.New("backend is unhealthy")
+
+func (s *QUICServer) registerAndServe(ctx context.Context, relayAddress string, retryBackoff *backoff.Backoff) error {
+	// the connection is long lived, so there is nothing to gain from 0-RTT
+	conn, err := quic.DialAddr(ctx, relayAddress, s.tlsConfig, transport.Config())
+	if err != nil {
+		return fmt.Errorf("error connecting to relay: %s", err.Error())
+	}
+	defer conn.CloseWithError(0, "closed")
+
+	control, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("error opening control stream: %s", err.Error())
+	}
+	registration := s.serverName
+	if s.weight > 0 {
+		registration = fmt.Sprintf("%s %d", registration, s.weight)
+	}
+	if err := protocol.WriteLine(control, "REGISTER", registration); err != nil {
+		return fmt.Errorf("error registering: %s", err.Error())
+	}
+	line, err := transport.ReadLine(control)
+	if err != nil {
+		return fmt.Errorf("error reading registration: %s", err.Error())
+	}
+	result, value, err := protocol.ParseLine(line)
+	if err != nil {
+		return err
+	}
+	if result != "SUCCESS" {
+		return fmt.Errorf("failed to register: %s", value)
+	}
+
+	fmt.Printf("Registered as %s with %s\n", value, relayAddress)
+	retryBackoff.Success()
+
+	// closing the connection withdraws the registration until the backend recovers
+	down := s.health.Down()
+	unhealthy := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-down:
+			fmt.Println("Unregistering while the backend is unhealthy")
+			close(unhealthy)
+			conn.CloseWithError(0, "unhealthy")
+		case <-done:
+		}
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			select {
+			case <-unhealthy:
+				return errUnhealthy
+			default:
+			}
+			return fmt.Errorf("error accepting stream: %s", err.Error())
+		}
+		go s.handleSession(transport.Stream{Stream: stream})
+	}
+}
+
+// handleSession connects a stream forwarded by the relay to the server.
+func (s *QUICServer) handleSession(stream transport.Stream) {
+	line, err := transport.ReadLine(stream)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading session: %s\n", err.Error())
+		stream.Close()
+		return
+	}
+	action, client, err := protocol.ParseLine(line)
+	if err != nil || action != "SESSION" {
+		fmt.Fprintf(os.Stderr, "invalid session from relay: %s\n", line)
+		stream.Close()
+		return
+	}
+
+	s.connect(stream, client)
+}
+
+// serveDirect accepts connections from clients that dial us instead of the relay.
+func (s *QUICServer) serveDirect(ctx context.Context) error {
+	tlsConfig, err := transport.ServerTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	listener, err := quic.ListenAddrEarly(s.listenAddress, tlsConfig, transport.Config())
+	if err != nil {
+		return fmt.Errorf("error listening for clients: %s", err.Error())
+	}
+	defer listener.Close()
+
+	if s.debug {
+		log.Printf("Listening for clients on %s\n", listener.Addr().String())
+	}
+
+	for {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error accepting from client: %s", err.Error())
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(ctx)
+				if err != nil {
+					return
+				}
+				go s.handleDirect(conn, transport.Stream{Stream: stream})
+			}
+		}()
+	}
+}
+
+// handleDirect answers a client's CONNECT the way the relay would.
+func (s *QUICServer) handleDirect(conn quic.Connection, stream transport.Stream) {
+	line, err := transport.ReadLine(stream)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	action, name, err := protocol.ParseLine(line)
+	if err != nil || action != "CONNECT" {
+		protocol.WriteLine(stream, "FAIL", "NOT ALLOWED")
+		stream.Close()
+		return
+	}
+	// an unhealthy backend is withdrawn from direct clients as it is from the relay
+	if name != s.serverName || !s.health.Healthy() {
+		protocol.WriteLine(stream, "FAIL", "NOT REGISTERED")
+		stream.Close()
+		return
+	}
+	if err := protocol.WriteLine(stream, "SUCCESS", name); err != nil {
+		stream.Close()
+		return
+	}
+
+	s.connect(stream, conn.RemoteAddr().String())
+}
+
+func (s *QUICServer) connect(stream transport.Stream, client string) {
+	serverConn, err := net.Dial("tcp", s.serverAddress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to server: %s\n", err.Error())
+		stream.Close()
+		return
+	}
+
+	if s.debug {
+		log.Printf("Streaming %s to %s\n", client, s.serverAddress)
+	}
+
+	pipe.Join(serverConn, crypto.NewConn(stream, s.cipher))
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the application protocol agents and relays negotiate.
+const ALPN = "net-relay"
+
+const maxLineLength = 512
+
+// Config is the QUIC configuration shared by agents and relays. Keep alives
+// hold NAT mappings open between sessions, and 0-RTT lets agents resume a
+// connection to a relay they have talked to before without a round trip.
+func Config() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     time.Second * 15,
+		KeepAlivePeriod:    time.Second * 5,
+		MaxIncomingStreams: 1024,
+		Allow0RTT:          true,
+	}
+}
+
+// ServerTLSConfig returns a TLS configuration with a freshly generated
+// self-signed certificate. Payloads are encrypted end-to-end with the
+// tunnel key, so TLS only protects the headers between hops.
+func ServerTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %s", err.Error())
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: ALPN},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 365),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %s", err.Error())
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{ALPN},
+	}, nil
+}
+
+// ClientTLSConfig returns a TLS configuration that accepts the relay's
+// self-signed certificate and caches session tickets for 0-RTT.
+func ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{ALPN},
+		ClientSessionCache: tls.NewLRUClientSessionCache(16),
+	}
+}
+
+// Stream adapts a QUIC stream to the half-close semantics of a TCP
+// connection. CloseWrite finishes the sending side, Close both sides.
+type Stream struct {
+	quic.Stream
+}
+
+func (s Stream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s Stream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// ReadLine reads a header line one byte at a time so that nothing after it
+// is consumed from the stream.
+func ReadLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= maxLineLength {
+			return "", errors.New("header line too long")
+		}
+		line = append(line, b[0])
+	}
+}
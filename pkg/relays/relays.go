@@ -0,0 +1,203 @@
+package relays
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvPrefix marks a relay address that is looked up as a DNS SRV record.
+const srvPrefix = "srv:"
+
+// failureTimeout is how long a relay that failed is tried after the others.
+const failureTimeout = time.Second * 30
+
+// resolveInterval is how long the result of an SRV lookup is used for.
+const resolveInterval = time.Second * 30
+
+// List is the relays an agent can use, in priority order. The address it is
+// parsed from is either a comma separated list of host:port addresses, or
+// srv: followed by a DNS name whose SRV records name the relays.
+type List struct {
+	spec      string
+	mu        sync.Mutex
+	addresses []string
+	resolved  time.Time
+	failed    map[string]time.Time
+	out       io.Writer
+}
+
+func Parse(spec string) (*List, error) {
+	l := &List{
+		spec:   spec,
+		failed: make(map[string]time.Time),
+		out:    os.Stdout,
+	}
+	if _, err := l.resolve(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetOutput sets where the list reports failed relays and lookups.
+func (l *List) SetOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = w
+}
+
+// String returns the address the list was parsed from.
+func (l *List) String() string {
+	return l.spec
+}
+
+// All returns every relay in priority order.
+func (l *List) All() []string {
+	addresses, _ := l.resolve()
+	return addresses
+}
+
+// Ordered returns the relays in the order to try them, by priority but with
+// the relays that failed recently last.
+func (l *List) Ordered() []string {
+	addresses, _ := l.resolve()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ordered := make([]string, 0, len(addresses))
+	var failed []string
+	for _, address := range addresses {
+		if t, ok := l.failed[address]; ok && time.Since(t) < failureTimeout {
+			failed = append(failed, address)
+			continue
+		}
+		ordered = append(ordered, address)
+	}
+	return append(ordered, failed...)
+}
+
+// Failed records that a relay couldn't be used.
+func (l *List) Failed(address string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failed[address] = time.Now()
+}
+
+// Succeeded records that a relay could be used.
+func (l *List) Succeeded(address string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failed, address)
+}
+
+// Try calls fn with each relay in order until it succeeds, returning the
+// error from the last relay if none does.
+func (l *List) Try(fn func(address string) error) error {
+	addresses := l.Ordered()
+	var err error
+	for _, address := range addresses {
+		if err = fn(address); err == nil {
+			l.Succeeded(address)
+			return nil
+		}
+		l.Failed(address)
+		if len(addresses) > 1 {
+			l.mu.Lock()
+			fmt.Fprintf(l.out, "Relay %s failed: %s\n", address, err.Error())
+			l.mu.Unlock()
+		}
+	}
+	return err
+}
+
+// resolve returns the relays, looking up the SRV records again once the
+// last lookup is old. A failed lookup keeps the relays found before.
+func (l *List) resolve() ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.addresses != nil && (!strings.HasPrefix(l.spec, srvPrefix) || time.Since(l.resolved) < resolveInterval) {
+		return l.addresses, nil
+	}
+
+	addresses, err := parseSpec(l.spec)
+	if err != nil {
+		if l.addresses != nil {
+			fmt.Fprintf(l.out, "Failed to look up relays, using the last ones found: %s\n", err.Error())
+			l.resolved = time.Now()
+			return l.addresses, nil
+		}
+		return nil, err
+	}
+	l.addresses = addresses
+	l.resolved = time.Now()
+	return addresses, nil
+}
+
+func parseSpec(spec string) ([]string, error) {
+	if strings.HasPrefix(spec, srvPrefix) {
+		return lookupSRV(strings.TrimPrefix(spec, srvPrefix))
+	}
+
+	var addresses []string
+	for _, address := range strings.Split(spec, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no relay address")
+	}
+	return addresses, nil
+}
+
+// lookupSRV returns the targets of a name's SRV records, ordered by priority
+// and randomized by weight within a priority.
+func lookupSRV(name string) ([]string, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up relays for %s: %s", name, err.Error())
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no relays for %s", name)
+	}
+
+	addresses := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return addresses, nil
+}
+
+// ServeEach runs serve for every relay until the context is done or one of
+// them fails, which is how servers register with all their relays.
+func ServeEach(ctx context.Context, addresses []string, serve func(ctx context.Context, address string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errChan := make(chan error, len(addresses))
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			errChan <- serve(ctx, address)
+		}(address)
+	}
+
+	err := <-errChan
+	cancel()
+	wg.Wait()
+	return err
+}
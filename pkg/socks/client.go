@@ -0,0 +1,123 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Agents that reach the relay through a SOCKS5 proxy speak the other side
+// of the protocol: the CONNECT command, with username and password
+// authentication (RFC 1929) when the proxy asks for it.
+
+const methodUserPass = 0x02
+
+const userPassVersion = 1
+
+// Connect asks a SOCKS5 proxy on conn to connect to a host:port. Without a
+// username, only no authentication is offered.
+func Connect(conn io.ReadWriter, target, username, password string) error {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %s: %s", target, err.Error())
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portString)
+	}
+
+	greeting := []byte{version, 1, methodNoAuth}
+	if username != "" {
+		greeting = []byte{version, 2, methodNoAuth, methodUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return fmt.Errorf("error reading method: %s", err.Error())
+	}
+	if method[0] != version {
+		return fmt.Errorf("unsupported SOCKS version %d", method[0])
+	}
+	switch {
+	case method[1] == methodNoAuth:
+	case method[1] == methodUserPass && username != "":
+		if err := authenticate(conn, username, password); err != nil {
+			return err
+		}
+	default:
+		return errors.New("proxy requires an unsupported authentication method")
+	}
+
+	request := []byte{version, commandConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name is too long: %s", host)
+		}
+		request = append(request, addressDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, addressIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, addressIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("error reading reply: %s", err.Error())
+	}
+	if reply[1] != Succeeded {
+		return fmt.Errorf("proxy failed to connect to %s: reply %d", target, reply[1])
+	}
+
+	// the bound address isn't used, but has to be read past
+	var size int
+	switch reply[3] {
+	case addressIPv4:
+		size = net.IPv4len
+	case addressIPv6:
+		size = net.IPv6len
+	case addressDomain:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return fmt.Errorf("error reading reply: %s", err.Error())
+		}
+		size = int(b[0])
+	default:
+		return fmt.Errorf("unsupported address type %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, size+2)); err != nil {
+		return fmt.Errorf("error reading reply: %s", err.Error())
+	}
+	return nil
+}
+
+func authenticate(conn io.ReadWriter, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("username and password must be at most 255 bytes")
+	}
+	request := []byte{userPassVersion, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("error reading authentication status: %s", err.Error())
+	}
+	if status[1] != 0 {
+		return errors.New("proxy rejected the username and password")
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// The subset of SOCKS5 (RFC 1928) the client speaks: no authentication and
+// the CONNECT command, with the destination as an IPv4 or IPv6 address or a
+// domain name that is resolved on the far side of the tunnel.
+
+const version = 5
+
+const (
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+)
+
+const commandConnect = 0x01
+
+const (
+	addressIPv4   = 0x01
+	addressDomain = 0x03
+	addressIPv6   = 0x04
+)
+
+// Reply codes sent to the client once the request has been handled.
+const (
+	Succeeded           byte = 0x00
+	GeneralFailure      byte = 0x01
+	HostUnreachable     byte = 0x04
+	CommandNotSupported byte = 0x07
+	AddressNotSupported byte = 0x08
+)
+
+// Handshake negotiates with a SOCKS5 client and reads its CONNECT request,
+// returning the host:port it wants to reach. Requests that can't be served
+// are answered with a failure. The caller answers the others with Reply.
+func Handshake(conn io.ReadWriter) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("error reading greeting: %s", err.Error())
+	}
+	if header[0] != version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("error reading greeting: %s", err.Error())
+	}
+	if !contains(methods, methodNoAuth) {
+		conn.Write([]byte{version, methodNoAcceptable})
+		return "", errors.New("client requires authentication")
+	}
+	if _, err := conn.Write([]byte{version, methodNoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", fmt.Errorf("error reading request: %s", err.Error())
+	}
+	if request[0] != version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != commandConnect {
+		Reply(conn, CommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case addressIPv4, addressIPv6:
+		size := net.IPv4len
+		if request[3] == addressIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("error reading address: %s", err.Error())
+		}
+		host = ip.String()
+	case addressDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", fmt.Errorf("error reading address: %s", err.Error())
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("error reading address: %s", err.Error())
+		}
+		host = string(domain)
+	default:
+		Reply(conn, AddressNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("error reading port: %s", err.Error())
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Request is a SOCKS client's CONNECT request.
+type Request struct {
+	net.Conn
+	target string
+}
+
+// ReadRequest negotiates with a SOCKS client and reads its request.
+func ReadRequest(conn net.Conn) (*Request, error) {
+	target, err := Handshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Conn: conn, target: target}, nil
+}
+
+func (r *Request) Target() string {
+	return r.target
+}
+
+func (r *Request) Accept() error {
+	return Reply(r.Conn, Succeeded)
+}
+
+func (r *Request) Fail() {
+	Reply(r.Conn, HostUnreachable)
+}
+
+// CloseWrite closes the sending side of the client connection if it can.
+func (r *Request) CloseWrite() error {
+	if cw, ok := r.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return r.Conn.Close()
+}
+
+// Reply answers a CONNECT request. The bound address is always reported as
+// unspecified, since the connection is made on the far side of the tunnel.
+func Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{version, code, 0, addressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func contains(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
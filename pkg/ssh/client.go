@@ -1,59 +1,224 @@
 package ssh
 
 import (
-	"io"
-	"io/ioutil"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-func Client() {
-	config := &ssh.ClientConfig{
-		User: "testuser",
-		Auth: []ssh.AuthMethod{
-			readKey("./id_ed25519_client"),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// knownHostsMu serializes the hosts added to known_hosts files.
+var knownHostsMu sync.Mutex
+
+// SSHClient is a connection to an SSH server that commands are run over.
+type SSHClient struct {
+	client *ssh.Client
+	agent  net.Conn
+}
+
+type SSHClientOpts struct {
+	Address         string
+	User            string
+	KeyFiles        []string
+	Agent           bool
+	KnownHosts      string
+	TrustOnFirstUse bool
+	Timeout         time.Duration
+}
+
+// Result is the output and exit status of a command.
+type Result struct {
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int
+}
+
+// Dial connects to the SSH server at the address.
+func Dial(opts SSHClientOpts) (*SSHClient, error) {
+	config, agentConn, err := clientConfig(opts)
+	if err != nil {
+		return nil, err
 	}
-	conn, err := ssh.Dial("tcp", "localhost:2022", config)
+	client, err := ssh.Dial("tcp", opts.Address, config)
 	if err != nil {
-		panic(err)
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, err
 	}
-	defer conn.Close()
-	runCommand("/usr/bin/whoami", conn)
+	return &SSHClient{client: client, agent: agentConn}, nil
 }
 
-func readKey(path string) ssh.AuthMethod {
-	key, err := ioutil.ReadFile(path)
+// NewSSHClient starts an SSH connection over conn, like a connection through
+// a tunnel. The address names the server the connection reaches, and is
+// what its host key is checked against.
+func NewSSHClient(conn net.Conn, opts SSHClientOpts) (*SSHClient, error) {
+	config, agentConn, err := clientConfig(opts)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
 	}
-	signer, err := ssh.ParsePrivateKey(key)
+	c, chans, reqs, err := ssh.NewClientConn(conn, opts.Address, config)
 	if err != nil {
-		panic(err)
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, err
 	}
-	return ssh.PublicKeys(signer)
+	conn.SetDeadline(time.Time{})
+	return &SSHClient{client: ssh.NewClient(c, chans, reqs), agent: agentConn}, nil
 }
 
-func runCommand(cmd string, conn *ssh.Client) {
-	sess, err := conn.NewSession()
-	if err != nil {
-		panic(err)
+func clientConfig(opts SSHClientOpts) (*ssh.ClientConfig, net.Conn, error) {
+	if opts.Address == "" {
+		return nil, nil, errors.New("address is required")
 	}
-	defer sess.Close()
-	sessStdOut, err := sess.StdoutPipe()
+	if opts.User == "" {
+		return nil, nil, errors.New("user is required")
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = time.Second * 10
+	}
+
+	knownHosts := opts.KnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error finding known hosts: %s", err.Error())
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	var auth []ssh.AuthMethod
+	var signers []ssh.Signer
+	for _, path := range opts.KeyFiles {
+		signer, err := readSigner(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading key: %s", err.Error())
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	var agentConn net.Conn
+	if opts.Agent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, errors.New("SSH_AUTH_SOCK is not set")
+		}
+		var err error
+		agentConn, err = net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error connecting to agent: %s", err.Error())
+		}
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+	if len(auth) == 0 {
+		return nil, nil, errors.New("a key file or the agent is required")
+	}
+
+	return &ssh.ClientConfig{
+		User:            opts.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback(knownHosts, opts.TrustOnFirstUse),
+		Timeout:         timeout,
+	}, agentConn, nil
+}
+
+// hostKeyCallback checks host keys against a known_hosts file. With trust
+// on first use, the key of a host that isn't in the file is added to it,
+// but a host whose key changed is still rejected.
+func hostKeyCallback(path string, trustOnFirstUse bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// the address of a connection through a tunnel may not be a host
+		// and port, and only the hostname is checked then
+		if _, _, err := net.SplitHostPort(remote.String()); err != nil {
+			remote = &net.TCPAddr{}
+		}
+
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && trustOnFirstUse {
+			return addKnownHost(path, hostname, key)
+		}
+		callback, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("error loading known hosts: %s", err.Error())
+		}
+		err = callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			if trustOnFirstUse {
+				return addKnownHost(path, hostname, key)
+			}
+			return fmt.Errorf("%s is not a known host", hostname)
+		}
+		if errors.As(err, &keyErr) {
+			return fmt.Errorf("host key for %s has changed", hostname)
+		}
+		return err
+	}
+}
+
+func addKnownHost(path, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error adding known host: %s", err.Error())
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("error adding known host: %s", err.Error())
 	}
-	go io.Copy(os.Stdout, sessStdOut)
-	sessStderr, err := sess.StderrPipe()
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		return fmt.Errorf("error adding known host: %s", err.Error())
+	}
+	return nil
+}
+
+// Run runs a command and returns its output and exit status. A command that
+// exits with a status other than 0 isn't an error.
+func (c *SSHClient) Run(command string) (*Result, error) {
+	sess, err := c.client.NewSession()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	err = sess.Run(command)
+
+	result := &Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitStatus = exitErr.ExitStatus()
+		return result, nil
 	}
-	go io.Copy(os.Stderr, sessStderr)
-	err = sess.Run(cmd) // eg., /usr/bin/whoami
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *SSHClient) Close() error {
+	if c.agent != nil {
+		c.agent.Close()
 	}
+	return c.client.Close()
 }
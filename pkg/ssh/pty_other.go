@@ -0,0 +1,21 @@
+//go:build !linux
+
+package ssh
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openPty fails where terminals aren't supported. Sessions without one
+// still run.
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("terminals are not supported on this platform")
+}
+
+func setWindowSize(ptm *os.File, columns, rows uint32) {}
+
+func terminalAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -1,133 +1,200 @@
 package ssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/term"
 )
 
-func Server() {
-	// Public key authentication is done by comparing
-	// the public key of a received connection
-	// with the entries in the authorized_keys file.
-	authorizedKeysBytes, err := ioutil.ReadFile("./authorized_keys")
-	if err != nil {
-		log.Fatalf("Failed to load authorized_keys, err: %v", err)
+// SSHServer accepts SSH connections and runs the commands and shells their
+// sessions ask for, as the user the server runs as.
+type SSHServer struct {
+	address string
+	config  *ssh.ServerConfig
+	shell   string
+	debug   bool
+}
+
+type SSHServerOpts struct {
+	ListenAddress    string
+	HostKeys         []string
+	AuthorizedKeys   string
+	PasswordCallback func(user, password string) error
+	Shell            string
+	Debug            bool
+}
+
+func NewSSHServer(opts SSHServerOpts) (*SSHServer, error) {
+	if len(opts.HostKeys) == 0 {
+		return nil, errors.New("a host key is required")
+	}
+	if opts.AuthorizedKeys == "" && opts.PasswordCallback == nil {
+		return nil, errors.New("authorized keys or a password callback is required")
+	}
+
+	address := opts.ListenAddress
+	if address == "" {
+		address = ":2022"
+	}
+
+	shell := opts.Shell
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		shell = "/bin/sh"
 	}
 
-	authorizedKeysMap := map[string]bool{}
-	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
+	config := &ssh.ServerConfig{}
+	for _, path := range opts.HostKeys {
+		signer, err := readSigner(path)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("error loading host key: %s", err.Error())
 		}
-
-		authorizedKeysMap[string(pubKey.Marshal())] = true
-		authorizedKeysBytes = rest
+		config.AddHostKey(signer)
 	}
 
-	// An SSH server is represented by a ServerConfig, which holds
-	// certificate details and handles authentication of ServerConns.
-	config := &ssh.ServerConfig{
-		// Remove to disable password auth.
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Should use constant-time compare (or better, salt+hash) in
-			// a production setting.
-			if c.User() == "testuser" && string(pass) == "tiger" {
-				return nil, nil
+	// the authorized keys are read for every login, so that changes to them
+	// apply without a restart
+	if opts.AuthorizedKeys != "" {
+		if _, err := readAuthorizedKeys(opts.AuthorizedKeys); err != nil {
+			return nil, err
+		}
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			keys, err := readAuthorizedKeys(opts.AuthorizedKeys)
+			if err != nil {
+				return nil, err
+			}
+			if !keys[string(key.Marshal())] {
+				return nil, fmt.Errorf("unknown public key for %q", c.User())
 			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
-
-		// Remove to disable public key auth.
-		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			if authorizedKeysMap[string(pubKey.Marshal())] {
-				return &ssh.Permissions{
-					// Record the public key used for authentication.
-					Extensions: map[string]string{
-						"pubkey-fp": ssh.FingerprintSHA256(pubKey),
-					},
-				}, nil
+			return &ssh.Permissions{
+				Extensions: map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)},
+			}, nil
+		}
+	}
+	if opts.PasswordCallback != nil {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if err := opts.PasswordCallback(c.User(), string(password)); err != nil {
+				return nil, fmt.Errorf("password rejected for %q: %s", c.User(), err.Error())
 			}
-			return nil, fmt.Errorf("unknown public key for %q", c.User())
-		},
+			return nil, nil
+		}
 	}
 
-	privateKeyBytes, err := ioutil.ReadFile("./id_ed25519")
+	return &SSHServer{
+		address: address,
+		config:  config,
+		shell:   shell,
+		debug:   opts.Debug,
+	}, nil
+}
+
+func readSigner(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal("Failed to load private key: ", err)
+		return nil, err
 	}
+	return ssh.ParsePrivateKey(b)
+}
 
-	privateKey, err := ssh.ParsePrivateKey(privateKeyBytes)
+// readAuthorizedKeys reads an authorized_keys file into a set of the
+// marshaled keys.
+func readAuthorizedKeys(path string) (map[string]bool, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal("Failed to parse private key: ", err)
+		return nil, fmt.Errorf("error loading authorized keys: %s", err.Error())
 	}
+	keys := make(map[string]bool)
+	for len(b) > 0 {
+		// lines that aren't keys are skipped, so an error means there are
+		// no keys left
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		keys[string(key.Marshal())] = true
+		b = rest
+	}
+	return keys, nil
+}
 
-	config.AddHostKey(privateKey)
+func (s *SSHServer) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	// Once a ServerConfig has been configured, connections can be
-	// accepted.
-	listener, err := net.Listen("tcp", "0.0.0.0:2022")
-	if err != nil {
-		log.Fatal("failed to listen for connection: ", err)
+	if err := s.Serve(ctx); err != nil && ctx.Err() == nil {
+		return err
 	}
-	log.Printf("Listening on %s...", listener.Addr())
+	return errors.New("interrupted")
+}
 
-	nConn, err := listener.Accept()
+// Serve listens for SSH connections until the context is done.
+func (s *SSHServer) Serve(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.address)
 	if err != nil {
-		log.Fatal("failed to accept incoming connection: ", err)
+		return err
+	}
+	if s.debug {
+		log.Printf("Listening for SSH on %s\n", listener.Addr().String())
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error accepting SSH connection: %s", err.Error())
+		}
+		go s.ServeConn(conn)
 	}
+}
 
-	// Before use, a handshake must be performed on the incoming
-	// net.Conn.
-	conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+// ServeConn serves the SSH connection on conn until it is closed. It is how
+// connections that don't come from the listener, like those over a tunnel,
+// are served.
+func (s *SSHServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
 	if err != nil {
-		log.Fatal("failed to handshake: ", err)
+		fmt.Fprintf(os.Stderr, "error handshaking with %s: %s\n", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	defer sshConn.Close()
+	if s.debug {
+		if sshConn.Permissions != nil && sshConn.Permissions.Extensions["pubkey-fp"] != "" {
+			fp := sshConn.Permissions.Extensions["pubkey-fp"]
+			log.Printf("%s logged in from %s with key %s\n", sshConn.User(), sshConn.RemoteAddr().String(), fp)
+		} else {
+			log.Printf("%s logged in from %s\n", sshConn.User(), sshConn.RemoteAddr().String())
+		}
 	}
-	log.Printf("logged in with key %s", conn.Permissions.Extensions["pubkey-fp"])
 
-	// The incoming Request channel must be serviced.
 	go ssh.DiscardRequests(reqs)
 
-	// Service the incoming Channel channel.
 	for newChannel := range chans {
-		// Channels have a type, depending on the application level
-		// protocol intended. In the case of a shell, the type is
-		// "session" and ServerShell may be used to present a simple
-		// terminal interface.
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			log.Fatalf("Could not accept channel: %v", err)
+			fmt.Fprintf(os.Stderr, "error accepting session: %s\n", err.Error())
+			continue
 		}
-
-		// Sessions have out-of-band requests such as "shell",
-		// "pty-req" and "env".  Here we handle only the
-		// "shell" request.
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				req.Reply(req.Type == "shell", nil)
-			}
-		}(requests)
-
-		term := term.NewTerminal(channel, "> ")
-
-		go func() {
-			defer channel.Close()
-			for {
-				line, err := term.ReadLine()
-				if err != nil {
-					break
-				}
-				fmt.Println(line)
-			}
-		}()
+		go s.handleSession(channel, requests)
 	}
 }
@@ -0,0 +1,197 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// session is a session channel and what its requests asked for before the
+// command started.
+type session struct {
+	channel ssh.Channel
+	env     []string
+	pty     *ptyRequest
+	// term is the terminal of the running command, if it has one
+	term    *os.File
+	started bool
+}
+
+// ptyRequest is the payload of a "pty-req" request.
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// windowChange is the payload of a "window-change" request.
+type windowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// handleSession serves the requests of a session channel, running the
+// shell or the command it asks for in a terminal if it asked for one.
+func (s *SSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	sess := &session{channel: channel}
+	defer func() {
+		if !sess.started {
+			channel.Close()
+		}
+	}()
+
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &kv); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			sess.env = append(sess.env, kv.Name+"="+kv.Value)
+			req.Reply(true, nil)
+		case "pty-req":
+			pty := &ptyRequest{}
+			if err := ssh.Unmarshal(req.Payload, pty); err != nil || sess.started {
+				req.Reply(false, nil)
+				continue
+			}
+			sess.pty = pty
+			req.Reply(true, nil)
+		case "window-change":
+			var size windowChange
+			if err := ssh.Unmarshal(req.Payload, &size); err != nil {
+				continue
+			}
+			if sess.term != nil {
+				setWindowSize(sess.term, size.Columns, size.Rows)
+			}
+		case "shell", "exec":
+			if sess.started {
+				req.Reply(false, nil)
+				continue
+			}
+			cmd := exec.Command(s.shell)
+			if req.Type == "exec" {
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				cmd = exec.Command(s.shell, "-c", payload.Command)
+				if s.debug {
+					log.Printf("Running %q\n", payload.Command)
+				}
+			} else if s.debug {
+				log.Printf("Starting %s\n", s.shell)
+			}
+			if err := sess.start(cmd); err != nil {
+				fmt.Fprintf(os.Stderr, "error starting session: %s\n", err.Error())
+				req.Reply(false, nil)
+				continue
+			}
+			sess.started = true
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// start runs the command for the session, and sends its exit status and
+// closes the channel once it exits.
+func (sess *session) start(cmd *exec.Cmd) error {
+	home, err := os.UserHomeDir()
+	if err == nil {
+		cmd.Dir = home
+	}
+	cmd.Env = append(os.Environ(), sess.env...)
+	if sess.pty != nil {
+		return sess.startTerminal(cmd)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = sess.channel
+	cmd.Stderr = sess.channel.Stderr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		io.Copy(stdin, sess.channel)
+		stdin.Close()
+	}()
+	go sess.exit(cmd.Wait())
+	return nil
+}
+
+// startTerminal runs the command in a new terminal, sized as the client
+// asked.
+func (sess *session) startTerminal(cmd *exec.Cmd) error {
+	ptm, tty, err := openPty()
+	if err != nil {
+		return err
+	}
+	setWindowSize(ptm, sess.pty.Columns, sess.pty.Rows)
+	cmd.Env = append(cmd.Env, "TERM="+sess.pty.Term)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = terminalAttr()
+	if err := cmd.Start(); err != nil {
+		ptm.Close()
+		tty.Close()
+		return err
+	}
+	// only the command holds the terminal open, so that reading it ends
+	// once the command exits
+	tty.Close()
+	sess.term = ptm
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(sess.channel, ptm)
+	}()
+	go io.Copy(ptm, sess.channel)
+
+	go func() {
+		err := cmd.Wait()
+		wg.Wait()
+		ptm.Close()
+		sess.exit(err)
+	}()
+	return nil
+}
+
+// exit sends the exit status of the command and closes the channel.
+func (sess *session) exit(err error) {
+	status := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		status = 255
+	}
+	// a command killed by a signal has no exit code
+	if status < 0 {
+		status = 255
+	}
+	sess.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	sess.channel.Close()
+}
@@ -0,0 +1,239 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// writeKey generates a key and writes it to a file in dir.
+func writeKey(t *testing.T, dir, name string) (ssh.PublicKey, string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	return signer.PublicKey(), path
+}
+
+// newTestServer creates a server with a new host key that authorizes the
+// client key it returns.
+func newTestServer(t *testing.T) (*SSHServer, ssh.PublicKey, string) {
+	t.Helper()
+	dir := t.TempDir()
+	hostKey, hostKeyPath := writeKey(t, dir, "host")
+	clientKey, clientKeyPath := writeKey(t, dir, "client")
+	authorizedKeys := filepath.Join(dir, "authorized_keys")
+	if err := os.WriteFile(authorizedKeys, ssh.MarshalAuthorizedKey(clientKey), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	s, err := NewSSHServer(SSHServerOpts{
+		HostKeys:       []string{hostKeyPath},
+		AuthorizedKeys: authorizedKeys,
+		Shell:          "/bin/sh",
+	})
+	if err != nil {
+		t.Fatalf("NewSSHServer: %v", err)
+	}
+	return s, hostKey, clientKeyPath
+}
+
+// pipe returns the two ends of a loopback connection. Both ends of an SSH
+// handshake write before they read, which deadlocks on a net.Pipe, since it
+// has no buffer, unlike the connections of a tunnel.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	other, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	return other, conn
+}
+
+// connect serves one connection the way a tunnel hands them to the server,
+// and starts a client on the other end.
+func connect(t *testing.T, s *SSHServer, opts SSHClientOpts) (*SSHClient, error) {
+	t.Helper()
+	serverConn, clientConn := pipe(t)
+	go s.ServeConn(serverConn)
+	client, err := NewSSHClient(clientConn, opts)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, nil
+}
+
+// knownHostLines returns the lines of a known_hosts file.
+func knownHostLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestRun(t *testing.T) {
+	s, _, clientKey := newTestServer(t)
+	client, err := connect(t, s, SSHClientOpts{
+		Address:         "box1:22",
+		User:            "test",
+		KeyFiles:        []string{clientKey},
+		KnownHosts:      filepath.Join(t.TempDir(), "known_hosts"),
+		TrustOnFirstUse: true,
+	})
+	if err != nil {
+		t.Fatalf("NewSSHClient: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		command    string
+		wantStdout string
+		wantStderr string
+		wantStatus int
+	}{
+		{"stdout", "echo out", "out\n", "", 0},
+		{"stderr", "echo err >&2", "", "err\n", 0},
+		{"both", "echo out; echo err >&2", "out\n", "err\n", 0},
+		{"exit status", "echo out; exit 3", "out\n", "", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := client.Run(tt.command)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if string(result.Stdout) != tt.wantStdout || string(result.Stderr) != tt.wantStderr || result.ExitStatus != tt.wantStatus {
+				t.Fatalf("got %q, %q and %d, want %q, %q and %d",
+					result.Stdout, result.Stderr, result.ExitStatus, tt.wantStdout, tt.wantStderr, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUnauthorizedKey(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	_, otherKey := writeKey(t, t.TempDir(), "other")
+	_, err := connect(t, s, SSHClientOpts{
+		Address:         "box1:22",
+		User:            "test",
+		KeyFiles:        []string{otherKey},
+		KnownHosts:      filepath.Join(t.TempDir(), "known_hosts"),
+		TrustOnFirstUse: true,
+	})
+	if err == nil {
+		t.Fatal("expected a key that isn't authorized to be rejected")
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	s, hostKey, clientKey := newTestServer(t)
+	knownHosts := filepath.Join(t.TempDir(), ".ssh", "known_hosts")
+	opts := SSHClientOpts{
+		User:            "test",
+		KeyFiles:        []string{clientKey},
+		KnownHosts:      knownHosts,
+		TrustOnFirstUse: true,
+	}
+
+	tests := []struct {
+		name      string
+		address   string
+		wantLines int
+	}{
+		{"first host creates the file", "box1:22", 1},
+		{"known host isn't added again", "box1:22", 1},
+		{"another host is appended", "box2:2022", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts.Address = tt.address
+			if _, err := connect(t, s, opts); err != nil {
+				t.Fatalf("NewSSHClient: %v", err)
+			}
+			lines := knownHostLines(t, knownHosts)
+			if len(lines) != tt.wantLines {
+				t.Fatalf("got %d known hosts, want %d: %q", len(lines), tt.wantLines, lines)
+			}
+			want := knownhosts.Line([]string{knownhosts.Normalize(tt.address)}, hostKey)
+			if lines[len(lines)-1] != want {
+				t.Fatalf("got %q, want %q", lines[len(lines)-1], want)
+			}
+		})
+	}
+
+	opts.Address = "box3:22"
+	opts.TrustOnFirstUse = false
+	if _, err := connect(t, s, opts); err == nil || !strings.Contains(err.Error(), "not a known host") {
+		t.Fatalf("got %v, want an unknown host rejected without trust on first use", err)
+	}
+}
+
+func TestChangedHostKey(t *testing.T) {
+	s, _, clientKey := newTestServer(t)
+	oldKey, _ := writeKey(t, t.TempDir(), "old")
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("box1:22")}, oldKey)
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	for _, trustOnFirstUse := range []bool{false, true} {
+		_, err := connect(t, s, SSHClientOpts{
+			Address:         "box1:22",
+			User:            "test",
+			KeyFiles:        []string{clientKey},
+			KnownHosts:      knownHosts,
+			TrustOnFirstUse: trustOnFirstUse,
+		})
+		if err == nil || !strings.Contains(err.Error(), "host key for box1:22 has changed") {
+			t.Fatalf("got %v with trust on first use %v, want the changed key rejected", err, trustOnFirstUse)
+		}
+	}
+	if lines := knownHostLines(t, knownHosts); len(lines) != 1 || lines[0] != line {
+		t.Fatalf("known hosts changed to %q", lines)
+	}
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store keeps relay state in a key-value file, so that it survives restarts.
+// Values are stored as JSON in named buckets.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the store at a path, creating it if it doesn't exist.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening state file %s: %s", path, err.Error())
+	}
+	return &Store{db: db}, nil
+}
+
+// Put stores a value under a key in a bucket.
+func (s *Store) Put(bucket, key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), b)
+	})
+}
+
+// Delete removes a key from a bucket.
+func (s *Store) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+// Load calls fn with every key and value in a bucket.
+func (s *Store) Load(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
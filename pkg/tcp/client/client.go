@@ -1,51 +1,187 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/httpproxy"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/proxy"
+	"github.com/cbodonnell/net/pkg/relays"
+	"github.com/cbodonnell/net/pkg/socks"
+	"github.com/cbodonnell/net/pkg/tcp/punch"
+	udpclient "github.com/cbodonnell/net/pkg/udp/client"
+	"github.com/cbodonnell/net/pkg/upstream"
 )
 
+// relayFailPrefix starts the relay's answer when it can't deliver a request.
+const relayFailPrefix = "FAIL: "
+
 type Client struct {
-	port         uint
-	relayAddress string
-	cipher       crypto.Cipher
-	bufferSize   uint
-	debug        bool
+	port       uint
+	relays     *relays.List
+	serverName string
+	cipher     crypto.Cipher
+	bufferSize uint
+	puncher    *udpclient.UDPClient
+	dialer     *punch.Dialer
+	upstream   *upstream.Dialer
+	socks      bool
+	httpProxy  bool
+	stdio      bool
+	stdin      io.ReadCloser
+	stdout     io.WriteCloser
+	logger     *log.Logger
+	debug      bool
 }
 
 type TCPClientOpts struct {
-	Port         uint
-	RelayAddress string
-	Key          []byte
-	BufferSize   uint
-	Debug        bool
+	Port              uint
+	RelayAddress      string
+	ServerName        string
+	Key               []byte
+	BufferSize        uint
+	PunchRelayAddress string
+	RendezvousAddress string
+	PunchTimeout      string
+	Socks             bool
+	HTTPProxy         bool
+	UpstreamProxy     string
+	Stdio             bool
+	Stdin             io.ReadCloser
+	Stdout            io.WriteCloser
+	Log               io.Writer
+	Debug             bool
 }
 
 func NewTCPClient(opts TCPClientOpts) (*Client, error) {
+	if opts.ServerName == "" {
+		return nil, errors.New("server name is required")
+	}
+	if opts.Socks && opts.HTTPProxy {
+		return nil, errors.New("only one of SOCKS and HTTP proxy can be used")
+	}
+	if opts.Stdio && (opts.Socks || opts.HTTPProxy) {
+		return nil, errors.New("a stdio session can't be proxied")
+	}
+
 	cipher, err := crypto.NewAESCipher(crypto.AESCipherOpts{Key: opts.Key})
 	if err != nil {
 		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
 	}
 
+	stdin, stdout := opts.Stdin, opts.Stdout
+	if stdin == nil {
+		stdin = os.Stdin
+	}
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	logWriter := opts.Log
+	if logWriter == nil {
+		logWriter = os.Stderr
+	}
+
+	var puncher *udpclient.UDPClient
+	if opts.PunchRelayAddress != "" {
+		puncher, err = udpclient.NewUDPClient(udpclient.UDPClientOpts{
+			RelayAddress: opts.PunchRelayAddress,
+			ServerName:   opts.ServerName,
+			Key:          opts.Key,
+			PunchTimeout: opts.PunchTimeout,
+			Stream:       true,
+			Log:          logWriter,
+			Debug:        opts.Debug,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating punch client: %s", err.Error())
+		}
+	}
+
+	var dialer *punch.Dialer
+	if opts.RendezvousAddress != "" {
+		var timeout time.Duration
+		if opts.PunchTimeout != "" {
+			timeout, err = time.ParseDuration(opts.PunchTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing punch timeout: %s", err.Error())
+			}
+		}
+		dialer = punch.NewDialer(punch.DialerOpts{
+			Address:    opts.RendezvousAddress,
+			ServerName: opts.ServerName,
+			Cipher:     cipher,
+			Timeout:    timeout,
+			Debug:      opts.Debug,
+		})
+	}
+
+	relayList, err := relays.Parse(opts.RelayAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing relay address: %s", err.Error())
+	}
+	relayList.SetOutput(logWriter)
+
+	upstreamDialer, err := upstream.NewDialer(upstream.DialerOpts{Proxy: opts.UpstreamProxy, Debug: opts.Debug})
+	if err != nil {
+		return nil, fmt.Errorf("error creating upstream proxy dialer: %s", err.Error())
+	}
+
 	return &Client{
-		port:         opts.Port,
-		relayAddress: opts.RelayAddress,
-		cipher:       cipher,
-		bufferSize:   opts.BufferSize,
-		debug:        opts.Debug,
+		port:       opts.Port,
+		relays:     relayList,
+		serverName: opts.ServerName,
+		cipher:     cipher,
+		bufferSize: opts.BufferSize,
+		puncher:    puncher,
+		dialer:     dialer,
+		upstream:   upstreamDialer,
+		socks:      opts.Socks,
+		httpProxy:  opts.HTTPProxy,
+		stdio:      opts.Stdio,
+		stdin:      stdin,
+		stdout:     stdout,
+		logger:     log.New(logWriter, "", log.LstdFlags),
+		debug:      opts.Debug,
 	}, nil
 }
 
 func (c *Client) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := c.Serve(ctx)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	// a stdio session is over once it finishes
+	if c.stdio && ctx.Err() == nil {
+		return nil
+	}
+	return errors.New("interrupted")
+}
+
+// Serve listens for client connections until the context is done, or
+// tunnels stdin and stdout until the session is over.
+func (c *Client) Serve(ctx context.Context) error {
+	if c.stdio {
+		return c.serveStdio(ctx)
+	}
+
 	portString := fmt.Sprintf(":%d", c.port)
 	if c.debug {
-		log.Printf("Listening for client on %s\n", portString)
+		c.logger.Printf("Listening for client on %s\n", portString)
 	}
 
 	listener, err := net.Listen("tcp", portString)
@@ -54,25 +190,32 @@ func (c *Client) Run() error {
 	}
 	defer listener.Close()
 
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
 
 	go c.handleClientConnections(listener, errChan)
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
 	select {
-	case <-interrupt:
-		return errors.New("interrupted")
+	case <-ctx.Done():
+		return ctx.Err()
 	case err := <-errChan:
 		return fmt.Errorf("error handling client connections: %s", err.Error())
 	}
 }
 
-func (c *Client) handleClientConnections(listener net.Listener, errChan chan<- error) error {
+func (c *Client) handleClientConnections(listener net.Listener, errChan chan<- error) {
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
 			errChan <- fmt.Errorf("error accepting from client: %s", err.Error())
+			return
+		}
+		if c.socks || c.httpProxy {
+			go c.handleProxy(clientConn)
+			continue
+		}
+		if c.dialer != nil || c.puncher != nil {
+			go c.handlePunched(clientConn, nil)
+			continue
 		}
 		if err := c.handleRequest(clientConn); err != nil {
 			fmt.Fprintf(os.Stderr, "error handling request: %s\n", err.Error())
@@ -80,21 +223,190 @@ func (c *Client) handleClientConnections(listener net.Listener, errChan chan<- e
 	}
 }
 
+// handleProxy reads where a SOCKS or HTTP proxy client wants to connect,
+// and has the server connect there.
+func (c *Client) handleProxy(clientConn net.Conn) {
+	var req proxy.Request
+	var err error
+	if c.socks {
+		req, err = socks.ReadRequest(clientConn)
+	} else {
+		req, err = httpproxy.ReadRequest(clientConn)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading proxy request: %s\n", err.Error())
+		clientConn.Close()
+		return
+	}
+	if c.debug {
+		c.logger.Printf("Proxy client asked for %s\n", req.Target())
+	}
+
+	if c.dialer != nil || c.puncher != nil {
+		c.handlePunched(clientConn, req)
+		return
+	}
+	if err := c.relay(clientConn, req); err != nil {
+		fmt.Fprintf(os.Stderr, "error handling request: %s\n", err.Error())
+	}
+}
+
+// handleRequest relays a request to the server.
 func (c *Client) handleRequest(clientConn net.Conn) error {
 	defer clientConn.Close()
 
-	if c.debug {
-		log.Printf("Connecting to %s\n", c.relayAddress)
-	}
-	relayConn, err := net.Dial("tcp", c.relayAddress)
+	relayConn, err := c.dialRelay()
 	if err != nil {
 		return err
 	}
 	defer relayConn.Close()
 
+	if _, err := fmt.Fprintf(relayConn, "CONNECT: %s\n", c.serverName); err != nil {
+		return err
+	}
+
+	if err := c.cipher.EncryptStream(relayConn, clientConn); err != nil {
+		return err
+	}
+
+	// the relay answers in plain text when no server picks up the request
+	reader := bufio.NewReaderSize(relayConn, 64*1024)
+	if prefix, err := reader.Peek(len(relayFailPrefix)); err == nil && bytes.Equal(prefix, []byte(relayFailPrefix)) {
+		reason, _ := reader.ReadString('\n')
+		return fmt.Errorf("relay failed: %s", strings.TrimPrefix(reason, relayFailPrefix))
+	}
+
+	return c.cipher.DecryptStream(clientConn, reader)
+}
+
+// streamRequest streams a connection to the server through the relay, for
+// sessions that go back and forth like SSH. If there is a proxy request, the
+// server is asked to connect to its target first.
+func (c *Client) streamRequest(clientConn net.Conn, req proxy.Request) error {
+	relayConn, err := c.dialRelay()
+	if err != nil {
+		if req != nil {
+			req.Fail()
+		}
+		clientConn.Close()
+		return err
+	}
+
+	if _, err := fmt.Fprintf(relayConn, "STREAM: %s\n", c.serverName); err != nil {
+		clientConn.Close()
+		relayConn.Close()
+		return err
+	}
+
+	session := &relayStream{Conn: relayConn, reader: bufio.NewReader(relayConn)}
+	c.join(clientConn, crypto.NewConn(session, c.cipher), req)
+	return session.err
+}
+
+// dialRelay connects to the relays in order, so that a relay that is down
+// fails over to the next.
+func (c *Client) dialRelay() (net.Conn, error) {
+	var relayConn net.Conn
+	err := c.relays.Try(func(address string) error {
+		if c.debug {
+			c.logger.Printf("Connecting to %s\n", address)
+		}
+		var err error
+		relayConn, err = c.upstream.Dial(address)
+		if err == nil && c.debug {
+			c.logger.Printf("Relaying to %s\n", address)
+		}
+		return err
+	})
+	return relayConn, err
+}
+
+// relayStream is a session streamed through the relay. The relay answers in
+// plain text when no server picks the session up, so the start of what it
+// sends is checked for that before it is read as the server's.
+type relayStream struct {
+	net.Conn
+	reader  *bufio.Reader
+	checked bool
+	err     error
+}
+
+func (s *relayStream) Read(b []byte) (int, error) {
+	if !s.checked {
+		s.checked = true
+		if prefix, err := s.reader.Peek(len(relayFailPrefix)); err == nil && bytes.Equal(prefix, []byte(relayFailPrefix)) {
+			reason, _ := s.reader.ReadString('\n')
+			s.err = fmt.Errorf("relay failed: %s", strings.TrimPrefix(reason, relayFailPrefix))
+			return 0, s.err
+		}
+	}
+	return s.reader.Read(b)
+}
+
+// relay sends a connection to the server through the relay, streaming
+// stdio and proxy sessions, which go back and forth, and sending anything
+// else as a single request.
+func (c *Client) relay(clientConn net.Conn, req proxy.Request) error {
+	if c.stdio || req != nil {
+		return c.streamRequest(clientConn, req)
+	}
+	return c.handleRequest(clientConn)
+}
+
+// handlePunched connects to the server directly, first over a punched TCP
+// connection and then over a punched UDP path, and relays the connection if
+// the server can't be reached either way. A proxy request is passed on to
+// the server as it is by relay.
+func (c *Client) handlePunched(clientConn net.Conn, req proxy.Request) {
+	if c.dialer != nil {
+		serverConn, err := c.dialer.Dial(context.Background())
+		if err == nil {
+			if c.debug {
+				c.logger.Println("Streaming peer-to-peer over TCP")
+			}
+			c.join(clientConn, serverConn, req)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "error punching over TCP: %s\n", err.Error())
+	}
+
+	if c.puncher != nil {
+		serverConn, err := c.puncher.DialStream()
+		if err == nil {
+			if c.debug {
+				c.logger.Printf("Streaming to %s peer-to-peer\n", serverConn.RemoteAddr().String())
+			}
+			c.join(clientConn, serverConn, req)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "error punching over UDP: %s\n", err.Error())
+	}
+
 	if c.debug {
-		log.Printf("Relaying to %s\n", c.relayAddress)
+		c.logger.Println("Falling back to relay")
 	}
+	if err := c.relay(clientConn, req); err != nil {
+		fmt.Fprintf(os.Stderr, "error handling request: %s\n", err.Error())
+	}
+}
 
-	return c.cipher.EncryptRoundTrip(relayConn, clientConn)
+// join streams a client connection to the server, first asking the server
+// to connect to the target of the proxy request if there is one.
+func (c *Client) join(clientConn net.Conn, serverConn io.ReadWriteCloser, req proxy.Request) {
+	if req == nil {
+		pipe.Join(clientConn, serverConn)
+		return
+	}
+	if _, err := serverConn.Write(proxy.Header(req.Target())); err != nil {
+		req.Fail()
+		clientConn.Close()
+		serverConn.Close()
+		return
+	}
+	if err := req.Accept(); err != nil {
+		clientConn.Close()
+		serverConn.Close()
+		return
+	}
+	pipe.Join(req, serverConn)
 }
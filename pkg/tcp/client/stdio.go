@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// serveStdio tunnels a single session between stdin and stdout and the
+// server, for use as an SSH ProxyCommand or in a pipe. Only the session
+// writes to stdout, so the client must log somewhere else.
+func (c *Client) serveStdio(ctx context.Context) error {
+	conn := &stdioConn{in: c.stdin, out: c.stdout}
+
+	errChan := make(chan error, 1)
+	go func() {
+		if c.dialer != nil || c.puncher != nil {
+			c.handlePunched(conn, nil)
+			errChan <- nil
+			return
+		}
+		errChan <- c.streamRequest(conn, nil)
+	}()
+
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		return ctx.Err()
+	case err := <-errChan:
+		return err
+	}
+}
+
+// stdioConn is the session on stdin and stdout as a client connection.
+type stdioConn struct {
+	in  io.ReadCloser
+	out io.WriteCloser
+}
+
+func (c *stdioConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+func (c *stdioConn) Close() error {
+	c.in.Close()
+	return c.out.Close()
+}
+
+// CloseWrite closes stdout, so that the other end sees the server is done.
+func (c *stdioConn) CloseWrite() error {
+	return c.out.Close()
+}
+
+func (c *stdioConn) LocalAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) RemoteAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string {
+	return "stdio"
+}
+
+func (stdioAddr) String() string {
+	return "stdio"
+}
@@ -0,0 +1,121 @@
+package punch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/protocol"
+)
+
+// Dialer opens direct connections to a server through a rendezvous.
+type Dialer struct {
+	address    string
+	serverName string
+	cipher     crypto.Cipher
+	timeout    time.Duration
+	debug      bool
+}
+
+type DialerOpts struct {
+	Address    string
+	ServerName string
+	Cipher     crypto.Cipher
+	Timeout    time.Duration
+	Debug      bool
+}
+
+func NewDialer(opts DialerOpts) *Dialer {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+
+	return &Dialer{
+		address:    opts.Address,
+		serverName: opts.ServerName,
+		cipher:     opts.Cipher,
+		timeout:    timeout,
+		debug:      opts.Debug,
+	}
+}
+
+// Dial punches a TCP connection to the server and returns it encrypted
+// with the tunnel key once the server has confirmed it.
+func (d *Dialer) Dial(ctx context.Context) (*crypto.Conn, error) {
+	deadline := time.Now().Add(d.timeout)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	control, err := dialRendezvous(ctx, d.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to rendezvous: %s", err.Error())
+	}
+	// keep the port bound until the punch is done
+	defer control.Close()
+	control.SetDeadline(deadline)
+
+	if _, err := fmt.Fprintf(control, "PUNCH: %s\n", d.serverName); err != nil {
+		return nil, fmt.Errorf("failed to write to rendezvous: %s", err.Error())
+	}
+
+	line, err := bufio.NewReader(control).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from rendezvous: %s", err.Error())
+	}
+	result, value, err := protocol.ParseLine(line)
+	if err != nil {
+		return nil, err
+	}
+	switch result {
+	case "SUCCESS":
+	case "FAIL":
+		return nil, fmt.Errorf("failed to punch to %s: %s", d.serverName, value)
+	default:
+		return nil, fmt.Errorf("unknown result: %s", result)
+	}
+
+	punch, err := ParsePunch(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.debug {
+		log.Printf("Punching to %s at %s in %s\n", d.serverName, punch.Peer, punch.Delay)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(punch.Delay):
+	}
+
+	conn, err := connect(ctx, control.LocalAddr(), punch.Peer, deadline, func() bool { return false })
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %s", punch.Peer, err.Error())
+	}
+
+	// prove we are the client the relay announced, and wait for the server to accept
+	peer := crypto.NewConn(conn, d.cipher)
+	conn.SetDeadline(deadline)
+	if _, err := fmt.Fprintf(peer, "HELLO: %s", punch.ID); err != nil {
+		peer.Close()
+		return nil, fmt.Errorf("failed to write to %s: %s", punch.Peer, err.Error())
+	}
+	buf := make([]byte, 256)
+	n, err := peer.Read(buf)
+	if err != nil {
+		peer.Close()
+		return nil, fmt.Errorf("failed to read from %s: %s", punch.Peer, err.Error())
+	}
+	if string(buf[:n]) != fmt.Sprintf("SUCCESS: %s", punch.ID) {
+		peer.Close()
+		return nil, fmt.Errorf("unexpected response from %s: %s", punch.Peer, string(buf[:n]))
+	}
+	conn.SetDeadline(time.Time{})
+
+	return peer, nil
+}
@@ -0,0 +1,80 @@
+package punch
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The rendezvous speaks the same line protocol as the UDP relay. A server
+// registers with "REGISTER: name" and keeps the connection open, pinging
+// it to show that it is still there. A client asks for a server with
+// "PUNCH: name", and the relay sends each side the other's observed
+// endpoint as "<address> <id> <delay>". Both sides wait for the delay and
+// then connect to each other from the port the relay observed, so that
+// their SYNs cross and open the connection through NATs.
+
+// attemptInterval is how long to wait between connection attempts while punching.
+const attemptInterval = time.Millisecond * 100
+
+const (
+	// PingInterval is how often a registered server pings the rendezvous
+	// with "PING: name", which answers "PONG: name".
+	PingInterval = time.Second * 10
+	// PingTimeout is how long either side of a registration waits to hear
+	// from the other before taking it as gone.
+	PingTimeout = PingInterval * 3
+)
+
+// Punch describes one side of a coordinated connection.
+type Punch struct {
+	Peer  string
+	ID    string
+	Delay time.Duration
+}
+
+func (p *Punch) String() string {
+	return fmt.Sprintf("%s %s %d", p.Peer, p.ID, p.Delay.Milliseconds())
+}
+
+// ParsePunch parses the value of a PUNCH request or response.
+func ParsePunch(value string) (*Punch, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid punch: %s", value)
+	}
+	delay, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid punch delay: %s", fields[2])
+	}
+	return &Punch{Peer: fields[0], ID: fields[1], Delay: time.Duration(delay) * time.Millisecond}, nil
+}
+
+// dialRendezvous connects to the rendezvous from a port that can be shared.
+func dialRendezvous(ctx context.Context, address string) (net.Conn, error) {
+	d := net.Dialer{Control: reusePort}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// connect repeatedly tries to connect from local to remote until it
+// succeeds, the deadline passes or done reports that it is no longer needed.
+func connect(ctx context.Context, local net.Addr, remote string, deadline time.Time, done func() bool) (net.Conn, error) {
+	d := net.Dialer{LocalAddr: local, Control: reusePort, Deadline: deadline}
+	for {
+		conn, err := d.DialContext(ctx, "tcp", remote)
+		if err == nil {
+			return conn, nil
+		}
+		if done() || !time.Now().Add(attemptInterval).Before(deadline) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(attemptInterval):
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package punch
+
+import "syscall"
+
+// reusePort is a no-op where sockets can't share a port. Punching is still
+// attempted but usually fails, and connections fall back to the relay.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,276 @@
+package punch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/protocol"
+	"github.com/cbodonnell/net/pkg/proxy"
+)
+
+// Server registers with a rendezvous and accepts the connections that
+// clients punch to it, connecting each one to the server address.
+type Server struct {
+	address       string
+	serverName    string
+	serverAddress string
+	cipher        crypto.Cipher
+	timeout       time.Duration
+	retryDuration time.Duration
+	proxy         *proxy.Dialer
+	debug         bool
+	mu            sync.Mutex
+	pending       map[string]time.Time
+}
+
+type ServerOpts struct {
+	Address       string
+	ServerName    string
+	ServerAddress string
+	Cipher        crypto.Cipher
+	Timeout       time.Duration
+	RetryDuration time.Duration
+	Proxy         *proxy.Dialer
+	Debug         bool
+}
+
+func NewServer(opts ServerOpts) *Server {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+
+	retryDuration := opts.RetryDuration
+	if retryDuration == 0 {
+		retryDuration = time.Second
+	}
+
+	return &Server{
+		address:       opts.Address,
+		serverName:    opts.ServerName,
+		serverAddress: opts.ServerAddress,
+		cipher:        opts.Cipher,
+		timeout:       timeout,
+		retryDuration: retryDuration,
+		proxy:         opts.Proxy,
+		debug:         opts.Debug,
+		pending:       make(map[string]time.Time),
+	}
+}
+
+// Serve stays registered with the rendezvous until the context is done.
+func (s *Server) Serve(ctx context.Context) error {
+	for {
+		if err := s.registerAndServe(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Fprintf(os.Stderr, "Error registering with rendezvous: %s\n", err.Error())
+			fmt.Fprintf(os.Stderr, "Retrying in %s\n", s.retryDuration)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(s.retryDuration):
+			}
+		}
+	}
+}
+
+func (s *Server) registerAndServe(ctx context.Context) error {
+	control, err := dialRendezvous(ctx, s.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to rendezvous: %s", err.Error())
+	}
+	defer control.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		control.Close()
+	}()
+
+	local := control.LocalAddr()
+
+	// accept clients whose SYN arrives before ours leaves, which is what
+	// happens when there is no NAT in front of us
+	lc := net.ListenConfig{Control: reusePort}
+	listener, err := lc.Listen(ctx, "tcp", local.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to listen on %s, punching without it: %s\n", local.String(), err.Error())
+	} else {
+		defer listener.Close()
+		go s.acceptPunched(listener)
+	}
+
+	if _, err := fmt.Fprintf(control, "REGISTER: %s\n", s.serverName); err != nil {
+		return fmt.Errorf("failed to write to rendezvous: %s", err.Error())
+	}
+	go s.ping(ctx, control)
+
+	reader := bufio.NewReader(control)
+	for {
+		control.SetReadDeadline(time.Now().Add(PingTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read from rendezvous: %s", err.Error())
+		}
+		action, value, err := protocol.ParseLine(line)
+		if err != nil {
+			return err
+		}
+
+		switch action {
+		case "SUCCESS":
+			fmt.Printf("Registered as %s with rendezvous %s\n", value, s.address)
+		case "PONG":
+		case "PUNCH":
+			punch, err := ParsePunch(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				continue
+			}
+			go s.punch(ctx, local, punch)
+		case "FAIL":
+			return fmt.Errorf("rendezvous failed: %s", value)
+		default:
+			return fmt.Errorf("unknown action from rendezvous: %s", action)
+		}
+	}
+}
+
+// ping keeps the registration alive, so that the rendezvous can tell a
+// server that is still there from one whose connection silently died.
+func (s *Server) ping(ctx context.Context, control net.Conn) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := fmt.Fprintf(control, "PING: %s\n", s.serverName); err != nil {
+			control.Close()
+			return
+		}
+	}
+}
+
+// punch connects to a client the rendezvous announced.
+func (s *Server) punch(ctx context.Context, local net.Addr, punch *Punch) {
+	deadline := time.Now().Add(s.timeout)
+
+	s.mu.Lock()
+	s.pending[punch.ID] = deadline
+	s.mu.Unlock()
+
+	if s.debug {
+		log.Printf("Punching to client at %s in %s\n", punch.Peer, punch.Delay)
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(punch.Delay):
+	}
+
+	conn, err := connect(ctx, local, punch.Peer, deadline, func() bool { return !s.isPending(punch.ID) })
+	if err != nil {
+		// the client may have reached us through the listener instead
+		if s.isPending(punch.ID) && s.debug {
+			log.Printf("Failed to punch to %s: %s\n", punch.Peer, err.Error())
+		}
+		s.mu.Lock()
+		delete(s.pending, punch.ID)
+		s.mu.Unlock()
+		return
+	}
+
+	s.handlePunched(conn)
+}
+
+func (s *Server) isPending(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline, ok := s.pending[id]
+	return ok && time.Now().Before(deadline)
+}
+
+func (s *Server) acceptPunched(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handlePunched(conn)
+	}
+}
+
+// handlePunched checks that a connection comes from a client the rendezvous
+// announced and connects it to the server.
+func (s *Server) handlePunched(conn net.Conn) {
+	peer := crypto.NewConn(conn, s.cipher)
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	buf := make([]byte, 256)
+	n, err := peer.Read(buf)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	id := strings.TrimPrefix(string(buf[:n]), "HELLO: ")
+
+	s.mu.Lock()
+	deadline, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if !ok || time.Now().After(deadline) {
+		conn.Close()
+		return
+	}
+
+	if _, err := fmt.Fprintf(peer, "SUCCESS: %s", id); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if s.proxy != nil {
+		targetConn, client, err := s.proxy.Accept(peer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error connecting client: %s\n", err.Error())
+			conn.Close()
+			return
+		}
+		if s.debug {
+			log.Printf("Streaming %s to %s peer-to-peer\n", conn.RemoteAddr().String(), targetConn.RemoteAddr().String())
+		}
+		pipe.Join(targetConn, client)
+		return
+	}
+
+	serverConn, err := net.Dial("tcp", s.serverAddress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to server: %s\n", err.Error())
+		conn.Close()
+		return
+	}
+
+	if s.debug {
+		log.Printf("Streaming %s to %s peer-to-peer\n", conn.RemoteAddr().String(), s.serverAddress)
+	}
+
+	pipe.Join(serverConn, peer)
+}
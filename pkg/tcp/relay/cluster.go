@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/cluster"
+	"github.com/cbodonnell/net/pkg/pipe"
+)
+
+// names returns the names servers are registered under, for the cluster.
+func (r *Relay) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.services))
+	for name, svc := range r.services {
+		if r.hasServers(svc) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasServers reports whether any server instance is registered with a
+// service. The caller must hold r.mu.
+func (r *Relay) hasServers(svc *service) bool {
+	r.pruneInstances(svc)
+	return svc.pool.Len() > 0
+}
+
+// forward relays a client's message or session through the relay in the
+// cluster that holds the name, reporting false if there is none. The message
+// goes to the other relay's client port marked as forwarded, so that it
+// isn't forwarded again, and the other relay's answer goes back to the
+// client as it is.
+func (r *Relay) forward(conn net.Conn, name string, message Message) (bool, error) {
+	entry, err := r.node.Locate(name)
+	if errors.Is(err, cluster.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	peer, err := net.DialTimeout("tcp", entry.Address, time.Second*5)
+	if err != nil {
+		return false, fmt.Errorf("error connecting to %s: %s", entry.Address, err.Error())
+	}
+	defer peer.Close()
+
+	if r.debug {
+		fmt.Printf("CLIENT: Forwarding message for %s to %s\n", name, entry.Address)
+	}
+
+	// the other relay takes the client's addresses from the header, so it is
+	// signed to show it comes from the cluster
+	kind := "request"
+	if message.Stream != nil {
+		kind = "stream"
+	}
+	fields := []string{
+		name, message.Source, message.Destination, kind,
+		strconv.Itoa(len(message.Data)), strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if _, err := fmt.Fprintf(peer, "FORWARD: %s %s\n", strings.Join(fields, " "), r.node.Sign(fields...)); err != nil {
+		return true, fmt.Errorf("error forwarding to %s: %s", entry.Address, err.Error())
+	}
+
+	// a streamed session is joined to the other relay, which streams it on
+	// to its server
+	if message.Stream != nil {
+		pipe.Join(peer, message.Stream)
+		return true, nil
+	}
+
+	// the other relay reads as many bytes of message as the header says
+	if _, err := peer.Write(message.Data); err != nil {
+		return true, fmt.Errorf("error forwarding to %s: %s", entry.Address, err.Error())
+	}
+
+	peer.SetReadDeadline(time.Now().Add(r.queueTimeout + time.Second*5))
+	if _, err := io.Copy(conn, peer); err != nil {
+		return true, fmt.Errorf("error forwarding response from %s: %s", entry.Address, err.Error())
+	}
+	return true, nil
+}
+
+// forwardWindow is how far the time a forwarded message was sent may be
+// from now, so that a forwarded header can't be replayed for long.
+const forwardWindow = time.Second * 30
+
+// fromCluster reports whether a forwarded message was recently signed by a
+// relay in the cluster.
+func (r *Relay) fromCluster(header *clientHeader, conn net.Conn) bool {
+	if r.node == nil {
+		return false
+	}
+	if age := time.Since(header.sent); age > forwardWindow || age < -forwardWindow {
+		return false
+	}
+	return r.node.Verify(header.signature, conn.RemoteAddr(), header.signed...)
+}
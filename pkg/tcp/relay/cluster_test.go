@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/cluster"
+)
+
+// newTestRelay creates a relay in a cluster that shares the registry, and
+// accepts its clients on a loopback port.
+func newTestRelay(t *testing.T, registry cluster.Registry, clusterAddress string) (*Relay, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	r, err := NewTCPRelay(TCPRelayOpts{
+		ClientPort:     uint(listener.Addr().(*net.TCPAddr).Port),
+		BufferSize:     1024,
+		QueueTimeout:   "1s",
+		ClusterAddress: clusterAddress,
+		AdvertiseHost:  "127.0.0.1",
+		ClusterSecret:  "secret",
+		Registry:       registry,
+	})
+	if err != nil {
+		t.Fatalf("NewTCPRelay: %v", err)
+	}
+	go r.handleClientConnections(listener, make(chan error, 1))
+	return r, listener.Addr().String()
+}
+
+// serveOnce connects a server for a name to the relay, which answers one
+// request with the request in upper case.
+func serveOnce(t *testing.T, r *Relay, name string) {
+	t.Helper()
+	server, relaySide := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go r.waitForMessage(relaySide)
+
+	if _, err := fmt.Fprintf(server, "WAIT: %s test 1 stream\n", name); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	go func() {
+		defer server.Close()
+		reader := bufio.NewReader(server)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		length, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(line), "MESSAGE: request "))
+		if err != nil {
+			return
+		}
+		request := make([]byte, length)
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+		server.Write([]byte(strings.ToUpper(string(request))))
+	}()
+}
+
+// roundTrip sends a request to a relay's client port and reads the answer.
+func roundTrip(t *testing.T, address, request string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	return string(response)
+}
+
+func TestForwardThroughCluster(t *testing.T) {
+	registry := cluster.NewMemory()
+	a, addressA := newTestRelay(t, registry, "127.0.0.1:7001")
+	_, addressB := newTestRelay(t, registry, "127.0.0.1:7002")
+
+	// the name is held on a, and its clients connect to b
+	serveOnce(t, a, "web")
+	registry.Announce(cluster.Entry{
+		Network: "tcp",
+		Name:    "web",
+		Relay:   "127.0.0.1:7001",
+		Address: addressA,
+		Expires: time.Now().Add(time.Minute),
+	})
+
+	if got := roundTrip(t, addressB, "CONNECT: web\nhello"); got != "HELLO" {
+		t.Fatalf("got %q through b, want %q", got, "HELLO")
+	}
+}
+
+func TestForwardedHeader(t *testing.T) {
+	registry := cluster.NewMemory()
+	a, addressA := newTestRelay(t, registry, "127.0.0.1:7001")
+	b, _ := newTestRelay(t, registry, "127.0.0.1:7002")
+
+	tests := []struct {
+		name string
+		sent time.Time
+		sign func(fields []string) string
+		want string
+	}{
+		{"signed", time.Now(), func(fields []string) string { return b.node.Sign(fields...) }, "HELLO"},
+		{"bad signature", time.Now(), func(fields []string) string { return strings.Repeat("0", 64) }, "FAIL: BAD REQUEST"},
+		{"unsigned", time.Now(), func(fields []string) string { return "-" }, "FAIL: BAD REQUEST"},
+		{"too old", time.Now().Add(-forwardWindow * 2), func(fields []string) string { return b.node.Sign(fields...) }, "FAIL: BAD REQUEST"},
+		{"too new", time.Now().Add(forwardWindow * 2), func(fields []string) string { return b.node.Sign(fields...) }, "FAIL: BAD REQUEST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveOnce(t, a, "web")
+			fields := []string{"web", "198.51.100.1:4000", addressA, "request", "5", strconv.FormatInt(tt.sent.Unix(), 10)}
+			request := fmt.Sprintf("FORWARD: %s %s\nhello", strings.Join(fields, " "), tt.sign(fields))
+			if got := roundTrip(t, addressA, request); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseForwardHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{"request", "FORWARD: web 1.2.3.4:5 6.7.8.9:10 request 5 1700000000 sig\n", false},
+		{"stream", "FORWARD: web 1.2.3.4:5 6.7.8.9:10 stream 0 1700000000 sig\n", false},
+		{"missing length", "FORWARD: web 1.2.3.4:5 6.7.8.9:10 request 1700000000 sig\n", true},
+		{"negative length", "FORWARD: web 1.2.3.4:5 6.7.8.9:10 request -1 1700000000 sig\n", true},
+		{"unknown kind", "FORWARD: web 1.2.3.4:5 6.7.8.9:10 datagram 5 1700000000 sig\n", true},
+		{"bad time", "FORWARD: web 1.2.3.4:5 6.7.8.9:10 request 5 yesterday sig\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := parseClientHeader(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseClientHeader: %v", err)
+			}
+			if !header.forwarded || len(header.signed) != 6 || header.signature != "sig" {
+				t.Fatalf("got %+v", header)
+			}
+		})
+	}
+}
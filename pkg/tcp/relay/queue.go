@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message states, a message is either picked up by a server or
+// expired by the client, whichever happens first.
+const (
+	messageQueued int32 = iota
+	messagePicked
+	messageExpired
+)
+
+type Message struct {
+	Client string
+	// Source and Destination are the addresses the client connected from
+	// and to, which are passed on to servers that ask for them.
+	Source      string
+	Destination string
+	Data        []byte
+	Deadline    time.Time
+	Response    chan []byte
+	Error       chan error
+	// Stream is the connection of a virtual host client, which is joined
+	// to the server's connection instead of sending it a single message.
+	Stream io.ReadWriteCloser
+	state  *int32
+}
+
+// pick claims the message for a server, unless it has expired.
+func (m Message) pick() bool {
+	if time.Now().After(m.Deadline) {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(m.state, messageQueued, messagePicked)
+}
+
+// expire withdraws the message and reports whether it is withdrawn, which
+// it is not if a server has already picked it up.
+func (m Message) expire() bool {
+	atomic.CompareAndSwapInt32(m.state, messageQueued, messageExpired)
+	return atomic.LoadInt32(m.state) == messageExpired
+}
+
+// messageQueue is a bounded queue of messages waiting for a server. Expired
+// messages are dropped rather than handed out, and don't count against the
+// capacity.
+type messageQueue struct {
+	mu       sync.Mutex
+	messages []Message
+	capacity int
+}
+
+func newMessageQueue(capacity int) *messageQueue {
+	return &messageQueue{capacity: capacity}
+}
+
+// push adds a message to the queue, or reports false if it is full.
+func (q *messageQueue) push(message Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	if len(q.messages) >= q.capacity {
+		return false
+	}
+	q.messages = append(q.messages, message)
+	return true
+}
+
+// pop picks the oldest message that hasn't expired, or reports false if there is none.
+func (q *messageQueue) pop() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	for len(q.messages) > 0 {
+		message := q.messages[0]
+		q.messages[0] = Message{}
+		q.messages = q.messages[1:]
+		if message.pick() {
+			return message, true
+		}
+	}
+	return Message{}, false
+}
+
+// len is the number of messages still waiting for a server.
+func (q *messageQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	return len(q.messages)
+}
+
+// prune drops expired messages. The lock must be held.
+func (q *messageQueue) prune() {
+	now := time.Now()
+	messages := q.messages[:0]
+	for _, message := range q.messages {
+		if now.After(message.Deadline) || atomic.LoadInt32(message.state) != messageQueued {
+			message.expire()
+			continue
+		}
+		messages = append(messages, message)
+	}
+	// clear the tail so dropped messages can be collected
+	for i := len(messages); i < len(q.messages); i++ {
+		q.messages[i] = Message{}
+	}
+	q.messages = messages
+}
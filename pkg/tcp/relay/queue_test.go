@@ -0,0 +1,180 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMessage(client string, timeout time.Duration) Message {
+	return Message{
+		Client:   client,
+		Deadline: time.Now().Add(timeout),
+		Response: make(chan []byte, 1),
+		Error:    make(chan error, 1),
+		state:    new(int32),
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	tests := []struct {
+		name string
+		// queued are the timeouts of the messages already in the queue
+		queued []time.Duration
+		want   bool
+	}{
+		{"empty", nil, true},
+		{"room left", []time.Duration{time.Minute}, true},
+		{"full", []time.Duration{time.Minute, time.Minute}, false},
+		{"full of expired messages", []time.Duration{-time.Second, -time.Second}, true},
+		{"partly expired", []time.Duration{time.Minute, -time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newMessageQueue(2)
+			// queue the messages directly, since messages past their
+			// deadline can't be pushed
+			for _, timeout := range tt.queued {
+				q.messages = append(q.messages, newTestMessage("queued", timeout))
+			}
+			if got := q.push(newTestMessage("new", time.Minute)); got != tt.want {
+				t.Fatalf("push = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := newMessageQueue(4)
+	for _, client := range []string{"a", "b", "c"} {
+		if !q.push(newTestMessage(client, time.Minute)) {
+			t.Fatalf("push %s failed", client)
+		}
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		message, ok := q.pop()
+		if !ok || message.Client != want {
+			t.Fatalf("popped %q, want %q", message.Client, want)
+		}
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatal("popped from an empty queue")
+	}
+}
+
+func TestQueueDeadline(t *testing.T) {
+	q := newMessageQueue(4)
+	expiring := newTestMessage("expiring", time.Millisecond*20)
+	q.push(expiring)
+	q.push(newTestMessage("waiting", time.Minute))
+	time.Sleep(time.Millisecond * 30)
+
+	if n := q.len(); n != 1 {
+		t.Fatalf("%d messages waiting, want 1", n)
+	}
+	message, ok := q.pop()
+	if !ok || message.Client != "waiting" {
+		t.Fatalf("popped %q, want the message that hasn't expired", message.Client)
+	}
+	if !expiring.expire() {
+		t.Fatal("expected the expired message to be withdrawn")
+	}
+}
+
+func TestQueueWithdrawn(t *testing.T) {
+	q := newMessageQueue(4)
+	withdrawn := newTestMessage("withdrawn", time.Minute)
+	q.push(withdrawn)
+	q.push(newTestMessage("waiting", time.Minute))
+
+	// the client gives up before its deadline, as it does when the relay's
+	// timer fires first
+	if !withdrawn.expire() {
+		t.Fatal("expected a queued message to be withdrawn")
+	}
+	message, ok := q.pop()
+	if !ok || message.Client != "waiting" {
+		t.Fatalf("popped %q, want the message that wasn't withdrawn", message.Client)
+	}
+}
+
+func TestPickExpire(t *testing.T) {
+	tests := []struct {
+		name       string
+		first      string
+		wantPick   bool
+		wantExpire bool
+	}{
+		{"picked first", "pick", true, false},
+		{"expired first", "expire", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := newTestMessage("client", time.Minute)
+			var picked, expired bool
+			if tt.first == "pick" {
+				picked = message.pick()
+				expired = message.expire()
+			} else {
+				expired = message.expire()
+				picked = message.pick()
+			}
+			if picked != tt.wantPick || expired != tt.wantExpire {
+				t.Fatalf("picked %v and expired %v, want %v and %v", picked, expired, tt.wantPick, tt.wantExpire)
+			}
+		})
+	}
+}
+
+func TestPickExpireRace(t *testing.T) {
+	// a server picking a message up and its client giving up at the same
+	// time must agree on which of them won
+	for i := 0; i < 1000; i++ {
+		message := newTestMessage("client", time.Minute)
+		var picked, expired bool
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			picked = message.pick()
+		}()
+		go func() {
+			defer wg.Done()
+			expired = message.expire()
+		}()
+		wg.Wait()
+		if picked == expired {
+			t.Fatalf("picked %v and expired %v, want exactly one", picked, expired)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueSize int
+		queued    int
+		wantErr   error
+	}{
+		{"no server", 1, 0, errNoServer},
+		{"queue full", 1, 1, errQueueFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewTCPRelay(TCPRelayOpts{QueueSize: uint(tt.queueSize), QueueTimeout: "50ms"})
+			if err != nil {
+				t.Fatalf("NewTCPRelay: %v", err)
+			}
+			svc := r.service("web")
+			for i := 0; i < tt.queued; i++ {
+				svc.queue.push(newTestMessage("queued", time.Minute))
+			}
+
+			_, err = r.send("web", newTestMessage("client", r.queueTimeout), "client")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
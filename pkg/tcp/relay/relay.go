@@ -1,50 +1,172 @@
 package relay
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/admin"
+	"github.com/cbodonnell/net/pkg/balance"
+	"github.com/cbodonnell/net/pkg/cluster"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/proxyproto"
 )
 
 type Relay struct {
-	clientPort uint
-	serverPort uint
-	bufferSize uint
-	debug      bool
+	clientPort       uint
+	serverPort       uint
+	rendezvousPort   uint
+	httpPort         uint
+	tlsPort          uint
+	proxyProtocol    bool
+	websocketAddress string
+	websocketPath    string
+	websocketTLS     *tls.Config
+	bufferSize       uint
+	queueSize        int
+	queueTimeout     time.Duration
+	adminAddress     string
+	policy           balance.Policy
+	sticky           bool
+	node             *cluster.Node
+	debug            bool
+	mu               sync.Mutex
+	services         map[string]*service
+	servers          map[string]*serverConn
+	sessions         map[string]*admin.SessionInfo
+	rendezvous       map[string]*rendezvousServer
+	draining         bool
+	enqueued         uint64
+	expired          uint64
+	rejected         uint64
+}
+
+// serverConn is a server connection waiting for a message.
+type serverConn struct {
+	conn      net.Conn
+	name      string
+	id        string
+	connected time.Time
+	message   chan Message
+	done      chan struct{}
 }
 
 type TCPRelayOpts struct {
-	ClientPort uint
-	ServerPort uint
-	BufferSize uint
-	Debug      bool
+	ClientPort       uint
+	ServerPort       uint
+	RendezvousPort   uint
+	HTTPPort         uint
+	TLSPort          uint
+	ProxyProtocol    bool
+	WebSocketAddress string
+	WebSocketPath    string
+	WebSocketCert    string
+	WebSocketKey     string
+	BufferSize       uint
+	QueueSize        uint
+	QueueTimeout     string
+	AdminAddress     string
+	Policy           string
+	Sticky           bool
+	ClusterAddress   string
+	AdvertiseHost    string
+	Peers            []string
+	ClusterSecret    string
+	Registry         cluster.Registry
+	Debug            bool
 }
 
-func NewTCPRelay(opts TCPRelayOpts) *Relay {
-	return &Relay{
-		clientPort: opts.ClientPort,
-		serverPort: opts.ServerPort,
-		bufferSize: opts.BufferSize,
-		debug:      opts.Debug,
+func NewTCPRelay(opts TCPRelayOpts) (*Relay, error) {
+	queueTimeout := time.Second * 10
+	if opts.QueueTimeout != "" {
+		var err error
+		queueTimeout, err = time.ParseDuration(opts.QueueTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing queue timeout: %s", err.Error())
+		}
+	}
+
+	queueSize := opts.QueueSize
+	if queueSize == 0 {
+		queueSize = 64
+	}
+
+	policy, err := balance.ParsePolicy(opts.Policy)
+	if err != nil {
+		return nil, err
 	}
-}
 
-type Message struct {
-	Data     []byte
-	Response chan []byte
-	Error    chan error
+	websocketPath := opts.WebSocketPath
+	if websocketPath == "" {
+		websocketPath = "/"
+	}
+
+	// without a certificate, WebSockets are served as ws, for a reverse proxy
+	// in front of the relay to terminate TLS
+	var websocketTLS *tls.Config
+	if opts.WebSocketCert != "" || opts.WebSocketKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.WebSocketCert, opts.WebSocketKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading WebSocket certificate: %s", err.Error())
+		}
+		websocketTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	var node *cluster.Node
+	if opts.ClusterAddress != "" {
+		node, err = cluster.NewNode(cluster.NodeOpts{
+			Registry:      opts.Registry,
+			Network:       "tcp",
+			ListenAddress: opts.ClusterAddress,
+			AdvertiseHost: opts.AdvertiseHost,
+			ClientPort:    opts.ClientPort,
+			Peers:         opts.Peers,
+			Secret:        opts.ClusterSecret,
+			Debug:         opts.Debug,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Relay{
+		clientPort:       opts.ClientPort,
+		serverPort:       opts.ServerPort,
+		rendezvousPort:   opts.RendezvousPort,
+		httpPort:         opts.HTTPPort,
+		tlsPort:          opts.TLSPort,
+		proxyProtocol:    opts.ProxyProtocol,
+		websocketAddress: opts.WebSocketAddress,
+		websocketPath:    websocketPath,
+		websocketTLS:     websocketTLS,
+		bufferSize:       opts.BufferSize,
+		queueSize:        int(queueSize),
+		queueTimeout:     queueTimeout,
+		adminAddress:     opts.AdminAddress,
+		policy:           policy,
+		sticky:           opts.Sticky,
+		node:             node,
+		debug:            opts.Debug,
+		services:         make(map[string]*service),
+		servers:          make(map[string]*serverConn),
+		sessions:         make(map[string]*admin.SessionInfo),
+		rendezvous:       make(map[string]*rendezvousServer),
+	}, nil
 }
 
-func (r Relay) Run() error {
+func (r *Relay) Run() error {
 	// Make a channel to handle errors.
 	errChan := make(chan error)
 
-	// Make a channel to handle messages.
-	messageQueue := make(chan Message)
-
 	clientPortString := fmt.Sprintf(":%d", r.clientPort)
 	if r.debug {
 		log.Printf("Listening for client on %s\n", clientPortString)
@@ -55,7 +177,7 @@ func (r Relay) Run() error {
 		return err
 	}
 
-	go r.handleClientConnections(clientListener, messageQueue, errChan)
+	go r.handleClientConnections(clientListener, errChan)
 
 	serverPortString := fmt.Sprintf(":%d", r.serverPort)
 	if r.debug {
@@ -67,73 +189,260 @@ func (r Relay) Run() error {
 		return err
 	}
 
-	go r.handleServerConnections(serverListener, messageQueue, errChan)
+	go r.handleServerConnections(serverListener, errChan)
+
+	if r.rendezvousPort != 0 {
+		rendezvousPortString := fmt.Sprintf(":%d", r.rendezvousPort)
+		if r.debug {
+			log.Printf("Listening for rendezvous on %s\n", rendezvousPortString)
+		}
+
+		rendezvousListener, err := net.Listen("tcp", rendezvousPortString)
+		if err != nil {
+			return err
+		}
+
+		go r.handleRendezvousConnections(rendezvousListener, errChan)
+	}
+
+	if r.httpPort != 0 {
+		httpPortString := fmt.Sprintf(":%d", r.httpPort)
+		if r.debug {
+			log.Printf("Listening for HTTP virtual hosts on %s\n", httpPortString)
+		}
+
+		httpListener, err := net.Listen("tcp", httpPortString)
+		if err != nil {
+			return err
+		}
+
+		go r.handleVhostConnections(httpListener, sniffHTTP, false, errChan)
+	}
+
+	if r.tlsPort != 0 {
+		tlsPortString := fmt.Sprintf(":%d", r.tlsPort)
+		if r.debug {
+			log.Printf("Listening for TLS virtual hosts on %s\n", tlsPortString)
+		}
+
+		tlsListener, err := net.Listen("tcp", tlsPortString)
+		if err != nil {
+			return err
+		}
+
+		go r.handleVhostConnections(tlsListener, sniffTLS, true, errChan)
+	}
+
+	if r.websocketAddress != "" {
+		if r.debug {
+			log.Printf("Listening for WebSocket agents on %s%s\n", r.websocketAddress, r.websocketPath)
+		}
+
+		websocketListener, err := net.Listen("tcp", r.websocketAddress)
+		if err != nil {
+			return err
+		}
+		if r.websocketTLS != nil {
+			websocketListener = tls.NewListener(websocketListener, r.websocketTLS)
+		}
+
+		go r.handleWebSocketConnections(websocketListener, errChan)
+	}
+
+	if r.adminAddress != "" {
+		adminServer := admin.NewAdminServer(admin.AdminServerOpts{
+			Address: r.adminAddress,
+			Relay:   r,
+			Debug:   r.debug,
+		})
+		go func() {
+			errChan <- adminServer.Run()
+		}()
+	}
+
+	if r.node != nil {
+		go func() {
+			errChan <- r.node.Run(r.names)
+		}()
+	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 	select {
 	case <-interrupt:
 		return errors.New("interrupted")
-	case <-errChan:
-		return fmt.Errorf("error: %s", <-errChan)
+	case err := <-errChan:
+		return fmt.Errorf("error: %s", err)
 	}
 }
 
-func (r *Relay) handleClientConnections(clientListener net.Listener, messageQueue chan Message, errChan chan<- error) error {
+func (r *Relay) handleClientConnections(clientListener net.Listener, errChan chan<- error) {
 	defer clientListener.Close()
 	for {
 		// Listen for an incoming connections from the client.
 		conn, err := clientListener.Accept()
 		if err != nil {
 			errChan <- fmt.Errorf("error accepting from client: %s", err.Error())
+			return
 		}
 		// Handle connections from the client.
-		if err = r.handleClientRequest(conn, messageQueue); err != nil {
-			fmt.Fprintf(os.Stderr, "error handling client request: %s", err.Error())
-		}
+		go func() {
+			conn, err := r.acceptProxyHeader(conn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error accepting client: %s\n", err.Error())
+				return
+			}
+			if err := r.handleClientRequest(conn); err != nil {
+				fmt.Fprintf(os.Stderr, "error handling client request: %s\n", err.Error())
+			}
+		}()
+	}
+}
+
+// acceptProxyHeader reads the PROXY protocol header a load balancer in
+// front of the relay sends, so that the connection's remote address is the
+// client's. Connections are taken as they are if the relay doesn't expect it.
+func (r *Relay) acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	if !r.proxyProtocol {
+		return conn, nil
+	}
+	proxied, err := proxyproto.Accept(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return proxied, nil
 }
 
-func (r *Relay) handleClientRequest(conn net.Conn, queue chan<- Message) error {
+func (r *Relay) handleClientRequest(conn net.Conn) error {
 	// Close the connection when you're done with it.
 	defer conn.Close()
 
-	// Make a buffer to hold incoming data.
-	if r.debug {
-		log.Println("CLIENT: Reading from client")
+	r.mu.Lock()
+	if r.draining {
+		r.mu.Unlock()
+		fmt.Fprintf(conn, "FAIL: DRAINING")
+		return errors.New("draining, rejected client")
 	}
-	buf := make([]byte, r.bufferSize)
-	// Read the incoming connection into the buffer.
-	reqLen, err := conn.Read(buf)
+	session := &admin.SessionInfo{Client: conn.RemoteAddr().String(), Started: time.Now()}
+	r.sessions[session.Client] = session
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.sessions, session.Client)
+		r.mu.Unlock()
+	}()
+
+	// the client names the server it wants before its message
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
 	if err != nil {
 		return fmt.Errorf("error reading from client: %s", err.Error())
 	}
+	header, err := parseClientHeader(line)
+	if err != nil {
+		fmt.Fprintf(conn, "FAIL: BAD REQUEST")
+		return err
+	}
+	// the client's addresses are only taken from relays in the cluster
+	if header.forwarded && !r.fromCluster(header, conn) {
+		fmt.Fprintf(conn, "FAIL: BAD REQUEST")
+		return fmt.Errorf("forwarded request from %s is not from a relay in the cluster", conn.RemoteAddr().String())
+	}
+	name := header.name
 
 	message := Message{
-		Data:     buf[:reqLen],
-		Response: make(chan []byte),
-		Error:    make(chan error),
+		Client:      session.Client,
+		Source:      conn.RemoteAddr().String(),
+		Destination: conn.LocalAddr().String(),
+		Deadline:    time.Now().Add(r.queueTimeout),
+		Response:    make(chan []byte),
+		Error:       make(chan error),
+		state:       new(int32),
 	}
-	if r.debug {
-		log.Printf("CLIENT: Received message with %d bytes:\n%s\n", reqLen, string(message.Data))
+	if header.forwarded {
+		message.Source, message.Destination = header.source, header.destination
 	}
 
-	// add message to the queue
-	if r.debug {
-		log.Println("CLIENT: Adding message to queue")
+	if header.stream {
+		// a streamed session is joined to the server once one picks it up
+		if r.debug {
+			log.Printf("CLIENT: Streaming client for %s\n", name)
+		}
+		message.Stream = pipe.Prefixed(conn, reader)
+	} else if header.forwarded {
+		// a forwarded message is as long as its header says
+		if header.length > int(r.bufferSize) {
+			fmt.Fprintf(conn, "FAIL: BAD REQUEST")
+			return fmt.Errorf("forwarded message of %d bytes is larger than the buffer", header.length)
+		}
+		message.Data = make([]byte, header.length)
+		if _, err := io.ReadFull(reader, message.Data); err != nil {
+			return fmt.Errorf("error reading from relay: %s", err.Error())
+		}
+		if r.debug {
+			log.Printf("CLIENT: Received forwarded message with %d bytes\n", header.length)
+		}
+	} else {
+		// Make a buffer to hold incoming data.
+		if r.debug {
+			log.Printf("CLIENT: Reading from client for %s\n", name)
+		}
+		buf := make([]byte, r.bufferSize)
+		// Read the incoming connection into the buffer.
+		reqLen, err := reader.Read(buf)
+		if err != nil {
+			return fmt.Errorf("error reading from client: %s", err.Error())
+		}
+		message.Data = buf[:reqLen]
+		if r.debug {
+			log.Printf("CLIENT: Received message with %d bytes:\n%s\n", reqLen, string(message.Data))
+		}
 	}
-	queue <- message
 
-	// wait for a response to the message
-	if r.debug {
-		log.Println("CLIENT: Waiting for a response")
+	// a name no server here is registered under may be held by another
+	// relay in the cluster, unless that relay is the one asking
+	if r.node != nil && !header.forwarded {
+		r.mu.Lock()
+		svc, ok := r.services[name]
+		local := ok && r.hasServers(svc)
+		r.mu.Unlock()
+		if !local {
+			ok, err := r.forward(conn, name, message)
+			if ok {
+				return err
+			}
+			if err != nil {
+				// queue the message here in case a server turns up
+				fmt.Fprintf(os.Stderr, "error forwarding client request: %s\n", err.Error())
+			}
+		}
 	}
 
-	var response []byte
-	select {
-	case response = <-message.Response:
-	case err = <-message.Error:
-		return fmt.Errorf("server returned an error: %s", err.Error())
+	// servers of the virtual hosts expect their clients' traffic as it is
+	r.mu.Lock()
+	svc, ok := r.services[name]
+	public := ok && svc.public
+	r.mu.Unlock()
+	if public {
+		fmt.Fprintf(conn, "FAIL: NO SERVER")
+		return fmt.Errorf("%s only serves virtual host clients", name)
+	}
+
+	response, err := r.send(name, message, balance.ClientID(conn.RemoteAddr()))
+	switch {
+	case errors.Is(err, errQueueFull):
+		fmt.Fprintf(conn, "FAIL: QUEUE FULL")
+		return fmt.Errorf("queue for %s is full, rejected client", name)
+	case errors.Is(err, errNoServer):
+		fmt.Fprintf(conn, "FAIL: NO SERVER")
+		return fmt.Errorf("no server for %s picked up the message within %s", name, r.queueTimeout)
+	case err != nil:
+		return err
+	}
+	if message.Stream != nil {
+		return nil
 	}
 
 	if r.debug {
@@ -152,33 +461,229 @@ func (r *Relay) handleClientRequest(conn net.Conn, queue chan<- Message) error {
 	return nil
 }
 
-func (r *Relay) handleServerConnections(serverListener net.Listener, messageQueue chan Message, errChan chan<- error) error {
+// errQueueFull is returned by send when a message can't be queued.
+var errQueueFull = errors.New("queue full")
+
+// errNoServer is returned by send when no server picks a message up in time.
+var errNoServer = errors.New("no server")
+
+// send hands a message to a waiting server for a name, or queues it until
+// one picks it up, and waits for the response.
+func (r *Relay) send(name string, message Message, client string) ([]byte, error) {
+	defer func() {
+		r.mu.Lock()
+		r.pruneService(name)
+		r.mu.Unlock()
+	}()
+
+	// hand the message to a waiting server, or add it to the queue
+	r.mu.Lock()
+	svc := r.service(name)
+	if _, ok := r.dispatch(svc, message, client); ok {
+		if r.debug {
+			log.Println("CLIENT: Handed message to a waiting server")
+		}
+	} else {
+		if r.debug {
+			log.Println("CLIENT: Adding message to queue")
+		}
+		if !svc.queue.push(message) {
+			r.rejected++
+			r.mu.Unlock()
+			return nil, errQueueFull
+		}
+	}
+	r.enqueued++
+	r.mu.Unlock()
+
+	// wait for a response to the message
+	if r.debug {
+		log.Println("CLIENT: Waiting for a response")
+	}
+
+	timer := time.NewTimer(time.Until(message.Deadline))
+	defer timer.Stop()
+
+	select {
+	case response := <-message.Response:
+		return response, nil
+	case err := <-message.Error:
+		return nil, fmt.Errorf("server returned an error: %s", err.Error())
+	case <-timer.C:
+		if message.expire() {
+			r.mu.Lock()
+			r.expired++
+			r.mu.Unlock()
+			return nil, errNoServer
+		}
+		// a server picked the message up just in time
+		select {
+		case response := <-message.Response:
+			return response, nil
+		case err := <-message.Error:
+			return nil, fmt.Errorf("server returned an error: %s", err.Error())
+		}
+	}
+}
+
+func (r *Relay) handleServerConnections(serverListener net.Listener, errChan chan<- error) {
 	defer serverListener.Close()
 	for {
 		// Listen for an incoming connections from the server.
 		conn, err := serverListener.Accept()
 		if err != nil {
 			errChan <- fmt.Errorf("error accepting from server: %s", err.Error())
+			return
 		}
 
+		go r.waitForMessage(conn)
+	}
+}
+
+// waitForMessage holds a server connection until there is a message for it,
+// it is unregistered through the admin API or it goes away.
+func (r *Relay) waitForMessage(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+
+	// the server says which name it serves and which instance it is
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading from server %s: %s\n", address, err.Error())
+		conn.Close()
+		return
+	}
+	header, err := parseServerHeader(line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading from server %s: %s\n", address, err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	server := &serverConn{
+		conn:      conn,
+		name:      header.name,
+		id:        header.id,
+		connected: time.Now(),
+		message:   make(chan Message, 1),
+		done:      make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	svc := r.service(header.name)
+	svc.public = header.public
+	instances := svc.pool.Len()
+	svc.pool.Add(header.id, header.weight)
+	if svc.pool.Len() > instances {
+		r.node.Changed()
+	}
+	svc.lastSeen[header.id] = time.Now()
+	message, ok := svc.queue.pop()
+	if ok {
+		svc.pool.Acquire(header.id)
+	} else {
+		svc.waiting[header.id] = append(svc.waiting[header.id], server)
+		r.servers[address] = server
+	}
+	r.mu.Unlock()
+
+	if !ok {
 		if r.debug {
-			log.Println("SERVER: Reading from message queue")
+			log.Printf("SERVER: %s waiting for a message for %s\n", address, header.name)
 		}
-		message := <-messageQueue
-
-		// Handle connections from the server.
-		if err = r.handleServerRequest(conn, message); err != nil {
-			// return fmt.Errorf("error handling server request: %s", err.Error())
-			message.Error <- fmt.Errorf("error handling server request: %s", err.Error())
-			fmt.Fprintf(os.Stderr, "error handling server request: %s", err.Error())
+		// servers send nothing while they wait, so reading from one only
+		// returns once it goes away, like when its backend goes unhealthy
+		gone := make(chan struct{})
+		go func() {
+			conn.Read(make([]byte, 1))
+			close(gone)
+		}()
+		select {
+		case message = <-server.message:
+			// stop reading before the server answers the message
+			conn.SetReadDeadline(time.Now())
+			<-gone
+			conn.SetReadDeadline(time.Time{})
+		case <-server.done:
+			conn.Close()
+			return
+		case <-gone:
+			r.mu.Lock()
+			removed := r.removeWaiting(svc, server)
+			if removed {
+				close(server.done)
+			}
+			r.mu.Unlock()
+			if removed {
+				if r.debug {
+					log.Printf("SERVER: %s went away while waiting for %s\n", address, header.name)
+				}
+				conn.Close()
+				return
+			}
+			// a message was handed to it as it went away, which fails
+			// like any other message to a server that's gone
+			select {
+			case message = <-server.message:
+			case <-server.done:
+				conn.Close()
+				return
+			}
 		}
 	}
+
+	r.mu.Lock()
+	if session, ok := r.sessions[message.Client]; ok {
+		session.Server = fmt.Sprintf("%s (%s)", header.name, address)
+	}
+	r.mu.Unlock()
+
+	// Handle connections from the server.
+	if err := r.handleServerRequest(conn, message, header); err != nil {
+		message.Error <- fmt.Errorf("error handling server request: %s", err.Error())
+		fmt.Fprintf(os.Stderr, "error handling server request: %s\n", err.Error())
+	}
+
+	r.mu.Lock()
+	svc.pool.Release(header.id)
+	svc.lastSeen[header.id] = time.Now()
+	r.mu.Unlock()
 }
 
-func (r *Relay) handleServerRequest(conn net.Conn, message Message) error {
+func (r *Relay) handleServerRequest(conn net.Conn, message Message, header *serverHeader) error {
 	// Close the connection when you're done with it.
 	defer conn.Close()
 
+	// servers that stream are told whether a message is a stream or a
+	// request and how long it is, and the client's addresses go after that,
+	// each on its own line
+	var prefix []byte
+	if header.stream {
+		kind := fmt.Sprintf("request %d", len(message.Data))
+		if message.Stream != nil {
+			kind = "stream"
+		}
+		prefix = []byte(fmt.Sprintf("MESSAGE: %s\n", kind))
+	} else if message.Stream != nil && !header.public {
+		return errors.New("server does not take streamed sessions")
+	}
+	if header.client {
+		prefix = append(prefix, fmt.Sprintf("CLIENT: %s %s\n", message.Source, message.Destination)...)
+	}
+
+	if message.Stream != nil {
+		if r.debug {
+			log.Println("SERVER: Streaming client to server")
+		}
+		if _, err := conn.Write(prefix); err != nil {
+			return fmt.Errorf("error writing to server: %s", err.Error())
+		}
+		pipe.Join(conn, message.Stream)
+		message.Response <- nil
+		return nil
+	}
+
 	if r.debug {
 		log.Printf("SERVER: Found message with %d bytes:\n%s\n", len(message.Data), string(message.Data))
 	}
@@ -187,6 +692,9 @@ func (r *Relay) handleServerRequest(conn net.Conn, message Message) error {
 	if r.debug {
 		log.Println("SERVER: Sending message to server")
 	}
+	if _, err := conn.Write(prefix); err != nil {
+		return fmt.Errorf("error writing to server: %s", err.Error())
+	}
 	_, err := conn.Write(message.Data)
 	if err != nil {
 		return fmt.Errorf("error writing to server: %s", err.Error())
@@ -216,3 +724,110 @@ func (r *Relay) handleServerRequest(conn net.Conn, message Message) error {
 
 	return nil
 }
+
+// Servers lists the server connections waiting for a message, and the
+// servers registered with the rendezvous.
+func (r *Relay) Servers() []admin.ServerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	servers := make([]admin.ServerInfo, 0, len(r.servers)+len(r.rendezvous))
+	for address, server := range r.servers {
+		info := admin.ServerInfo{
+			Name:     server.name,
+			Address:  address,
+			LastPing: server.connected,
+		}
+		if backend, ok := r.services[server.name].pool.Get(server.id); ok {
+			info.Weight = backend.Weight
+			info.Connections = backend.Conns
+		}
+		servers = append(servers, info)
+	}
+	for name, server := range r.rendezvous {
+		servers = append(servers, admin.ServerInfo{
+			Name:     name,
+			Address:  server.conn.RemoteAddr().String(),
+			LastPing: server.registered,
+		})
+	}
+	sort.SliceStable(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers
+}
+
+func (r *Relay) Sessions() []admin.SessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]admin.SessionInfo, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions
+}
+
+// QueueMetrics reports how many client messages are waiting for a server
+// and what has happened to the messages queued so far.
+func (r *Relay) QueueMetrics() admin.QueueMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metrics := admin.QueueMetrics{
+		Capacity:       r.queueSize,
+		WaitingServers: len(r.servers),
+		Enqueued:       r.enqueued,
+		Expired:        r.expired,
+		Rejected:       r.rejected,
+		Queues:         make(map[string]int, len(r.services)),
+	}
+	for name, svc := range r.services {
+		depth := svc.queue.len()
+		metrics.Depth += depth
+		metrics.Queues[name] = depth
+	}
+	return metrics
+}
+
+// Unregister closes a rendezvous registration, the waiting connections of
+// every server for a name, or the waiting connection from an address.
+func (r *Relay) Unregister(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if server, ok := r.rendezvous[name]; ok {
+		delete(r.rendezvous, name)
+		server.conn.Close()
+		return nil
+	}
+
+	var servers []*serverConn
+	if server, ok := r.servers[name]; ok {
+		servers = append(servers, server)
+	} else {
+		for _, server := range r.servers {
+			if server.name == name {
+				servers = append(servers, server)
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("%s: %w", name, admin.ErrNotRegistered)
+	}
+	for _, server := range servers {
+		if r.removeWaiting(r.services[server.name], server) {
+			close(server.done)
+		}
+	}
+	return nil
+}
+
+// Drain stops accepting new client requests. Requests in flight are
+// allowed to finish.
+func (r *Relay) Drain() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+	return nil
+}
@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/protocol"
+	"github.com/cbodonnell/net/pkg/tcp/punch"
+)
+
+// punchDelay is how long both sides wait before connecting to each other,
+// enough for the announcement to reach a server on the other side of the world.
+const punchDelay = time.Millisecond * 500
+
+// rendezvousServer is a server registered to accept punched connections.
+type rendezvousServer struct {
+	conn       net.Conn
+	registered time.Time
+	// mu serializes announcements written to the connection
+	mu sync.Mutex
+}
+
+func (r *Relay) handleRendezvousConnections(listener net.Listener, errChan chan<- error) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errChan <- fmt.Errorf("error accepting from rendezvous: %s", err.Error())
+			return
+		}
+		go func() {
+			if err := r.handleRendezvous(conn); err != nil {
+				fmt.Fprintf(os.Stderr, "error handling rendezvous: %s\n", err.Error())
+			}
+		}()
+	}
+}
+
+func (r *Relay) handleRendezvous(conn net.Conn) error {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading from %s: %s", conn.RemoteAddr().String(), err.Error())
+	}
+	action, name, err := protocol.ParseLine(line)
+	if err != nil {
+		fmt.Fprintf(conn, "FAIL: BAD REQUEST\n")
+		return err
+	}
+
+	r.mu.Lock()
+	draining := r.draining
+	r.mu.Unlock()
+	if draining {
+		fmt.Fprintf(conn, "FAIL: DRAINING\n")
+		return fmt.Errorf("draining, rejected %s for %s", action, name)
+	}
+
+	switch action {
+	case "REGISTER":
+		return r.registerRendezvous(conn, reader, name)
+	case "PUNCH":
+		return r.announcePunch(conn, name)
+	default:
+		fmt.Fprintf(conn, "FAIL: NOT ALLOWED\n")
+		return fmt.Errorf("unknown action: %s", action)
+	}
+}
+
+// registerRendezvous holds a server's connection open until it goes away,
+// announcing the clients that want to punch to it.
+func (r *Relay) registerRendezvous(conn net.Conn, reader *bufio.Reader, name string) error {
+	server := &rendezvousServer{conn: conn, registered: time.Now()}
+
+	r.mu.Lock()
+	if _, ok := r.rendezvous[name]; ok {
+		r.mu.Unlock()
+		fmt.Fprintf(conn, "FAIL: ALREADY REGISTERED\n")
+		return fmt.Errorf("%s is already registered", name)
+	}
+	r.rendezvous[name] = server
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		if r.rendezvous[name] == server {
+			delete(r.rendezvous, name)
+		}
+		r.mu.Unlock()
+	}()
+
+	if r.debug {
+		log.Printf("[REGISTER] %s as %s\n", conn.RemoteAddr().String(), name)
+	}
+
+	server.mu.Lock()
+	_, err := fmt.Fprintf(conn, "SUCCESS: %s\n", name)
+	server.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the server only pings from now on, and one that stops is dropped so
+	// that its name is free again
+	for {
+		conn.SetReadDeadline(time.Now().Add(punch.PingTimeout))
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if r.debug {
+				log.Printf("[UNREGISTER] %s after timeout\n", name)
+			}
+			return nil
+		}
+		if err != nil {
+			if r.debug {
+				log.Printf("[UNREGISTER] %s\n", name)
+			}
+			return nil
+		}
+
+		action, _, err := protocol.ParseLine(line)
+		if err != nil || action != "PING" {
+			server.mu.Lock()
+			fmt.Fprintf(conn, "FAIL: BAD REQUEST\n")
+			server.mu.Unlock()
+			return fmt.Errorf("unexpected message from %s: %s", name, strings.TrimSpace(line))
+		}
+		server.mu.Lock()
+		_, err = fmt.Fprintf(conn, "PONG: %s\n", name)
+		server.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// announcePunch sends a client and a server each other's endpoints.
+func (r *Relay) announcePunch(conn net.Conn, name string) error {
+	r.mu.Lock()
+	server, ok := r.rendezvous[name]
+	r.mu.Unlock()
+	if !ok {
+		fmt.Fprintf(conn, "FAIL: NOT REGISTERED\n")
+		return fmt.Errorf("target not registered: %s", name)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+
+	toServer := &punch.Punch{Peer: conn.RemoteAddr().String(), ID: id, Delay: punchDelay}
+	toClient := &punch.Punch{Peer: server.conn.RemoteAddr().String(), ID: id, Delay: punchDelay}
+
+	if r.debug {
+		log.Printf("[PUNCH] from %s to %s at %s\n", toServer.Peer, name, toClient.Peer)
+	}
+
+	server.mu.Lock()
+	_, err := fmt.Fprintf(server.conn, "PUNCH: %s\n", toServer.String())
+	server.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(conn, "FAIL: UNAVAILABLE\n")
+		return fmt.Errorf("error writing to %s: %s", name, err.Error())
+	}
+
+	if _, err := fmt.Fprintf(conn, "SUCCESS: %s\n", toClient.String()); err != nil {
+		return fmt.Errorf("error writing to client: %s", err.Error())
+	}
+
+	// wait for the client to hang up so that it, not us, holds the port open
+	conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+	conn.Read(make([]byte, 1))
+	return nil
+}
@@ -0,0 +1,207 @@
+package relay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/balance"
+	"github.com/cbodonnell/net/pkg/protocol"
+)
+
+// instanceTimeout is how long a server instance stays in its service's pool
+// without connecting, since instances reconnect after every message.
+const instanceTimeout = time.Second * 30
+
+// service is the queue and the servers for one name. Every server agent
+// identifies itself with an instance id, so that the connections it makes
+// one after another count as the same backend.
+type service struct {
+	queue    *messageQueue
+	pool     *balance.Pool
+	waiting  map[string][]*serverConn
+	lastSeen map[string]time.Time
+	public   bool
+}
+
+// serverHeader is what a server sends when it connects, "WAIT: name id
+// weight", followed by options: "public" for servers of the virtual hosts,
+// "client" for servers that want to know the address of each client, and
+// "stream" for servers that take streamed sessions as well as requests.
+type serverHeader struct {
+	name   string
+	id     string
+	weight int
+	public bool
+	client bool
+	stream bool
+}
+
+func parseServerHeader(line string) (*serverHeader, error) {
+	action, value, err := protocol.ParseLine(line)
+	if err != nil || action != "WAIT" {
+		return nil, fmt.Errorf("invalid server header: %s", line)
+	}
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid server header: %s", line)
+	}
+	weight, err := strconv.Atoi(fields[2])
+	if err != nil || weight < 1 {
+		return nil, fmt.Errorf("invalid weight: %s", fields[2])
+	}
+	header := &serverHeader{name: fields[0], id: fields[1], weight: weight}
+	for _, option := range fields[3:] {
+		switch option {
+		case "public":
+			header.public = true
+		case "client":
+			header.client = true
+		case "stream":
+			header.stream = true
+		default:
+			return nil, fmt.Errorf("unknown server option: %s", option)
+		}
+	}
+	return header, nil
+}
+
+// clientHeader is what a client sends before its message.
+type clientHeader struct {
+	name      string
+	forwarded bool
+	// stream is set for sessions that are streamed to the server instead of
+	// sent as a single message
+	stream bool
+	// source and destination are the client's addresses as another relay
+	// saw them, for forwarded messages, which that relay signs along with
+	// the time it sent them
+	source      string
+	destination string
+	// length is the size of a forwarded message, which follows the header
+	length    int
+	sent      time.Time
+	signed    []string
+	signature string
+}
+
+// parseClientHeader parses what a client sends before its message,
+// "CONNECT: name", "STREAM: name" for a streamed session, or "FORWARD: name
+// source destination request|stream length time signature" when another
+// relay in the cluster forwards the message or session of one of its
+// clients.
+func parseClientHeader(line string) (*clientHeader, error) {
+	action, value, err := protocol.ParseLine(line)
+	if err != nil || value == "" {
+		return nil, fmt.Errorf("invalid client header: %s", line)
+	}
+	switch action {
+	case "CONNECT":
+		return &clientHeader{name: value}, nil
+	case "STREAM":
+		return &clientHeader{name: value, stream: true}, nil
+	}
+	if action != "FORWARD" {
+		return nil, fmt.Errorf("invalid client header: %s", line)
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 7 || (fields[3] != "request" && fields[3] != "stream") {
+		return nil, fmt.Errorf("invalid client header: %s", line)
+	}
+	length, err := strconv.Atoi(fields[4])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid client header: %s", line)
+	}
+	sent, err := strconv.ParseInt(fields[5], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client header: %s", line)
+	}
+	return &clientHeader{
+		name:        fields[0],
+		forwarded:   true,
+		stream:      fields[3] == "stream",
+		source:      fields[1],
+		destination: fields[2],
+		length:      length,
+		sent:        time.Unix(sent, 0),
+		signed:      fields[:6],
+		signature:   fields[6],
+	}, nil
+}
+
+// service returns the service for a name, creating it if needed.
+// The caller must hold r.mu.
+func (r *Relay) service(name string) *service {
+	svc, ok := r.services[name]
+	if !ok {
+		svc = &service{
+			queue:    newMessageQueue(r.queueSize),
+			pool:     balance.NewPool(r.policy, r.sticky),
+			waiting:  make(map[string][]*serverConn),
+			lastSeen: make(map[string]time.Time),
+		}
+		r.services[name] = svc
+	}
+	return svc
+}
+
+// dispatch hands a message to a waiting server chosen by the service's
+// policy, or reports false if no server is waiting. The caller must hold r.mu.
+func (r *Relay) dispatch(svc *service, message Message, client string) (*serverConn, bool) {
+	r.pruneInstances(svc)
+
+	backend, ok := svc.pool.Pick(client, func(b *balance.Backend) bool { return len(svc.waiting[b.ID]) > 0 })
+	if !ok || !message.pick() {
+		return nil, false
+	}
+
+	server := svc.waiting[backend.ID][0]
+	r.removeWaiting(svc, server)
+	svc.pool.Acquire(backend.ID)
+	server.message <- message
+	return server, true
+}
+
+// removeWaiting stops a server connection from waiting for messages.
+// The caller must hold r.mu.
+func (r *Relay) removeWaiting(svc *service, server *serverConn) bool {
+	conns := svc.waiting[server.id]
+	for i, conn := range conns {
+		if conn == server {
+			svc.waiting[server.id] = append(conns[:i], conns[i+1:]...)
+			if len(svc.waiting[server.id]) == 0 {
+				delete(svc.waiting, server.id)
+			}
+			delete(r.servers, server.conn.RemoteAddr().String())
+			return true
+		}
+	}
+	return false
+}
+
+// pruneService forgets a name once it has no servers and no queued messages,
+// so that clients asking for names nobody serves don't leave them behind.
+// The caller must hold r.mu.
+func (r *Relay) pruneService(name string) {
+	svc, ok := r.services[name]
+	if !ok {
+		return
+	}
+	r.pruneInstances(svc)
+	if svc.pool.Len() == 0 && len(svc.waiting) == 0 && svc.queue.len() == 0 {
+		delete(r.services, name)
+	}
+}
+
+// pruneInstances removes the instances that have stopped connecting.
+// The caller must hold r.mu.
+func (r *Relay) pruneInstances(svc *service) {
+	for _, backend := range svc.pool.Backends() {
+		if len(svc.waiting[backend.ID]) == 0 && backend.Conns == 0 && time.Since(svc.lastSeen[backend.ID]) > instanceTimeout {
+			svc.pool.Remove(backend.ID)
+			delete(svc.lastSeen, backend.ID)
+			r.node.Changed()
+		}
+	}
+}
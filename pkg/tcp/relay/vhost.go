@@ -0,0 +1,207 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/admin"
+	"github.com/cbodonnell/net/pkg/balance"
+	"github.com/cbodonnell/net/pkg/pipe"
+)
+
+// maxHeaderSize is how much of an HTTP request is read looking for its Host.
+const maxHeaderSize = 16 * 1024
+
+// sniffTimeout is how long a virtual host client has to say which host it wants.
+const sniffTimeout = time.Second * 10
+
+// A sniffer reads which host a virtual host client wants, returning what
+// it read so that it can be passed on to the server untouched.
+type sniffer func(conn net.Conn) (string, []byte, error)
+
+// handleVhostConnections accepts public clients on a virtual host port,
+// routing each to the servers registered under the host it asks for.
+func (r *Relay) handleVhostConnections(listener net.Listener, sniff sniffer, isTLS bool, errChan chan<- error) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errChan <- fmt.Errorf("error accepting from virtual host client: %s", err.Error())
+			return
+		}
+		go func() {
+			conn, err := r.acceptProxyHeader(conn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error accepting virtual host client: %s\n", err.Error())
+				return
+			}
+			if err := r.handleVhostRequest(conn, sniff, isTLS); err != nil {
+				fmt.Fprintf(os.Stderr, "error handling virtual host request: %s\n", err.Error())
+			}
+		}()
+	}
+}
+
+func (r *Relay) handleVhostRequest(conn net.Conn, sniff sniffer, isTLS bool) error {
+	defer conn.Close()
+
+	// a TLS client can't be answered without terminating its connection,
+	// so it is only closed
+	fail := func(status int, host string) {
+		if !isTLS {
+			writeErrorPage(conn, status, host)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	host, head, err := sniff(conn)
+	if err != nil {
+		fail(http.StatusBadRequest, "")
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	if r.draining {
+		r.mu.Unlock()
+		fail(http.StatusServiceUnavailable, host)
+		return errors.New("draining, rejected virtual host client")
+	}
+	svc, ok := r.services[host]
+	connected := ok && svc.public && r.hasServers(svc)
+	session := &admin.SessionInfo{Client: conn.RemoteAddr().String(), Started: time.Now()}
+	if connected {
+		r.sessions[session.Client] = session
+	}
+	r.mu.Unlock()
+
+	if !connected {
+		fail(http.StatusBadGateway, host)
+		return fmt.Errorf("no server is connected for %s", host)
+	}
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.sessions, session.Client)
+		r.mu.Unlock()
+	}()
+
+	if r.debug {
+		log.Printf("CLIENT: Virtual host client for %s\n", host)
+	}
+
+	message := Message{
+		Client:      session.Client,
+		Source:      conn.RemoteAddr().String(),
+		Destination: conn.LocalAddr().String(),
+		Deadline:    time.Now().Add(r.queueTimeout),
+		Response:    make(chan []byte, 1),
+		Error:       make(chan error),
+		Stream:      pipe.Prefixed(conn, io.MultiReader(bytes.NewReader(head), conn)),
+		state:       new(int32),
+	}
+	_, err = r.send(host, message, balance.ClientID(conn.RemoteAddr()))
+	switch {
+	case errors.Is(err, errQueueFull):
+		fail(http.StatusServiceUnavailable, host)
+		return fmt.Errorf("queue for %s is full, rejected virtual host client", host)
+	case errors.Is(err, errNoServer):
+		fail(http.StatusGatewayTimeout, host)
+		return fmt.Errorf("no server for %s picked up the virtual host client within %s", host, r.queueTimeout)
+	}
+	return err
+}
+
+// sniffHTTP reads the Host header of an HTTP request.
+func sniffHTTP(conn net.Conn) (string, []byte, error) {
+	br := bufio.NewReaderSize(conn, maxHeaderSize)
+	for {
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			return "", nil, fmt.Errorf("error reading request: %s", err.Error())
+		}
+		head, _ := br.Peek(br.Buffered())
+		if i := bytes.Index(head, []byte("\r\n\r\n")); i >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head[:i+4])))
+			if err != nil {
+				return "", nil, fmt.Errorf("error parsing request: %s", err.Error())
+			}
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if host == "" {
+				return "", nil, errors.New("request has no host")
+			}
+			return host, head, nil
+		}
+		if len(head) >= maxHeaderSize {
+			return "", nil, errors.New("request headers are too large")
+		}
+	}
+}
+
+// errSniffed stops the TLS handshake once the client hello has been read.
+var errSniffed = errors.New("sniffed")
+
+// sniffTLS reads the server name a TLS client hello asks for, without
+// terminating the connection.
+func sniffTLS(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var host string
+	err := tls.Server(&readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			host = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+	if !errors.Is(err, errSniffed) {
+		return "", nil, fmt.Errorf("error reading client hello: %s", err.Error())
+	}
+	if host == "" {
+		return "", nil, errors.New("client hello has no server name")
+	}
+	return host, read.Bytes(), nil
+}
+
+// readOnlyConn lets the TLS handshake read a client hello without writing
+// anything back.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// writeErrorPage answers an HTTP client that couldn't be routed.
+func writeErrorPage(w io.Writer, status int, host string) {
+	text := http.StatusText(status)
+	detail := "The request could not be read."
+	switch status {
+	case http.StatusBadGateway:
+		detail = fmt.Sprintf("No server is connected for %s.", html.EscapeString(host))
+	case http.StatusGatewayTimeout:
+		detail = fmt.Sprintf("No server for %s answered in time.", html.EscapeString(host))
+	case http.StatusServiceUnavailable:
+		detail = fmt.Sprintf("%s is not taking requests right now.", html.EscapeString(host))
+	}
+	body := fmt.Sprintf("<!DOCTYPE html>\n<html>\n<head><title>%d %s</title></head>\n<body>\n<h1>%d %s</h1>\n<p>%s</p>\n</body>\n</html>\n", status, text, status, text, detail)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", status, text, len(body), body)
+}
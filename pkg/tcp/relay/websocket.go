@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/websocket"
+)
+
+// handleWebSocketConnections serves agents that connect over WebSocket at
+// the relay's path. Clients and servers share the path, and are told apart
+// by what they send first.
+func (r *Relay) handleWebSocketConnections(listener net.Listener, errChan chan<- error) {
+	defer listener.Close()
+	mux := http.NewServeMux()
+	mux.Handle(r.websocketPath, websocket.Handler(r.handleWebSocket))
+	err := http.Serve(listener, mux)
+	errChan <- fmt.Errorf("error serving WebSocket agents: %s", err.Error())
+}
+
+func (r *Relay) handleWebSocket(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	head, err := reader.Peek(len("WAIT:"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading from WebSocket agent %s: %s\n", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn = &peekedConn{Conn: conn, reader: reader}
+
+	if bytes.Equal(head, []byte("WAIT:")) {
+		if r.debug {
+			log.Printf("SERVER: %s connected over WebSocket\n", conn.RemoteAddr().String())
+		}
+		r.waitForMessage(conn)
+		return
+	}
+	if r.debug {
+		log.Printf("CLIENT: %s connected over WebSocket\n", conn.RemoteAddr().String())
+	}
+	if err := r.handleClientRequest(conn); err != nil {
+		fmt.Fprintf(os.Stderr, "error handling client request: %s\n", err.Error())
+	}
+}
+
+// peekedConn is a connection whose first bytes were read to see what kind
+// of agent it is.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
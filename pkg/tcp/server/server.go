@@ -1,39 +1,107 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cbodonnell/net/pkg/backoff"
 	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/health"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/protocol"
+	"github.com/cbodonnell/net/pkg/proxy"
+	"github.com/cbodonnell/net/pkg/proxyproto"
+	"github.com/cbodonnell/net/pkg/relays"
+	"github.com/cbodonnell/net/pkg/tcp/punch"
+	udpserver "github.com/cbodonnell/net/pkg/udp/server"
+	"github.com/cbodonnell/net/pkg/upstream"
 )
 
 type Server struct {
-	relayAddress  string
+	*backoff.Circuits
+	relays        []string
 	serverAddress string
+	serverName    string
+	id            string
+	weight        uint
 	cipher        crypto.Cipher
-	retryDuration time.Duration
+	puncher       *udpserver.UDPServer
+	rendezvous    *punch.Server
+	health        *health.Monitor
+	proxy         *proxy.Dialer
+	public        bool
+	proxyProtocol proxyproto.Version
+	upstream      *upstream.Dialer
 	debug         bool
 }
 
 type TCPServerOpts struct {
-	RelayAddress  string
-	ServerAddress string
-	Key           []byte
-	RetryDuration string
-	Debug         bool
+	RelayAddress      string
+	ServerAddress     string
+	ServerName        string
+	Weight            uint
+	Key               []byte
+	RetryDuration     string
+	MaxRetryDuration  string
+	CircuitThreshold  uint
+	PunchRelayAddress string
+	RendezvousAddress string
+	HealthCheck       string
+	HealthInterval    string
+	HealthTimeout     string
+	HealthThreshold   uint
+	Allow             []string
+	Public            bool
+	ProxyProtocol     string
+	UpstreamProxy     string
+	Debug             bool
 }
 
 func NewTCPServer(opts TCPServerOpts) (*Server, error) {
+	if opts.ServerName == "" {
+		return nil, errors.New("server name is required")
+	}
+	if opts.Public && len(opts.Allow) > 0 {
+		return nil, errors.New("a public server can't dial destinations for its clients")
+	}
+
+	proxyProtocol, err := proxyproto.ParseVersion(opts.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol != 0 && len(opts.Allow) > 0 {
+		return nil, errors.New("the PROXY protocol can't be sent to destinations dialed for clients")
+	}
+
 	cipher, err := crypto.NewAESCipher(crypto.AESCipherOpts{Key: opts.Key})
 	if err != nil {
 		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
 	}
 
+	// the relay counts the connections we make one after another as one server
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("error generating instance id: %s", err.Error())
+	}
+
+	weight := opts.Weight
+	if weight == 0 {
+		weight = 1
+	}
+
 	retryDuration := time.Second
 	if opts.RetryDuration != "" {
 		retryDuration, err = time.ParseDuration(opts.RetryDuration)
@@ -42,54 +110,420 @@ func NewTCPServer(opts TCPServerOpts) (*Server, error) {
 		}
 	}
 
+	// servers register with every relay, looked up once
+	relayList, err := relays.Parse(opts.RelayAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing relay address: %s", err.Error())
+	}
+	relayAddresses := relayList.All()
+
+	upstreamDialer, err := upstream.NewDialer(upstream.DialerOpts{Proxy: opts.UpstreamProxy, Debug: opts.Debug})
+	if err != nil {
+		return nil, fmt.Errorf("error creating upstream proxy dialer: %s", err.Error())
+	}
+
+	circuits, err := backoff.NewCircuits(relayAddresses, backoff.BackoffOpts{
+		Min:       opts.RetryDuration,
+		Max:       opts.MaxRetryDuration,
+		Threshold: opts.CircuitThreshold,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// with an allowlist, clients choose the destination instead of the
+	// server address
+	var dialer *proxy.Dialer
+	if len(opts.Allow) > 0 {
+		dialer, err = proxy.NewDialer(proxy.DialerOpts{Allow: opts.Allow, Debug: opts.Debug})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	monitor, err := health.NewMonitor(health.MonitorOpts{
+		Check:     opts.HealthCheck,
+		Address:   opts.ServerAddress,
+		Interval:  opts.HealthInterval,
+		Timeout:   opts.HealthTimeout,
+		Threshold: opts.HealthThreshold,
+		Debug:     opts.Debug,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating health check: %s", err.Error())
+	}
+
+	var puncher *udpserver.UDPServer
+	if opts.PunchRelayAddress != "" {
+		puncher, err = udpserver.NewUDPServer(udpserver.UDPServerOpts{
+			RelayAddress:     opts.PunchRelayAddress,
+			ServerAddress:    opts.ServerAddress,
+			ServerName:       opts.ServerName,
+			Key:              opts.Key,
+			RetryDuration:    opts.RetryDuration,
+			MaxRetryDuration: opts.MaxRetryDuration,
+			CircuitThreshold: opts.CircuitThreshold,
+			Stream:           true,
+			Proxy:            dialer,
+			HealthCheck:      opts.HealthCheck,
+			HealthInterval:   opts.HealthInterval,
+			HealthTimeout:    opts.HealthTimeout,
+			HealthThreshold:  opts.HealthThreshold,
+			Debug:            opts.Debug,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating punch server: %s", err.Error())
+		}
+	}
+
+	var rendezvous *punch.Server
+	if opts.RendezvousAddress != "" {
+		rendezvous = punch.NewServer(punch.ServerOpts{
+			Address:       opts.RendezvousAddress,
+			ServerName:    opts.ServerName,
+			ServerAddress: opts.ServerAddress,
+			Cipher:        cipher,
+			RetryDuration: retryDuration,
+			Proxy:         dialer,
+			Debug:         opts.Debug,
+		})
+	}
+
 	return &Server{
-		relayAddress:  opts.RelayAddress,
+		relays:        relayAddresses,
 		serverAddress: opts.ServerAddress,
+		serverName:    opts.ServerName,
+		id:            hex.EncodeToString(b),
+		weight:        weight,
 		cipher:        cipher,
-		retryDuration: retryDuration,
+		Circuits:      circuits,
+		puncher:       puncher,
+		rendezvous:    rendezvous,
+		health:        monitor,
+		proxy:         dialer,
+		public:        opts.Public,
+		proxyProtocol: proxyProtocol,
+		upstream:      upstreamDialer,
 		debug:         opts.Debug,
 	}, nil
 }
 
 func (s *Server) Run() error {
-	go func() {
-		for {
-			if err := s.fetchAndRelay(); err != nil {
-				fmt.Fprintf(os.Stderr, "Error fetching and relaying: %s\n", err.Error())
-				fmt.Fprintf(os.Stderr, "Retrying in %s\n", s.retryDuration)
-				time.Sleep(s.retryDuration)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := s.Serve(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return errors.New("interrupted")
+}
+
+// Serve fetches and relays messages until the context is done.
+func (s *Server) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if s.rendezvous != nil {
+		go func() {
+			if err := s.rendezvous.Serve(ctx); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Error accepting punched connections: %s\n", err.Error())
+			}
+		}()
+	}
+
+	if s.puncher != nil {
+		go func() {
+			if err := s.puncher.Serve(ctx); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Error accepting punched streams: %s\n", err.Error())
+			}
+		}()
+	}
+
+	go s.health.Run(ctx)
+
+	return relays.ServeEach(ctx, s.relays, s.serveRelay)
+}
+
+// serveRelay fetches and relays messages from one relay until the context is done.
+func (s *Server) serveRelay(ctx context.Context, relayAddress string) error {
+	retryBackoff := s.Circuits.For(relayAddress)
+	for {
+		// stop waiting on the relay while the backend can't take messages
+		if err := s.health.Wait(ctx); err != nil {
+			return err
+		}
+		fetch := s.fetchAndRelay
+		if s.public {
+			fetch = s.fetchAndStream
+		}
+		if err := fetch(ctx, relayAddress, retryBackoff); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			if !s.health.Healthy() {
+				continue
+			}
+			delay := retryBackoff.Failure()
+			fmt.Fprintf(os.Stderr, "Error fetching and relaying from %s: %s\n", relayAddress, err.Error())
+			fmt.Fprintf(os.Stderr, "Retrying in %s\n", delay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+func (s *Server) fetchAndRelay(ctx context.Context, relayAddress string, retryBackoff *backoff.Backoff) error {
+	// a streamed session carries on in the background with the connections,
+	// which are closed here otherwise
+	streaming := false
+
+	// a proxy connects once it knows the destination the message is for
+	var serverConn net.Conn
+	if s.proxy == nil {
+		var err error
+		serverConn, err = net.Dial("tcp", s.serverAddress)
+		if err != nil {
+			return fmt.Errorf("error connecting to server: %s", err.Error())
+		}
+		if s.debug {
+			log.Printf("Connected to server at %s\n", s.serverAddress)
+		}
+		defer func() {
+			if !streaming {
+				serverConn.Close()
+			}
+		}()
+	}
+
+	relayConn, err := s.upstream.Dial(relayAddress)
+	if err != nil {
+		return fmt.Errorf("error connecting to relay: %s", err.Error())
+	}
+	if s.debug {
+		log.Printf("Connected to relay at %s\n", relayAddress)
+	}
+	defer func() {
+		if !streaming {
+			relayConn.Close()
 		}
 	}()
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
-	return errors.New("interrupted")
+	if _, err := fmt.Fprintf(relayConn, "WAIT: %s\n", s.waitOptions()); err != nil {
+		return fmt.Errorf("error writing to relay: %s", err.Error())
+	}
+	retryBackoff.Success()
+
+	if s.debug {
+		log.Println("Ready to relay")
+	}
+
+	// unblock the round trip if the context is done or the backend goes
+	// down while waiting on the relay
+	down := s.health.Down()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			relayConn.Close()
+		case <-down:
+			fmt.Println("Leaving the relay while the backend is unhealthy")
+			relayConn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(relayConn)
+	stream, length, err := readMessageKind(reader)
+	if err != nil {
+		return err
+	}
+	if s.proxyProtocol != 0 {
+		if err := s.writeProxyHeader(serverConn, reader); err != nil {
+			return err
+		}
+	}
+
+	// the next message can be waited for while the session goes on
+	if stream {
+		streaming = true
+		go s.stream(serverConn, crypto.NewConn(pipe.Prefixed(relayConn, reader), s.cipher))
+		return nil
+	}
+
+	// clients of a proxy stream their sessions, since they choose the
+	// destination at the start of the stream
+	if s.proxy != nil {
+		fmt.Fprintf(os.Stderr, "Rejected a request, clients must stream to choose a destination\n")
+		return nil
+	}
+
+	// a request is as long as the relay says, however many reads it takes
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return fmt.Errorf("error reading from relay: %s", err.Error())
+	}
+	message := pipe.Prefixed(relayConn, bytes.NewReader(data))
+	return s.cipher.DecryptRoundTrip(serverConn, message)
 }
 
-func (s *Server) fetchAndRelay() error {
-	serverConn, err := net.Dial("tcp", s.serverAddress)
+// maxMessageSize is the largest request the relay may send.
+const maxMessageSize = 64 * 1024
+
+// readMessageKind reads whether the relay is sending a streamed session or
+// a request and how long it is, which it says ahead of every message.
+func readMessageKind(reader *bufio.Reader) (bool, int, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return false, 0, fmt.Errorf("error reading from relay: %s", err.Error())
+	}
+	action, value, err := protocol.ParseLine(line)
+	if err != nil {
+		return false, 0, err
+	}
+	if action != "MESSAGE" {
+		return false, 0, fmt.Errorf("invalid message from relay: %s", strings.TrimSpace(line))
+	}
+	if value == "stream" {
+		return true, 0, nil
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 2 || fields[0] != "request" {
+		return false, 0, fmt.Errorf("invalid message from relay: %s", strings.TrimSpace(line))
+	}
+	length, err := strconv.Atoi(fields[1])
+	if err != nil || length < 0 || length > maxMessageSize {
+		return false, 0, fmt.Errorf("invalid message length from relay: %s", fields[1])
+	}
+	return false, length, nil
+}
+
+// stream joins a session streamed through the relay to the server, or to
+// the destination the session asks for.
+func (s *Server) stream(serverConn net.Conn, session io.ReadWriteCloser) {
+	if s.proxy != nil {
+		targetConn, client, err := s.proxy.Accept(session)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting client: %s\n", err.Error())
+			session.Close()
+			return
+		}
+		if s.debug {
+			log.Printf("Streaming a client to %s\n", targetConn.RemoteAddr().String())
+		}
+		pipe.Join(targetConn, client)
+		return
+	}
+	if s.debug {
+		log.Printf("Streaming a client to %s\n", s.serverAddress)
+	}
+	pipe.Join(serverConn, session)
+}
+
+// waitOptions is what follows WAIT when connecting to the relay: the name,
+// instance and weight, and the options of the server.
+func (s *Server) waitOptions() string {
+	options := fmt.Sprintf("%s %s %d", s.serverName, s.id, s.weight)
+	if s.public {
+		options += " public"
+	} else {
+		options += " stream"
+	}
+	if s.proxyProtocol != 0 {
+		options += " client"
+	}
+	return options
+}
+
+// writeProxyHeader reads the client's addresses, which the relay sends
+// ahead of the client's data, and passes them on to the backend in a PROXY
+// protocol header.
+func (s *Server) writeProxyHeader(serverConn net.Conn, reader *bufio.Reader) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading from relay: %s", err.Error())
+	}
+	action, value, err := protocol.ParseLine(line)
 	if err != nil {
-		return fmt.Errorf("error connecting to server: %s", err.Error())
+		return err
+	}
+	addresses := strings.Fields(value)
+	if action != "CLIENT" || len(addresses) != 2 {
+		return fmt.Errorf("invalid client from relay: %s", strings.TrimSpace(line))
 	}
 	if s.debug {
-		log.Printf("Connected to server at %s\n", s.serverAddress)
+		log.Printf("Client connected from %s to %s\n", addresses[0], addresses[1])
 	}
-	defer serverConn.Close()
+	if err := proxyproto.WriteHeader(serverConn, s.proxyProtocol, addresses[0], addresses[1]); err != nil {
+		return fmt.Errorf("error writing to server: %s", err.Error())
+	}
+	return nil
+}
 
-	relayConn, err := net.Dial("tcp", s.relayAddress)
+// fetchAndStream waits on the relay for a client of its virtual hosts, and
+// streams it to the server as it is. The stream carries on in the
+// background, so that the next client can be waited for straight away.
+func (s *Server) fetchAndStream(ctx context.Context, relayAddress string, retryBackoff *backoff.Backoff) error {
+	relayConn, err := s.upstream.Dial(relayAddress)
 	if err != nil {
 		return fmt.Errorf("error connecting to relay: %s", err.Error())
 	}
 	if s.debug {
-		log.Printf("Connected to relay at %s\n", s.relayAddress)
+		log.Printf("Connected to relay at %s\n", relayAddress)
 	}
-	defer relayConn.Close()
+
+	if _, err := fmt.Fprintf(relayConn, "WAIT: %s\n", s.waitOptions()); err != nil {
+		relayConn.Close()
+		return fmt.Errorf("error writing to relay: %s", err.Error())
+	}
+	retryBackoff.Success()
 
 	if s.debug {
-		log.Println("Ready to relay")
+		log.Println("Ready to stream")
 	}
 
-	return s.cipher.DecryptRoundTrip(serverConn, relayConn)
+	// unblock the wait if the context is done or the backend goes down
+	down := s.health.Down()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			relayConn.Close()
+		case <-down:
+			fmt.Println("Leaving the relay while the backend is unhealthy")
+			relayConn.Close()
+		case <-done:
+		}
+	}()
+
+	// the client is picked up when the relay starts sending its traffic
+	reader := bufio.NewReader(relayConn)
+	_, err = reader.Peek(1)
+	close(done)
+	if err != nil {
+		relayConn.Close()
+		return fmt.Errorf("error reading from relay: %s", err.Error())
+	}
+
+	serverConn, err := net.Dial("tcp", s.serverAddress)
+	if err != nil {
+		relayConn.Close()
+		fmt.Fprintf(os.Stderr, "Error connecting to server: %s\n", err.Error())
+		return nil
+	}
+	if s.proxyProtocol != 0 {
+		if err := s.writeProxyHeader(serverConn, reader); err != nil {
+			relayConn.Close()
+			serverConn.Close()
+			return err
+		}
+	}
+	if s.debug {
+		log.Printf("Streaming a client to %s\n", s.serverAddress)
+	}
+	go pipe.Join(serverConn, pipe.Prefixed(relayConn, reader))
+	return nil
 }
@@ -1,33 +1,59 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/relays"
+	"github.com/cbodonnell/net/pkg/udp/fragment"
+	"github.com/cbodonnell/net/pkg/udp/stream"
 )
 
+// responseTimeout is how long to wait for the server to respond to a datagram,
+// and for the fragments of a response to arrive.
+const responseTimeout = time.Second * 5
+
 type UDPClient struct {
-	port         uint
-	relayAddress string
-	serverName   string
-	cipher       crypto.Cipher
-	bufferSize   uint
-	debug        bool
+	port            uint
+	relays          *relays.List
+	serverName      string
+	cipher          crypto.Cipher
+	bufferSize      uint
+	maxDatagramSize uint
+	fragmenter      *fragment.Fragmenter
+	reassembler     *fragment.Reassembler
+	punchTimeout    time.Duration
+	stream          bool
+	log             io.Writer
+	debug           bool
+	mu              sync.Mutex
+	transport       *stream.Transport
+	transportConn   *net.UDPConn
+	target          *net.UDPAddr
 }
 
 type UDPClientOpts struct {
-	Port         uint
-	RelayAddress string
-	ServerName   string
-	Key          []byte
-	BufferSize   uint
-	Debug        bool
+	Port            uint
+	RelayAddress    string
+	ServerName      string
+	Key             []byte
+	BufferSize      uint
+	Fragment        bool
+	MaxDatagramSize uint
+	PunchTimeout    string
+	Stream          bool
+	Log             io.Writer
+	Debug           bool
 }
 
 func NewUDPClient(opts UDPClientOpts) (*UDPClient, error) {
@@ -36,20 +62,79 @@ func NewUDPClient(opts UDPClientOpts) (*UDPClient, error) {
 		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
 	}
 
+	punchTimeout := time.Second * 5
+	if opts.PunchTimeout != "" {
+		punchTimeout, err = time.ParseDuration(opts.PunchTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing punch timeout: %s", err.Error())
+		}
+	}
+
+	bufferSize := opts.BufferSize
+	if bufferSize == 0 {
+		bufferSize = 1024
+	}
+
+	maxDatagramSize := opts.MaxDatagramSize
+	if maxDatagramSize == 0 {
+		maxDatagramSize = 1400
+	}
+
+	if opts.Stream && opts.Fragment {
+		return nil, errors.New("stream mode segments data itself and can't be combined with fragmentation")
+	}
+
+	var fragmenter *fragment.Fragmenter
+	var reassembler *fragment.Reassembler
+	if opts.Fragment {
+		fragmenter, err = fragment.NewFragmenter(int(maxDatagramSize))
+		if err != nil {
+			return nil, fmt.Errorf("error creating fragmenter: %s", err.Error())
+		}
+		reassembler = fragment.NewReassembler(responseTimeout, 64)
+	}
+
+	logWriter := opts.Log
+	if logWriter == nil {
+		logWriter = os.Stdout
+	}
+
+	relayList, err := relays.Parse(opts.RelayAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing relay address: %s", err.Error())
+	}
+	relayList.SetOutput(logWriter)
+
 	return &UDPClient{
-		port:         opts.Port,
-		relayAddress: opts.RelayAddress,
-		serverName:   opts.ServerName,
-		cipher:       cipher,
-		bufferSize:   opts.BufferSize,
-		debug:        opts.Debug,
+		port:            opts.Port,
+		relays:          relayList,
+		serverName:      opts.ServerName,
+		cipher:          cipher,
+		bufferSize:      bufferSize,
+		maxDatagramSize: maxDatagramSize,
+		fragmenter:      fragmenter,
+		reassembler:     reassembler,
+		punchTimeout:    punchTimeout,
+		stream:          opts.Stream,
+		log:             logWriter,
+		debug:           opts.Debug,
 	}, nil
 }
 
 func (c *UDPClient) Run() error {
-	relayAddr, err := net.ResolveUDPAddr("udp4", c.relayAddress)
-	if err != nil {
-		return fmt.Errorf("failed to resolve relay address: %s", err.Error())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := c.Serve(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return errors.New("interrupted")
+}
+
+// Serve punches to the server and relays client requests until the context is done.
+func (c *UDPClient) Serve(ctx context.Context) error {
+	if c.stream {
+		return c.serveStream(ctx)
 	}
 
 	portString := fmt.Sprintf(":%d", c.port)
@@ -66,14 +151,15 @@ func (c *UDPClient) Run() error {
 	defer clientListener.Close()
 
 	if c.debug {
-		fmt.Printf("Listening for client requests on %s\n", listenAddr.String())
+		fmt.Fprintf(c.log, "Listening for client requests on %s\n", listenAddr.String())
 	}
 
-	if c.debug {
-		fmt.Printf("Punching to client %s on signal server %s\n", c.serverName, relayAddr.String())
+	relayConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to listen for relay: %s", err.Error())
 	}
-
-	target, err := c.punch(relayAddr)
+	target, err := c.punchRelays(relayConn)
+	relayConn.Close()
 	if err != nil {
 		return fmt.Errorf("failed to punch: %s", err.Error())
 	}
@@ -81,35 +167,54 @@ func (c *UDPClient) Run() error {
 	// TODO: The client should be "aware" if it is punched or relayed
 
 	if c.debug {
-		fmt.Printf("Punched to target %s\n", target.String())
+		fmt.Fprintf(c.log, "Punched to target %s\n", target.String())
 	}
 
 	go c.handleClientConnections(clientListener, target)
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
-	return errors.New("interrupted")
+	<-ctx.Done()
+	return ctx.Err()
 }
 
-func (c *UDPClient) punch(relayAddr *net.UDPAddr) (*net.UDPAddr, error) {
-	// dial to relay address
-	relayConn, err := net.DialUDP("udp", nil, relayAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial relay: %s", err.Error())
-	}
+// punchRelays punches through the relays in order until one of them knows the server.
+func (c *UDPClient) punchRelays(conn *net.UDPConn) (*net.UDPAddr, error) {
+	var target *net.UDPAddr
+	err := c.relays.Try(func(address string) error {
+		relayAddr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			return fmt.Errorf("failed to resolve relay address: %s", err.Error())
+		}
+		if c.debug {
+			fmt.Fprintf(c.log, "Punching to server %s on relay %s\n", c.serverName, relayAddr.String())
+		}
+		target, err = c.punch(conn, relayAddr)
+		return err
+	})
+	return target, err
+}
 
-	_, err = relayConn.Write([]byte(fmt.Sprintf("PUNCH: %s", c.serverName)))
+// punch asks the relay for the address of the server from relayConn, so that
+// the mapping a NAT creates for it can be reused to reach the server.
+func (c *UDPClient) punch(relayConn *net.UDPConn, relayAddr *net.UDPAddr) (*net.UDPAddr, error) {
+	_, err := relayConn.WriteToUDP([]byte(fmt.Sprintf("PUNCH: %s", c.serverName)), relayAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to relay: %s", err.Error())
 	}
 
-	relayConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	relayConn.SetReadDeadline(time.Now().Add(c.punchTimeout))
+	defer relayConn.SetReadDeadline(time.Time{})
 
 	buffer := make([]byte, 1024)
-	n, _, err := relayConn.ReadFromUDP(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from relay: %s", err.Error())
+	var n int
+	for {
+		var from *net.UDPAddr
+		n, from, err = relayConn.ReadFromUDP(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from relay: %s", err.Error())
+		}
+		if from.String() == relayAddr.String() {
+			break
+		}
 	}
 	response := buffer[0:n]
 
@@ -137,28 +242,36 @@ func (c *UDPClient) punch(relayAddr *net.UDPAddr) (*net.UDPAddr, error) {
 func (c *UDPClient) handleClientConnections(clientListener *net.UDPConn, target *net.UDPAddr) {
 	for {
 		if err := c.handleRequest(clientListener, target); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Fprintf(os.Stderr, "error handling request: %s\n", err.Error())
 		}
 	}
 }
 
 func (c *UDPClient) handleRequest(clientListener *net.UDPConn, target *net.UDPAddr) error {
-	buffer := make([]byte, c.bufferSize)
+	// read one byte more than allowed to detect datagrams that don't fit
+	buffer := make([]byte, c.bufferSize+1)
 	n, clientAddr, err := clientListener.ReadFromUDP(buffer)
 	if err != nil {
-		return fmt.Errorf("failed to read from client: %s", err.Error())
+		return fmt.Errorf("failed to read from client: %w", err)
+	}
+	if n > int(c.bufferSize) {
+		return fmt.Errorf("dropped datagram from %s larger than buffer size of %d bytes", clientAddr.String(), c.bufferSize)
 	}
 
 	message := buffer[:n]
 
 	if c.debug {
-		fmt.Printf("Received %d bytes from %s:\n%s\n", n, clientAddr.String(), string(message))
+		fmt.Fprintf(c.log, "Received %d bytes from %s:\n%s\n", n, clientAddr.String(), string(message))
 	}
 
 	targetConn, err := net.DialUDP("udp", nil, target)
 	if err != nil {
 		return fmt.Errorf("failed to dial target: %s", err.Error())
 	}
+	defer targetConn.Close()
 
 	encryptedMessage, err := c.cipher.Encrypt(message)
 	if err != nil {
@@ -166,22 +279,18 @@ func (c *UDPClient) handleRequest(clientListener *net.UDPConn, target *net.UDPAd
 	}
 
 	if c.debug {
-		fmt.Printf("Sending %d bytes to %s:\n%s\n", len(encryptedMessage), target.String(), string(encryptedMessage))
+		fmt.Fprintf(c.log, "Sending %d bytes to %s:\n%s\n", len(encryptedMessage), target.String(), string(encryptedMessage))
 	}
 
-	_, err = targetConn.Write(encryptedMessage)
-	if err != nil {
+	if err := c.writeToTarget(targetConn, encryptedMessage); err != nil {
 		return fmt.Errorf("failed to write to target: %s", err.Error())
 	}
 
-	buffer = make([]byte, c.bufferSize)
-	n, _, err = targetConn.ReadFromUDP(buffer)
+	response, err := c.readFromTarget(targetConn)
 	if err != nil {
 		return fmt.Errorf("failed to read from target: %s", err.Error())
 	}
 
-	response := buffer[:n]
-
 	decryptedResponse, err := c.cipher.Decrypt(response)
 	if err != nil {
 		return fmt.Errorf("failed to decrypt response: %s", err.Error())
@@ -194,3 +303,174 @@ func (c *UDPClient) handleRequest(clientListener *net.UDPConn, target *net.UDPAd
 
 	return nil
 }
+
+func (c *UDPClient) writeToTarget(targetConn *net.UDPConn, message []byte) error {
+	if c.fragmenter == nil {
+		_, err := targetConn.Write(message)
+		return err
+	}
+
+	datagrams, err := c.fragmenter.Split(message)
+	if err != nil {
+		return err
+	}
+	for _, datagram := range datagrams {
+		if _, err := targetConn.Write(datagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *UDPClient) readFromTarget(targetConn *net.UDPConn) ([]byte, error) {
+	targetConn.SetReadDeadline(time.Now().Add(responseTimeout))
+
+	// the largest datagram the server may send, plus a byte to detect truncation
+	size := int(c.bufferSize) + c.cipher.Overhead()
+	if c.fragmenter != nil {
+		size = int(c.maxDatagramSize)
+	}
+	buffer := make([]byte, size+1)
+
+	for {
+		n, err := targetConn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		if n > size {
+			return nil, fmt.Errorf("datagram larger than %d bytes was truncated", size)
+		}
+		if c.reassembler == nil {
+			return buffer[:n], nil
+		}
+
+		message, err := c.reassembler.Add(targetConn.RemoteAddr().String(), buffer[:n])
+		if err != nil {
+			return nil, err
+		}
+		if message != nil {
+			return message, nil
+		}
+	}
+}
+
+// serveStream accepts TCP connections and carries each one to the server
+// as a reliable stream over the punched path.
+func (c *UDPClient) serveStream(ctx context.Context) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", c.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for client: %s", err.Error())
+	}
+	defer listener.Close()
+	defer c.resetTransport(nil)
+
+	if c.debug {
+		fmt.Fprintf(c.log, "Listening for client connections on %s\n", listener.Addr().String())
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		clientConn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to accept client connection: %s", err.Error())
+		}
+		go c.handleStream(clientConn)
+	}
+}
+
+func (c *UDPClient) handleStream(clientConn net.Conn) {
+	serverConn, err := c.DialStream()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening stream: %s\n", err.Error())
+		clientConn.Close()
+		return
+	}
+
+	if c.debug {
+		fmt.Fprintf(c.log, "Streaming %s to %s\n", clientConn.RemoteAddr().String(), serverConn.RemoteAddr().String())
+	}
+
+	pipe.Join(clientConn, serverConn)
+}
+
+// DialStream opens a reliable stream to the server over the punched path,
+// punching first if there is no path yet. The server must run in stream mode.
+func (c *UDPClient) DialStream() (net.Conn, error) {
+	transport, target, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := transport.Dial(target)
+	if err != nil {
+		// the path may have gone away, punch again on the next attempt
+		c.resetTransport(transport)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect punches to the server and starts a stream transport on the punched socket.
+func (c *UDPClient) connect() (*stream.Transport, *net.UDPAddr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport != nil {
+		return c.transport, c.target, nil
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen: %s", err.Error())
+	}
+
+	target, err := c.punchRelays(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to punch: %s", err.Error())
+	}
+
+	if c.debug {
+		fmt.Fprintf(c.log, "Punched to target %s\n", target.String())
+	}
+
+	transport, err := stream.NewTransport(stream.TransportOpts{
+		Conn:            conn,
+		Cipher:          c.cipher,
+		MaxDatagramSize: c.maxDatagramSize,
+		Debug:           c.debug,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	go transport.Serve()
+
+	c.transport = transport
+	c.transportConn = conn
+	c.target = target
+	return transport, target, nil
+}
+
+// resetTransport closes the current transport if it is still the given one,
+// or whichever is current if nil.
+func (c *UDPClient) resetTransport(transport *stream.Transport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport == nil || (transport != nil && c.transport != transport) {
+		return
+	}
+	c.transport.Close()
+	c.transportConn.Close()
+	c.transport = nil
+	c.transportConn = nil
+	c.target = nil
+}
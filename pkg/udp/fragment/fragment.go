@@ -0,0 +1,163 @@
+package fragment
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every fragment starts with a header of
+// magic (1 byte) | message id (4 bytes) | index (1 byte) | count (1 byte)
+const (
+	HeaderSize   = 7
+	MaxFragments = 255
+	magic        = 0xf7
+)
+
+var ErrTooLarge = errors.New("message too large")
+
+// Fragmenter splits messages into datagrams no larger than a maximum size.
+type Fragmenter struct {
+	maxSize int
+	nextID  uint32
+}
+
+func NewFragmenter(maxSize int) (*Fragmenter, error) {
+	if maxSize <= HeaderSize {
+		return nil, fmt.Errorf("maximum datagram size must be larger than %d", HeaderSize)
+	}
+
+	// start at a random id so restarts don't collide with fragments still in flight
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &Fragmenter{
+		maxSize: maxSize,
+		nextID:  binary.BigEndian.Uint32(b),
+	}, nil
+}
+
+// Split returns the datagrams to send for a message.
+func (f *Fragmenter) Split(message []byte) ([][]byte, error) {
+	chunkSize := f.maxSize - HeaderSize
+	count := (len(message) + chunkSize - 1) / chunkSize
+	if count == 0 {
+		count = 1
+	}
+	if count > MaxFragments {
+		return nil, fmt.Errorf("%w: %d bytes needs more than %d fragments", ErrTooLarge, len(message), MaxFragments)
+	}
+
+	id := atomic.AddUint32(&f.nextID, 1)
+	datagrams := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(message) {
+			end = len(message)
+		}
+		datagram := make([]byte, HeaderSize+end-start)
+		datagram[0] = magic
+		binary.BigEndian.PutUint32(datagram[1:5], id)
+		datagram[5] = byte(i)
+		datagram[6] = byte(count)
+		copy(datagram[HeaderSize:], message[start:end])
+		datagrams = append(datagrams, datagram)
+	}
+	return datagrams, nil
+}
+
+type partial struct {
+	fragments [][]byte
+	received  int
+	size      int
+	started   time.Time
+}
+
+// Reassembler puts fragmented messages back together. Messages that are
+// not complete within the timeout are dropped.
+type Reassembler struct {
+	timeout    time.Duration
+	maxPending int
+	mu         sync.Mutex
+	pending    map[string]*partial
+}
+
+func NewReassembler(timeout time.Duration, maxPending int) *Reassembler {
+	return &Reassembler{
+		timeout:    timeout,
+		maxPending: maxPending,
+		pending:    make(map[string]*partial),
+	}
+}
+
+// Add adds a datagram received from source. It returns the message once all
+// of its fragments have arrived, or nil if more fragments are needed.
+func (r *Reassembler) Add(source string, datagram []byte) ([]byte, error) {
+	if len(datagram) < HeaderSize || datagram[0] != magic {
+		return nil, errors.New("invalid fragment header")
+	}
+	id := binary.BigEndian.Uint32(datagram[1:5])
+	index, count := int(datagram[5]), int(datagram[6])
+	if count == 0 || index >= count {
+		return nil, fmt.Errorf("invalid fragment %d of %d", index, count)
+	}
+
+	// fast path for messages that fit in a single datagram
+	if count == 1 {
+		return datagram[HeaderSize:], nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+
+	key := fmt.Sprintf("%s/%d", source, id)
+	p, ok := r.pending[key]
+	if !ok {
+		if len(r.pending) >= r.maxPending {
+			return nil, errors.New("too many messages pending reassembly")
+		}
+		p = &partial{fragments: make([][]byte, count), started: time.Now()}
+		r.pending[key] = p
+	}
+	if len(p.fragments) != count {
+		delete(r.pending, key)
+		return nil, fmt.Errorf("fragment count changed from %d to %d", len(p.fragments), count)
+	}
+	if p.fragments[index] != nil {
+		// duplicate
+		return nil, nil
+	}
+
+	p.fragments[index] = append([]byte(nil), datagram[HeaderSize:]...)
+	p.received++
+	p.size += len(datagram) - HeaderSize
+	if p.received < count {
+		return nil, nil
+	}
+
+	delete(r.pending, key)
+	message := make([]byte, 0, p.size)
+	for _, fragment := range p.fragments {
+		message = append(message, fragment...)
+	}
+	return message, nil
+}
+
+// expire drops messages that have been pending for longer than the timeout.
+// The caller must hold r.mu.
+func (r *Reassembler) expire() {
+	for key, p := range r.pending {
+		if time.Since(p.started) > r.timeout {
+			delete(r.pending, key)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package fragment
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSplitAndReassemble(t *testing.T) {
+	const maxSize = 64
+	chunkSize := maxSize - HeaderSize
+
+	tests := []struct {
+		name  string
+		size  int
+		count int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"one full fragment", chunkSize, 1},
+		{"just over one fragment", chunkSize + 1, 2},
+		{"exact multiple", chunkSize * 3, 3},
+		{"most fragments", chunkSize * MaxFragments, MaxFragments},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFragmenter(maxSize)
+			if err != nil {
+				t.Fatalf("NewFragmenter: %v", err)
+			}
+			message := make([]byte, tt.size)
+			rand.Read(message)
+
+			datagrams, err := f.Split(message)
+			if err != nil {
+				t.Fatalf("Split: %v", err)
+			}
+			if len(datagrams) != tt.count {
+				t.Fatalf("got %d fragments, want %d", len(datagrams), tt.count)
+			}
+			for _, datagram := range datagrams {
+				if len(datagram) > maxSize {
+					t.Fatalf("fragment of %d bytes is larger than %d", len(datagram), maxSize)
+				}
+			}
+
+			// fragments may arrive in any order and more than once
+			r := NewReassembler(time.Second, 16)
+			order := rand.Perm(len(datagrams))
+			var got []byte
+			for i, index := range order {
+				got, err = r.Add("peer", datagrams[index])
+				if err != nil {
+					t.Fatalf("Add: %v", err)
+				}
+				if i < len(order)-1 {
+					if got != nil {
+						t.Fatalf("got a message after %d of %d fragments", i+1, len(order))
+					}
+					if dup, err := r.Add("peer", datagrams[index]); dup != nil || err != nil {
+						t.Fatalf("duplicate fragment returned %v, %v", dup, err)
+					}
+				}
+			}
+			if !bytes.Equal(got, message) {
+				t.Fatalf("reassembled %d bytes, want %d", len(got), len(message))
+			}
+			if len(r.pending) != 0 {
+				t.Fatalf("%d messages still pending", len(r.pending))
+			}
+		})
+	}
+}
+
+func TestSplitTooLarge(t *testing.T) {
+	f, err := NewFragmenter(HeaderSize + 1)
+	if err != nil {
+		t.Fatalf("NewFragmenter: %v", err)
+	}
+	if _, err := f.Split(make([]byte, MaxFragments+1)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestNewFragmenterTooSmall(t *testing.T) {
+	if _, err := NewFragmenter(HeaderSize); err == nil {
+		t.Fatal("expected an error for a size that leaves no room for data")
+	}
+}
+
+func TestReassemblerInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram []byte
+	}{
+		{"too short", []byte{magic, 0, 0, 0}},
+		{"bad magic", []byte{0, 0, 0, 0, 1, 0, 1}},
+		{"no fragments", []byte{magic, 0, 0, 0, 1, 0, 0}},
+		{"index out of range", []byte{magic, 0, 0, 0, 1, 2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler(time.Second, 16)
+			if _, err := r.Add("peer", tt.datagram); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestReassemblerCountChanged(t *testing.T) {
+	r := NewReassembler(time.Second, 16)
+	if _, err := r.Add("peer", []byte{magic, 0, 0, 0, 1, 0, 2, 'a'}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := r.Add("peer", []byte{magic, 0, 0, 0, 1, 1, 3, 'b'}); err == nil {
+		t.Fatal("expected an error for a changed fragment count")
+	}
+	if len(r.pending) != 0 {
+		t.Fatalf("%d messages still pending", len(r.pending))
+	}
+}
+
+func TestReassemblerSources(t *testing.T) {
+	// the same message id from two sources is two messages
+	r := NewReassembler(time.Second, 16)
+	first := []byte{magic, 0, 0, 0, 1, 0, 2, 'a'}
+	second := []byte{magic, 0, 0, 0, 1, 1, 2, 'b'}
+	if got, _ := r.Add("one", first); got != nil {
+		t.Fatalf("got %q after one fragment", got)
+	}
+	if got, _ := r.Add("two", second); got != nil {
+		t.Fatalf("got %q from a fragment of another source", got)
+	}
+	got, err := r.Add("one", second)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if string(got) != "ab" {
+		t.Fatalf("got %q, want %q", got, "ab")
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := NewReassembler(time.Millisecond*20, 16)
+	if _, err := r.Add("peer", []byte{magic, 0, 0, 0, 1, 0, 2, 'a'}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	time.Sleep(time.Millisecond * 40)
+
+	// the first fragment expired, so the second one starts over
+	got, err := r.Add("peer", []byte{magic, 0, 0, 0, 1, 1, 2, 'b'})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("got %q from an expired message", got)
+	}
+	if len(r.pending) != 1 {
+		t.Fatalf("%d messages pending, want 1", len(r.pending))
+	}
+}
+
+func TestReassemblerMaxPending(t *testing.T) {
+	r := NewReassembler(time.Second, 2)
+	for id := byte(1); id <= 2; id++ {
+		if _, err := r.Add("peer", []byte{magic, 0, 0, 0, id, 0, 2, 'a'}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if _, err := r.Add("peer", []byte{magic, 0, 0, 0, 3, 0, 2, 'a'}); err == nil {
+		t.Fatal("expected an error with too many messages pending")
+	}
+
+	// single fragment messages don't need to be pending
+	got, err := r.Add("peer", []byte{magic, 0, 0, 0, 4, 0, 1, 'a'})
+	if err != nil || string(got) != "a" {
+		t.Fatalf("got %q, %v, want %q", got, err, "a")
+	}
+
+	// finishing a message makes room for another
+	if _, err := r.Add("peer", []byte{magic, 0, 0, 0, 1, 1, 2, 'b'}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := r.Add("peer", []byte{magic, 0, 0, 0, 3, 0, 2, 'a'}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+}
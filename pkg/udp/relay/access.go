@@ -0,0 +1,220 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/admin"
+)
+
+const (
+	// bansBucket holds the banned hosts, keyed by IP address.
+	bansBucket = "bans"
+	// credentialsBucket holds the hashed tokens servers need to register
+	// under a name, keyed by name.
+	credentialsBucket = "credentials"
+)
+
+type savedBan struct {
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+type savedCredential struct {
+	Name  string    `json:"name"`
+	Hash  string    `json:"hash"`
+	Since time.Time `json:"since"`
+}
+
+// credential is the hash of the token that servers must present to
+// register under a name. Only the hash is kept, in memory and on disk.
+type credential struct {
+	hash  [sha256.Size]byte
+	since time.Time
+}
+
+// restoreAccess loads the bans and credentials saved before the relay
+// restarted. The caller must hold r.mu.
+func (r *UDPRelay) restoreAccess() error {
+	err := r.store.Load(bansBucket, func(key string, value []byte) error {
+		var saved savedBan
+		if err := json.Unmarshal(value, &saved); err != nil {
+			return fmt.Errorf("invalid ban %s: %s", key, err.Error())
+		}
+		r.bans[saved.Host] = saved.Since
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error restoring bans: %s", err.Error())
+	}
+
+	err = r.store.Load(credentialsBucket, func(key string, value []byte) error {
+		var saved savedCredential
+		if err := json.Unmarshal(value, &saved); err != nil {
+			return fmt.Errorf("invalid credential %s: %s", key, err.Error())
+		}
+		b, err := hex.DecodeString(saved.Hash)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid credential hash for %s", saved.Name)
+		}
+		c := credential{since: saved.Since}
+		copy(c.hash[:], b)
+		r.credentials[saved.Name] = c
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error restoring credentials: %s", err.Error())
+	}
+	return nil
+}
+
+// banned reports whether requests from an IP address are rejected. The
+// caller must hold r.mu.
+func (r *UDPRelay) banned(ip net.IP) bool {
+	_, ok := r.bans[ip.String()]
+	return ok
+}
+
+// authorized reports whether a token allows registering under a name. Names
+// without a credential need no token. The caller must hold r.mu.
+func (r *UDPRelay) authorized(target, token string) bool {
+	c, ok := r.credentials[target]
+	if !ok {
+		return true
+	}
+	hash := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(hash[:], c.hash[:]) == 1
+}
+
+func (r *UDPRelay) Bans() []admin.BanInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bans := make([]admin.BanInfo, 0, len(r.bans))
+	for host, since := range r.bans {
+		bans = append(bans, admin.BanInfo{Host: host, Since: since})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Host < bans[j].Host })
+	return bans
+}
+
+// Ban rejects every request from a host from now on, and drops the servers
+// it registered and the sessions of its clients.
+func (r *UDPRelay) Ban(host string) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid host: %s", host)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	host = ip.String()
+	since := time.Now()
+	r.bans[host] = since
+	if r.store != nil {
+		if err := r.store.Put(bansBucket, host, savedBan{Host: host, Since: since}); err != nil {
+			fmt.Printf("[ERROR] Failed to save ban of %s: %s\n", host, err.Error())
+		}
+	}
+
+	type entry struct{ target, address string }
+	var dropped []entry
+	for target, svc := range r.servers {
+		for address := range svc.registrations {
+			if addr, err := net.ResolveUDPAddr("udp", address); err == nil && addr.IP.Equal(ip) {
+				dropped = append(dropped, entry{target, address})
+			}
+		}
+	}
+	for _, e := range dropped {
+		r.unregister(e.target, e.address)
+	}
+	for client, session := range r.clients {
+		if addr, err := net.ResolveUDPAddr("udp", client); err == nil && addr.IP.Equal(ip) {
+			r.release(session)
+			delete(r.clients, client)
+		}
+	}
+	return nil
+}
+
+func (r *UDPRelay) Unban(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.bans[host]; !ok {
+		return fmt.Errorf("%s: %w", host, admin.ErrNotFound)
+	}
+	delete(r.bans, host)
+	if r.store != nil {
+		if err := r.store.Delete(bansBucket, host); err != nil {
+			fmt.Printf("[ERROR] Failed to forget ban of %s: %s\n", host, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *UDPRelay) Credentials() []admin.CredentialInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	credentials := make([]admin.CredentialInfo, 0, len(r.credentials))
+	for name, c := range r.credentials {
+		credentials = append(credentials, admin.CredentialInfo{Name: name, Since: c.since})
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].Name < credentials[j].Name })
+	return credentials
+}
+
+// SetCredential requires servers registering under a name from now on to
+// present a token. Servers that are already registered stay registered.
+func (r *UDPRelay) SetCredential(name, token string) error {
+	if token == "" {
+		return errors.New("token is required")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := credential{hash: sha256.Sum256([]byte(token)), since: time.Now()}
+	r.credentials[name] = c
+	if r.store != nil {
+		err := r.store.Put(credentialsBucket, name, savedCredential{
+			Name:  name,
+			Hash:  hex.EncodeToString(c.hash[:]),
+			Since: c.since,
+		})
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to save credential of %s: %s\n", name, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *UDPRelay) RemoveCredential(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.credentials[name]; !ok {
+		return fmt.Errorf("%s: %w", name, admin.ErrNotFound)
+	}
+	delete(r.credentials, name)
+	if r.store != nil {
+		if err := r.store.Delete(credentialsBucket, name); err != nil {
+			fmt.Printf("[ERROR] Failed to forget credential of %s: %s\n", name, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/cbodonnell/net/pkg/cluster"
+)
+
+// punchRequest is a punch forwarded by another relay in the cluster for a
+// client of its own.
+type punchRequest struct {
+	Name   string `json:"name"`
+	Client string `json:"client"`
+}
+
+type punchResponse struct {
+	Server string `json:"server"`
+}
+
+// names returns the names servers are registered under, for the cluster.
+func (r *UDPRelay) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.servers))
+	for name := range r.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forwardPunch asks the relay in the cluster that holds a name to punch for
+// the client, and answers the client with the server it picked.
+func (r *UDPRelay) forwardPunch(target string, listener *net.UDPConn, remoteAddr *net.UDPAddr) {
+	entry, err := r.node.Locate(target)
+	if err == nil {
+		var response punchResponse
+		err = r.node.Call(entry.Relay, "/punch", punchRequest{Name: target, Client: remoteAddr.String()}, &response)
+		if err == nil {
+			if r.debug {
+				fmt.Printf("[PUNCH] from %s to %s at %s through %s\n", remoteAddr.String(), target, response.Server, entry.Relay)
+			}
+			if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", response.Server)), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write PUNCH response %s\n", err.Error())
+			}
+			return
+		}
+	}
+	if !errors.Is(err, cluster.ErrNotFound) {
+		fmt.Printf("[ERROR] failed to forward punch to %s: %s\n", target, err.Error())
+	}
+	if _, err := listener.WriteToUDP([]byte("FAIL: NOT REGISTERED"), remoteAddr); err != nil {
+		fmt.Printf("[ERROR] Failed to write NOT REGISTERED response %s\n", err.Error())
+	}
+}
+
+// handleForwardedPunch punches for a client of another relay in the cluster.
+// Forwarded punches are never forwarded again, so relays can't bounce them.
+func (r *UDPRelay) handleForwardedPunch(w http.ResponseWriter, req *http.Request) {
+	var request punchRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client, err := net.ResolveUDPAddr("udp", request.Client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	if r.draining {
+		r.mu.Unlock()
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if r.banned(client.IP) {
+		r.mu.Unlock()
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+	server, ok := r.punch(request.Name, client)
+	r.mu.Unlock()
+	if !ok {
+		http.Error(w, "not registered", http.StatusNotFound)
+		return
+	}
+
+	if r.debug {
+		fmt.Printf("[PUNCH] from %s to %s at %s for the cluster\n", request.Client, request.Name, server)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(punchResponse{Server: server})
+}
@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/cluster"
+)
+
+func newTestRelay(t *testing.T, registry cluster.Registry, clusterAddress string) *UDPRelay {
+	t.Helper()
+	r, err := NewUDPRelay(UDPRelayOpts{
+		ClusterAddress: clusterAddress,
+		AdvertiseHost:  "127.0.0.1",
+		ClusterSecret:  "secret",
+		Registry:       registry,
+	})
+	if err != nil {
+		t.Fatalf("NewUDPRelay: %v", err)
+	}
+	return r
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readReply reads the next datagram a relay sends to conn.
+func readReply(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buffer := make([]byte, 1024)
+	n, _, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatalf("ReadFromUDP: %v", err)
+	}
+	return string(buffer[:n])
+}
+
+func TestForwardPunch(t *testing.T) {
+	registry := cluster.NewMemory()
+	a := newTestRelay(t, registry, "127.0.0.1:7101")
+	b := newTestRelay(t, registry, "127.0.0.1:7102")
+
+	// the server registers with a, which other relays reach over HTTP
+	listenerA := listenUDP(t)
+	server := listenUDP(t)
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	if err := a.handleAction("REGISTER", "web", listenerA, serverAddr); err != nil {
+		t.Fatalf("REGISTER: %v", err)
+	}
+	if reply := readReply(t, server); reply != "SUCCESS: web 10s" {
+		t.Fatalf("got %q registering", reply)
+	}
+
+	clusterA := httptest.NewServer(http.HandlerFunc(a.handleForwardedPunch))
+	defer clusterA.Close()
+	registry.Announce(cluster.Entry{
+		Network: "udp",
+		Name:    "web",
+		Relay:   clusterA.Listener.Addr().String(),
+		Expires: time.Now().Add(time.Minute),
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		ban    bool
+		want   string
+	}{
+		{"held by another relay", "web", false, "SUCCESS: " + serverAddr.String()},
+		{"held by no relay", "other", false, "FAIL: NOT REGISTERED"},
+		{"client banned by the other relay", "web", true, "FAIL: NOT REGISTERED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listenerB := listenUDP(t)
+			client := listenUDP(t)
+			clientAddr := client.LocalAddr().(*net.UDPAddr)
+			if tt.ban {
+				if err := a.Ban(clientAddr.IP.String()); err != nil {
+					t.Fatalf("Ban: %v", err)
+				}
+				defer a.Unban(clientAddr.IP.String())
+			}
+
+			if err := b.handleAction("PUNCH", tt.target, listenerB, clientAddr); err != nil {
+				t.Fatalf("PUNCH: %v", err)
+			}
+			if reply := readReply(t, client); reply != tt.want {
+				t.Fatalf("got %q, want %q", reply, tt.want)
+			}
+		})
+	}
+}
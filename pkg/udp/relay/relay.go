@@ -3,110 +3,335 @@ package relay
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/cbodonnell/net/pkg/admin"
+	"github.com/cbodonnell/net/pkg/balance"
+	"github.com/cbodonnell/net/pkg/cluster"
+	"github.com/cbodonnell/net/pkg/store"
 )
 
 type UDPRelay struct {
-	clientPort uint
-	serverPort uint
-	bufferSize uint
-	debug      bool
-	// clients    map[string]string
-	servers  map[string]string
-	monitors map[string]chan *net.UDPAddr
+	clientPort      uint
+	serverPort      uint
+	bufferSize      uint
+	evictionTimeout time.Duration
+	sessionTimeout  time.Duration
+	adminAddress    string
+	policy          balance.Policy
+	sticky          bool
+	node            *cluster.Node
+	store           *store.Store
+	gracePeriod     time.Duration
+	graceUntil      time.Time
+	reserved        map[string]map[string]bool
+	debug           bool
+	mu              sync.Mutex
+	servers         map[string]*service
+	clients         map[string]*session
+	bans            map[string]time.Time
+	credentials     map[string]credential
+	draining        bool
+}
+
+// service is the set of servers registered under one name.
+type service struct {
+	pool          *balance.Pool
+	registrations map[string]*registration
+}
+
+type registration struct {
+	address  string
+	weight   int
+	lastPing time.Time
+	// restoredUntil keeps a registration restored from the state file
+	// without pings until the grace period ends
+	restoredUntil time.Time
+}
+
+type session struct {
+	target  string
+	server  string
+	started time.Time
 }
 
 type UDPRelayOpts struct {
-	ClientPort uint
-	ServerPort uint
-	BufferSize uint
-	Debug      bool
+	ClientPort      uint
+	ServerPort      uint
+	BufferSize      uint
+	EvictionTimeout string
+	SessionTimeout  string
+	AdminAddress    string
+	Policy          string
+	Sticky          bool
+	ClusterAddress  string
+	AdvertiseHost   string
+	Peers           []string
+	ClusterSecret   string
+	Registry        cluster.Registry
+	StateFile       string
+	GracePeriod     string
+	Debug           bool
 }
 
-func NewUDPRelay(opts UDPRelayOpts) *UDPRelay {
-	return &UDPRelay{
-		clientPort: opts.ClientPort,
-		serverPort: opts.ServerPort,
-		bufferSize: opts.BufferSize,
-		debug:      opts.Debug,
-		// clients:    make(map[string]string),
-		servers:  make(map[string]string),
-		monitors: make(map[string]chan *net.UDPAddr),
+func NewUDPRelay(opts UDPRelayOpts) (*UDPRelay, error) {
+	evictionTimeout := time.Second * 10
+	if opts.EvictionTimeout != "" {
+		var err error
+		evictionTimeout, err = time.ParseDuration(opts.EvictionTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing eviction timeout: %s", err.Error())
+		}
 	}
-}
 
-func (r *UDPRelay) Run() error {
-	// TODO: Listen on separate ports for clients and servers.
-	clientPortString := fmt.Sprintf(":%d", r.clientPort)
+	// punched clients talk to their server directly, so the relay can't
+	// tell when they are done and counts them for a while after the punch
+	sessionTimeout := time.Minute * 10
+	if opts.SessionTimeout != "" {
+		var err error
+		sessionTimeout, err = time.ParseDuration(opts.SessionTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing session timeout: %s", err.Error())
+		}
+	}
 
-	clientAddr, err := net.ResolveUDPAddr("udp", clientPortString)
+	bufferSize := opts.BufferSize
+	if bufferSize == 0 {
+		bufferSize = 1024
+	}
+
+	policy, err := balance.ParsePolicy(opts.Policy)
 	if err != nil {
-		return fmt.Errorf("error resolving client port: %s", err)
+		return nil, err
 	}
-	clientListener, err := net.ListenUDP("udp", clientAddr)
+
+	gracePeriod := time.Second * 30
+	if opts.GracePeriod != "" {
+		gracePeriod, err = time.ParseDuration(opts.GracePeriod)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing grace period: %s", err.Error())
+		}
+	}
+
+	var node *cluster.Node
+	if opts.ClusterAddress != "" {
+		node, err = cluster.NewNode(cluster.NodeOpts{
+			Registry:      opts.Registry,
+			Network:       "udp",
+			ListenAddress: opts.ClusterAddress,
+			AdvertiseHost: opts.AdvertiseHost,
+			ClientPort:    opts.ClientPort,
+			Peers:         opts.Peers,
+			Secret:        opts.ClusterSecret,
+			Debug:         opts.Debug,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &UDPRelay{
+		clientPort:      opts.ClientPort,
+		serverPort:      opts.ServerPort,
+		bufferSize:      bufferSize,
+		evictionTimeout: evictionTimeout,
+		sessionTimeout:  sessionTimeout,
+		adminAddress:    opts.AdminAddress,
+		policy:          policy,
+		sticky:          opts.Sticky,
+		node:            node,
+		gracePeriod:     gracePeriod,
+		reserved:        make(map[string]map[string]bool),
+		debug:           opts.Debug,
+		servers:         make(map[string]*service),
+		clients:         make(map[string]*session),
+		bans:            make(map[string]time.Time),
+		credentials:     make(map[string]credential),
+	}
+
+	if opts.StateFile != "" {
+		if r.store, err = store.Open(opts.StateFile); err != nil {
+			return nil, err
+		}
+		if err := r.restore(); err != nil {
+			r.store.Close()
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// role is the kind of peer a listener serves. Each role may only use its own actions.
+type role string
+
+const (
+	roleClient role = "client"
+	roleServer role = "server"
+)
+
+var allowedActions = map[role]map[string]bool{
+	roleClient: {"PUNCH": true, "LIST": true},
+	roleServer: {"REGISTER": true, "PING": true, "UNREGISTER": true},
+}
+
+func (r *UDPRelay) Run() error {
+	if r.store != nil {
+		defer r.store.Close()
+	}
+
+	clientListener, err := listen(r.clientPort)
 	if err != nil {
 		return fmt.Errorf("error listening on client port: %s", err)
 	}
 	defer clientListener.Close()
 
+	serverListener, err := listen(r.serverPort)
+	if err != nil {
+		return fmt.Errorf("error listening on server port: %s", err)
+	}
+	defer serverListener.Close()
+
 	if r.debug {
-		fmt.Printf("Listening on %s\n", clientListener.LocalAddr().String())
+		fmt.Printf("Listening for clients on %s\n", clientListener.LocalAddr().String())
+		fmt.Printf("Listening for servers on %s\n", serverListener.LocalAddr().String())
+	}
+
+	if r.adminAddress != "" {
+		adminServer := admin.NewAdminServer(admin.AdminServerOpts{
+			Address: r.adminAddress,
+			Relay:   r,
+			Debug:   r.debug,
+		})
+		go func() {
+			if err := adminServer.Run(); err != nil {
+				fmt.Printf("[ERROR] admin server stopped: %s\n", err.Error())
+			}
+		}()
 	}
 
+	if r.node != nil {
+		r.node.Handle("/punch", r.handleForwardedPunch)
+		go func() {
+			if err := r.node.Run(r.names); err != nil {
+				fmt.Printf("[ERROR] cluster stopped: %s\n", err.Error())
+			}
+		}()
+	}
+
+	go r.monitor()
+
+	errChan := make(chan error, 2)
+	go r.handleRequests(clientListener, roleClient, errChan)
+	go r.handleRequests(serverListener, roleServer, errChan)
+
+	return <-errChan
+}
+
+func listen(port uint) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+func (r *UDPRelay) handleRequests(listener *net.UDPConn, role role, errChan chan<- error) {
 	for {
-		if err := r.handleRequest(clientListener); err != nil {
-			return fmt.Errorf("error handling connection: %s", err)
+		if err := r.handleRequest(listener, role); err != nil {
+			errChan <- fmt.Errorf("error handling %s connection: %s", role, err)
+			return
 		}
 	}
 }
 
-func (r *UDPRelay) handleRequest(clientListener *net.UDPConn) error {
-	buffer := make([]byte, 1024)
-	bytesRead, remoteAddr, err := clientListener.ReadFromUDP(buffer)
+func (r *UDPRelay) handleRequest(listener *net.UDPConn, role role) error {
+	// read one byte more than allowed to detect requests that don't fit
+	buffer := make([]byte, r.bufferSize+1)
+	bytesRead, remoteAddr, err := listener.ReadFromUDP(buffer)
 	if err != nil {
 		return fmt.Errorf("failed to read from UDP: %s", err.Error())
 	}
+	if bytesRead > int(r.bufferSize) {
+		if _, err = listener.WriteToUDP([]byte("FAIL: TOO LARGE"), remoteAddr); err != nil {
+			fmt.Printf("[ERROR] Failed to write TOO LARGE response %s\n", err.Error())
+		}
+		fmt.Printf("[ERROR] request from %s larger than %d bytes\n", remoteAddr.String(), r.bufferSize)
+		return nil
+	}
 
 	if r.debug {
-		fmt.Println("[INCOMING]", string(buffer[0:bytesRead]))
+		fmt.Printf("[INCOMING] (%s) %s\n", role, string(buffer[0:bytesRead]))
 	}
 
 	parts := strings.Split(string(buffer[0:bytesRead]), ": ")
 	if len(parts) != 2 {
-		if _, err = clientListener.WriteToUDP([]byte("FAIL: BAD REQUEST"), remoteAddr); err != nil {
+		if _, err = listener.WriteToUDP([]byte("FAIL: BAD REQUEST"), remoteAddr); err != nil {
 			fmt.Printf("[ERROR] Failed to write BAD REQUEST response %s\n", err.Error())
 		}
-		return fmt.Errorf("invalid request: %s", string(buffer[0:bytesRead]))
+		fmt.Printf("[ERROR] invalid request: %s\n", string(buffer[0:bytesRead]))
+		return nil
 	}
 
 	action, target := parts[0], parts[1]
 
-	if err := r.handleAction(action, target, clientListener, remoteAddr); err != nil {
+	if !allowedActions[role][action] {
+		if _, err = listener.WriteToUDP([]byte("FAIL: NOT ALLOWED"), remoteAddr); err != nil {
+			fmt.Printf("[ERROR] Failed to write NOT ALLOWED response %s\n", err.Error())
+		}
+		fmt.Printf("[ERROR] %s not allowed on the %s port from %s\n", action, role, remoteAddr.String())
+		return nil
+	}
+
+	if err := r.handleAction(action, target, listener, remoteAddr); err != nil {
 		fmt.Printf("[ERROR] error handling action: %s\n", err.Error())
 	}
 
 	return nil
 }
 
-func (r *UDPRelay) handleAction(action, target string, clientListener *net.UDPConn, remoteAddr *net.UDPAddr) error {
+func (r *UDPRelay) handleAction(action, target string, listener *net.UDPConn, remoteAddr *net.UDPAddr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.banned(remoteAddr.IP) {
+		if _, err := listener.WriteToUDP([]byte("FAIL: BANNED"), remoteAddr); err != nil {
+			fmt.Printf("[ERROR] Failed to write BANNED response %s\n", err.Error())
+		}
+		return fmt.Errorf("%s is banned, rejected %s", remoteAddr.String(), action)
+	}
+
 	switch action {
 	case "PUNCH":
-		// can only punch to a registered server
-		if _, ok := r.servers[target]; !ok {
-			if _, err := clientListener.WriteToUDP([]byte("FAIL: NOT REGISTERED"), remoteAddr); err != nil {
+		if r.draining {
+			if _, err := listener.WriteToUDP([]byte("FAIL: DRAINING"), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write DRAINING response %s\n", err.Error())
+			}
+			return fmt.Errorf("draining, rejected punch to %s", target)
+		}
+
+		// can only punch to a registered server, here or on another relay in the cluster
+		server, ok := r.punch(target, remoteAddr)
+		if !ok && r.node != nil {
+			go r.forwardPunch(target, listener, remoteAddr)
+			return nil
+		}
+		if !ok {
+			if _, err := listener.WriteToUDP([]byte("FAIL: NOT REGISTERED"), remoteAddr); err != nil {
 				fmt.Printf("[ERROR] Failed to write NOT REGISTERED response %s\n", err.Error())
 			}
 			return fmt.Errorf("target not registered: %s", target)
 		}
 
 		if r.debug {
-			fmt.Printf("[PUNCH] from %s to %s\n", remoteAddr.String(), target)
+			fmt.Printf("[PUNCH] from %s to %s at %s\n", remoteAddr.String(), target, server)
 		}
 
-		// r.clients[remoteAddr.String()] = target
-
-		if _, err := clientListener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", r.servers[target])), remoteAddr); err != nil {
+		if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", server)), remoteAddr); err != nil {
 			fmt.Printf("[ERROR] Failed to write PUNCH response %s\n", err.Error())
 		}
 	// case "CLOSE":
@@ -116,78 +341,306 @@ func (r *UDPRelay) handleAction(action, target string, clientListener *net.UDPCo
 
 	// 	delete(r.clients, remoteAddr.String())
 
-	// 	if _, err := clientListener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", target)), remoteAddr); err != nil {
+	// 	if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", target)), remoteAddr); err != nil {
 	// 		fmt.Printf("[ERROR] Failed to write CLOSE response %s\n", err.Error())
 	// 	}
+	case "LIST":
+		names := make([]string, 0, len(r.servers))
+		for name := range r.servers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", strings.Join(names, ","))), remoteAddr); err != nil {
+			fmt.Printf("[ERROR] Failed to write LIST response %s\n", err.Error())
+		}
 	case "REGISTER":
-		if _, ok := r.servers[target]; ok {
-			if _, err := clientListener.WriteToUDP([]byte("FAIL: ALREADY REGISTERED"), remoteAddr); err != nil {
+		if r.draining {
+			if _, err := listener.WriteToUDP([]byte("FAIL: DRAINING"), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write DRAINING response %s\n", err.Error())
+			}
+			return fmt.Errorf("draining, rejected registration of %s", target)
+		}
+
+		// the name may be followed by the server's weight and its token
+		fields := strings.Fields(target)
+		if len(fields) == 0 || len(fields) > 3 {
+			if _, err := listener.WriteToUDP([]byte("FAIL: BAD REQUEST"), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write BAD REQUEST response %s\n", err.Error())
+			}
+			return fmt.Errorf("invalid registration: %s", target)
+		}
+		target = fields[0]
+		weight := 1
+		if len(fields) >= 2 {
+			var err error
+			if weight, err = strconv.Atoi(fields[1]); err != nil || weight < 1 {
+				if _, err := listener.WriteToUDP([]byte("FAIL: BAD REQUEST"), remoteAddr); err != nil {
+					fmt.Printf("[ERROR] Failed to write BAD REQUEST response %s\n", err.Error())
+				}
+				return fmt.Errorf("invalid weight for %s: %s", target, fields[1])
+			}
+		}
+
+		token := ""
+		if len(fields) == 3 {
+			token = fields[2]
+		}
+		if !r.authorized(target, token) {
+			if _, err := listener.WriteToUDP([]byte("FAIL: UNAUTHORIZED"), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write UNAUTHORIZED response %s\n", err.Error())
+			}
+			return fmt.Errorf("%s has no valid token for %s", remoteAddr.String(), target)
+		}
+
+		// a server that registered before the relay restarted claims its registration back
+		if server, ok := r.restored(target, remoteAddr); ok {
+			if r.debug {
+				fmt.Printf("[REGISTER] %s reclaimed %s with weight %d\n", remoteAddr.String(), target, weight)
+			}
+			r.reclaim(target, server, remoteAddr.String(), weight)
+			if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s %s", target, r.evictionTimeout)), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write REGISTER response %s\n", err.Error())
+			}
+			return nil
+		}
+
+		if r.reservedFor(target, remoteAddr.IP.String()) {
+			if _, err := listener.WriteToUDP([]byte("FAIL: RESERVED"), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write RESERVED response %s\n", err.Error())
+			}
+			return fmt.Errorf("%s is reserved for its previous owners, rejected %s", target, remoteAddr.String())
+		}
+
+		svc := r.service(target)
+		if _, ok := svc.registrations[remoteAddr.String()]; ok {
+			if _, err := listener.WriteToUDP([]byte("FAIL: ALREADY REGISTERED"), remoteAddr); err != nil {
 				fmt.Printf("[ERROR] Failed to write ALREADY REGISTERED response %s\n", err.Error())
 			}
-			return fmt.Errorf("target already registered: %s", target)
+			return fmt.Errorf("%s already registered as %s", remoteAddr.String(), target)
 		}
 
 		if r.debug {
-			fmt.Printf("[REGISTER] %s registered as %s\n", remoteAddr.String(), target)
+			fmt.Printf("[REGISTER] %s registered as %s with weight %d\n", remoteAddr.String(), target, weight)
 		}
 
-		r.servers[target] = remoteAddr.String()
+		// registering counts as the first ping
+		server := &registration{address: remoteAddr.String(), weight: weight, lastPing: time.Now()}
+		svc.registrations[remoteAddr.String()] = server
+		svc.pool.Add(remoteAddr.String(), weight)
+		r.save(target, server)
 
-		// start ping loop
-		ping := make(chan *net.UDPAddr)
-		r.monitors[target] = ping
-		go r.monitor(clientListener, target, ping)
-
-		if _, err := clientListener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", target)), remoteAddr); err != nil {
+		// advertise the eviction timeout so the server can ping often enough
+		if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s %s", target, r.evictionTimeout)), remoteAddr); err != nil {
 			fmt.Printf("[ERROR] Failed to write REGISTER response %s\n", err.Error())
 		}
 	case "PING":
-		if _, ok := r.servers[target]; !ok {
-			if _, err := clientListener.WriteToUDP([]byte("FAIL: NOT REGISTERED"), remoteAddr); err != nil {
-				fmt.Printf("[ERROR] Failed to write NOT REGISTERED response %s\n", err.Error())
+		server, ok := r.registration(target, remoteAddr.String())
+		if !ok {
+			server, ok = r.restored(target, remoteAddr)
+			if ok {
+				if r.debug {
+					fmt.Printf("[PING] %s reclaimed %s\n", remoteAddr.String(), target)
+				}
+				r.reclaim(target, server, remoteAddr.String(), server.weight)
 			}
-			return fmt.Errorf("target not registered: %s", target)
 		}
-		if _, ok := r.monitors[target]; !ok {
-			if _, err := clientListener.WriteToUDP([]byte("FAIL: NOT MONITORING"), remoteAddr); err != nil {
-				fmt.Printf("[ERROR] Failed to write NOT MONITORING response %s\n", err.Error())
+		if !ok {
+			if _, err := listener.WriteToUDP([]byte("FAIL: NOT REGISTERED"), remoteAddr); err != nil {
+				fmt.Printf("[ERROR] Failed to write NOT REGISTERED response %s\n", err.Error())
 			}
-			return fmt.Errorf("not monitoring target: %s", target)
+			return fmt.Errorf("%s not registered as %s", remoteAddr.String(), target)
 		}
-		if r.servers[target] != remoteAddr.String() {
-			return fmt.Errorf("%s is not %s", remoteAddr.String(), target)
+
+		if r.debug {
+			fmt.Printf("[PING] %s\n", target)
+		}
+
+		server.lastPing = time.Now()
+		if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("PONG: %s", target)), remoteAddr); err != nil {
+			fmt.Printf("[ERROR] Failed to write PONG response %s\n", err.Error())
 		}
-		r.monitors[target] <- remoteAddr
 	case "UNREGISTER":
 		if r.debug {
-			fmt.Printf("[UNREGISTER] %s unregistered\n", target)
+			fmt.Printf("[UNREGISTER] %s unregistered from %s\n", remoteAddr.String(), target)
 		}
-		delete(r.servers, target)
-		if _, err := clientListener.WriteToUDP([]byte(fmt.Sprintf("SUCCESS: %s", target)), remoteAddr); err != nil {
+		r.unregister(target, remoteAddr.String())
+		// answered differently from a registration, so that a server
+		// registering again can't take this for its acknowledgement
+		if _, err := listener.WriteToUDP([]byte(fmt.Sprintf("UNREGISTERED: %s", target)), remoteAddr); err != nil {
 			fmt.Printf("[ERROR] Failed to write UNREGISTER response %s\n", err.Error())
 		}
 	default:
-		if _, err := clientListener.WriteToUDP([]byte("FAIL: BAD REQUEST"), remoteAddr); err != nil {
+		if _, err := listener.WriteToUDP([]byte("FAIL: BAD REQUEST"), remoteAddr); err != nil {
 			fmt.Printf("[ERROR] Failed to write BAD REQUEST response %s\n", err.Error())
 		}
 	}
 	return nil
 }
 
-func (r *UDPRelay) monitor(conn *net.UDPConn, target string, ping chan *net.UDPAddr) {
-	for {
-		select {
-		case <-time.After(time.Second * 10):
-			delete(r.servers, target)
-			if r.debug {
-				fmt.Printf("[UNREGISTER] %s unregistered after timeout\n", target)
+// punch picks a server registered under a name for a client and starts a
+// session between them. The caller must hold r.mu.
+func (r *UDPRelay) punch(target string, client *net.UDPAddr) (string, bool) {
+	svc, ok := r.servers[target]
+	if !ok {
+		return "", false
+	}
+
+	server, _ := svc.pool.Pick(balance.ClientID(client), nil)
+
+	if previous, ok := r.clients[client.String()]; ok {
+		r.release(previous)
+	}
+	r.clients[client.String()] = &session{target: target, server: server.ID, started: time.Now()}
+	svc.pool.Acquire(server.ID)
+	return server.ID, true
+}
+
+// monitor unregisters servers that have stopped pinging, and ends the
+// sessions of clients that haven't punched for the session timeout.
+func (r *UDPRelay) monitor() {
+	for range time.Tick(time.Second) {
+		r.mu.Lock()
+		for client, session := range r.clients {
+			if time.Since(session.started) > r.sessionTimeout {
+				r.release(session)
+				delete(r.clients, client)
+				if r.debug {
+					fmt.Printf("[EXPIRE] session of %s to %s expired\n", client, session.target)
+				}
 			}
-			return
-		case server := <-ping:
-			if r.debug {
-				fmt.Printf("[PING] %s\n", target)
+		}
+		for target, svc := range r.servers {
+			for address, server := range svc.registrations {
+				if time.Since(server.lastPing) > r.evictionTimeout && time.Now().After(server.restoredUntil) {
+					r.unregister(target, address)
+					if r.debug {
+						fmt.Printf("[UNREGISTER] %s unregistered from %s after timeout\n", address, target)
+					}
+				}
 			}
-			conn.WriteTo([]byte(fmt.Sprintf("PONG: %s", target)), server)
 		}
+		r.mu.Unlock()
 	}
 }
+
+// service returns the servers registered under a name, creating them if
+// needed. The caller must hold r.mu.
+func (r *UDPRelay) service(target string) *service {
+	svc, ok := r.servers[target]
+	if !ok {
+		svc = &service{
+			pool:          balance.NewPool(r.policy, r.sticky),
+			registrations: make(map[string]*registration),
+		}
+		r.servers[target] = svc
+		r.node.Changed()
+	}
+	return svc
+}
+
+// registration finds the server at an address registered under a name.
+// The caller must hold r.mu.
+func (r *UDPRelay) registration(target, address string) (*registration, bool) {
+	svc, ok := r.servers[target]
+	if !ok {
+		return nil, false
+	}
+	server, ok := svc.registrations[address]
+	return server, ok
+}
+
+// unregister removes a server and the client sessions punched to it, and
+// the name once no server is left under it. The caller must hold r.mu.
+func (r *UDPRelay) unregister(target, address string) {
+	svc, ok := r.servers[target]
+	if !ok {
+		return
+	}
+	delete(svc.registrations, address)
+	svc.pool.Remove(address)
+	r.forget(target, address)
+	if len(svc.registrations) == 0 {
+		delete(r.servers, target)
+		r.node.Changed()
+	}
+	for client, session := range r.clients {
+		if session.target == target && session.server == address {
+			delete(r.clients, client)
+		}
+	}
+}
+
+// release stops counting a session against its server. The caller must hold r.mu.
+func (r *UDPRelay) release(s *session) {
+	if svc, ok := r.servers[s.target]; ok {
+		svc.pool.Release(s.server)
+	}
+}
+
+func (r *UDPRelay) Servers() []admin.ServerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	servers := make([]admin.ServerInfo, 0, len(r.servers))
+	for target, svc := range r.servers {
+		for _, backend := range svc.pool.Backends() {
+			server := svc.registrations[backend.ID]
+			servers = append(servers, admin.ServerInfo{
+				Name:        target,
+				Address:     server.address,
+				LastPing:    server.lastPing,
+				Weight:      backend.Weight,
+				Connections: backend.Conns,
+			})
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers
+}
+
+func (r *UDPRelay) Sessions() []admin.SessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]admin.SessionInfo, 0, len(r.clients))
+	for client, session := range r.clients {
+		sessions = append(sessions, admin.SessionInfo{
+			Client:  client,
+			Server:  fmt.Sprintf("%s (%s)", session.target, session.server),
+			Started: session.started,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions
+}
+
+// Unregister removes every server registered under a name, or the one
+// server registered from an address.
+func (r *UDPRelay) Unregister(target string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if svc, ok := r.servers[target]; ok {
+		for address := range svc.registrations {
+			r.unregister(target, address)
+		}
+		return nil
+	}
+	for name, svc := range r.servers {
+		if _, ok := svc.registrations[target]; ok {
+			r.unregister(name, target)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w", target, admin.ErrNotRegistered)
+}
+
+// Drain stops accepting new registrations and punches. Servers that are
+// already registered keep being monitored until they unregister or time out.
+func (r *UDPRelay) Drain() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+	return nil
+}
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// registrationsBucket holds the registered servers, keyed by name and address.
+const registrationsBucket = "registrations"
+
+type savedRegistration struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
+func registrationKey(target, address string) string {
+	return target + " " + address
+}
+
+// restore loads the state saved before the relay restarted. Registrations
+// are kept without pings until the grace period ends, so that servers which
+// are still running carry on, and their names are reserved for the hosts
+// that held them until then.
+func (r *UDPRelay) restore() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.restoreAccess(); err != nil {
+		return err
+	}
+
+	r.graceUntil = time.Now().Add(r.gracePeriod)
+	restored := 0
+	err := r.store.Load(registrationsBucket, func(key string, value []byte) error {
+		var saved savedRegistration
+		if err := json.Unmarshal(value, &saved); err != nil {
+			return fmt.Errorf("invalid registration %s: %s", key, err.Error())
+		}
+
+		svc := r.service(saved.Name)
+		svc.registrations[saved.Address] = &registration{
+			address:       saved.Address,
+			weight:        saved.Weight,
+			lastPing:      time.Now(),
+			restoredUntil: r.graceUntil,
+		}
+		svc.pool.Add(saved.Address, saved.Weight)
+
+		if host, _, err := net.SplitHostPort(saved.Address); err == nil {
+			if r.reserved[saved.Name] == nil {
+				r.reserved[saved.Name] = make(map[string]bool)
+			}
+			r.reserved[saved.Name][host] = true
+		}
+		restored++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error restoring registrations: %s", err.Error())
+	}
+
+	if restored > 0 {
+		fmt.Printf("Restored %d registrations, reserved for %s\n", restored, r.gracePeriod)
+	}
+	return nil
+}
+
+// restored finds a registration restored from the state file that a server
+// at an address may claim back. Servers come back from a new port after
+// losing their socket, so it is matched by host. The caller must hold r.mu.
+func (r *UDPRelay) restored(target string, addr *net.UDPAddr) (*registration, bool) {
+	svc, ok := r.servers[target]
+	if !ok {
+		return nil, false
+	}
+	if server, ok := svc.registrations[addr.String()]; ok {
+		return server, !server.restoredUntil.IsZero()
+	}
+	for address, server := range svc.registrations {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil && !server.restoredUntil.IsZero() && net.ParseIP(host).Equal(addr.IP) {
+			return server, true
+		}
+	}
+	return nil, false
+}
+
+// reclaim hands a restored registration to the server now at an address,
+// replacing the stale entry so that clients are no longer punched to it.
+// The caller must hold r.mu.
+func (r *UDPRelay) reclaim(target string, server *registration, address string, weight int) {
+	svc := r.servers[target]
+	previous := server.address
+	delete(svc.registrations, previous)
+	svc.pool.Remove(previous)
+	r.forget(target, previous)
+	for client, session := range r.clients {
+		if session.target == target && session.server == previous {
+			delete(r.clients, client)
+		}
+	}
+
+	server.address = address
+	server.weight = weight
+	server.lastPing = time.Now()
+	server.restoredUntil = time.Time{}
+	svc.registrations[address] = server
+	svc.pool.Add(address, weight)
+	r.save(target, server)
+}
+
+// reservedFor reports whether a name is reserved for other hosts than the
+// one registering. The caller must hold r.mu.
+func (r *UDPRelay) reservedFor(target, host string) bool {
+	if time.Now().After(r.graceUntil) {
+		return false
+	}
+	owners, ok := r.reserved[target]
+	return ok && !owners[host]
+}
+
+// save stores a registration. The caller must hold r.mu.
+func (r *UDPRelay) save(target string, server *registration) {
+	if r.store == nil {
+		return
+	}
+	err := r.store.Put(registrationsBucket, registrationKey(target, server.address), savedRegistration{
+		Name:    target,
+		Address: server.address,
+		Weight:  server.weight,
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to save registration of %s: %s\n", target, err.Error())
+	}
+}
+
+// forget removes a stored registration. The caller must hold r.mu.
+func (r *UDPRelay) forget(target, address string) {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.Delete(registrationsBucket, registrationKey(target, address)); err != nil {
+		fmt.Printf("[ERROR] Failed to forget registration of %s: %s\n", target, err.Error())
+	}
+}
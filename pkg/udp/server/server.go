@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -9,25 +10,60 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cbodonnell/net/pkg/backoff"
 	"github.com/cbodonnell/net/pkg/crypto"
+	"github.com/cbodonnell/net/pkg/health"
+	"github.com/cbodonnell/net/pkg/pipe"
+	"github.com/cbodonnell/net/pkg/proxy"
+	"github.com/cbodonnell/net/pkg/relays"
+	"github.com/cbodonnell/net/pkg/udp/fragment"
+	"github.com/cbodonnell/net/pkg/udp/stream"
 )
 
 type UDPServer struct {
-	relayAddress  string
-	serverAddress string
-	serverName    string
-	cipher        crypto.Cipher
-	retryDuration time.Duration
-	debug         bool
+	*backoff.Circuits
+	relays          []string
+	serverAddress   string
+	serverName      string
+	weight          uint
+	credential      string
+	cipher          crypto.Cipher
+	bufferSize      uint
+	maxDatagramSize uint
+	fragmenter      *fragment.Fragmenter
+	reassembler     *fragment.Reassembler
+	registerTimeout time.Duration
+	pingInterval    time.Duration
+	pingTimeout     time.Duration
+	stream          bool
+	proxy           *proxy.Dialer
+	health          *health.Monitor
+	debug           bool
 }
 
 type UDPServerOpts struct {
-	RelayAddress  string
-	ServerAddress string
-	ServerName    string
-	Key           []byte
-	RetryDuration string
-	Debug         bool
+	RelayAddress     string
+	ServerAddress    string
+	ServerName       string
+	Weight           uint
+	Credential       string
+	Key              []byte
+	BufferSize       uint
+	Fragment         bool
+	MaxDatagramSize  uint
+	RetryDuration    string
+	MaxRetryDuration string
+	CircuitThreshold uint
+	RegisterTimeout  string
+	PingInterval     string
+	PingTimeout      string
+	Stream           bool
+	Proxy            *proxy.Dialer
+	HealthCheck      string
+	HealthInterval   string
+	HealthTimeout    string
+	HealthThreshold  uint
+	Debug            bool
 }
 
 func NewUDPServer(opts UDPServerOpts) (*UDPServer, error) {
@@ -36,52 +72,163 @@ func NewUDPServer(opts UDPServerOpts) (*UDPServer, error) {
 		return nil, fmt.Errorf("error creating cipher: %s", err.Error())
 	}
 
-	retryDuration := time.Second
-	if opts.RetryDuration != "" {
-		retryDuration, err = time.ParseDuration(opts.RetryDuration)
+	// servers register with every relay, looked up once
+	relayList, err := relays.Parse(opts.RelayAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing relay address: %s", err.Error())
+	}
+	relayAddresses := relayList.All()
+
+	circuits, err := backoff.NewCircuits(relayAddresses, backoff.BackoffOpts{
+		Min:       opts.RetryDuration,
+		Max:       opts.MaxRetryDuration,
+		Threshold: opts.CircuitThreshold,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	registerTimeout, err := parseDuration(opts.RegisterTimeout, time.Second*5)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing register timeout: %s", err.Error())
+	}
+
+	pingInterval, err := parseDuration(opts.PingInterval, time.Second*5)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ping interval: %s", err.Error())
+	}
+
+	pingTimeout, err := parseDuration(opts.PingTimeout, time.Second*5)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ping timeout: %s", err.Error())
+	}
+
+	bufferSize := opts.BufferSize
+	if bufferSize == 0 {
+		bufferSize = 1024
+	}
+
+	maxDatagramSize := opts.MaxDatagramSize
+	if maxDatagramSize == 0 {
+		maxDatagramSize = 1400
+	}
+
+	if opts.Stream && opts.Fragment {
+		return nil, errors.New("stream mode segments data itself and can't be combined with fragmentation")
+	}
+
+	var fragmenter *fragment.Fragmenter
+	var reassembler *fragment.Reassembler
+	if opts.Fragment {
+		fragmenter, err = fragment.NewFragmenter(int(maxDatagramSize))
 		if err != nil {
-			return nil, fmt.Errorf("error parsing retry duration: %s", err.Error())
+			return nil, fmt.Errorf("error creating fragmenter: %s", err.Error())
 		}
+		reassembler = fragment.NewReassembler(time.Second*5, 256)
+	}
+
+	monitor, err := health.NewMonitor(health.MonitorOpts{
+		Check:     opts.HealthCheck,
+		Address:   opts.ServerAddress,
+		Interval:  opts.HealthInterval,
+		Timeout:   opts.HealthTimeout,
+		Threshold: opts.HealthThreshold,
+		Debug:     opts.Debug,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating health check: %s", err.Error())
 	}
 
 	return &UDPServer{
-		relayAddress:  opts.RelayAddress,
-		serverAddress: opts.ServerAddress,
-		serverName:    opts.ServerName,
-		cipher:        cipher,
-		retryDuration: retryDuration,
-		debug:         opts.Debug,
+		relays:          relayAddresses,
+		serverAddress:   opts.ServerAddress,
+		serverName:      opts.ServerName,
+		weight:          opts.Weight,
+		credential:      opts.Credential,
+		cipher:          cipher,
+		bufferSize:      bufferSize,
+		maxDatagramSize: maxDatagramSize,
+		fragmenter:      fragmenter,
+		reassembler:     reassembler,
+		Circuits:        circuits,
+		registerTimeout: registerTimeout,
+		pingInterval:    pingInterval,
+		pingTimeout:     pingTimeout,
+		stream:          opts.Stream,
+		proxy:           opts.Proxy,
+		health:          monitor,
+		debug:           opts.Debug,
 	}, nil
 }
 
-func (s *UDPServer) Run() error {
-	relayAddr, err := net.ResolveUDPAddr("udp", s.relayAddress)
+// parseDuration parses a duration, returning the fallback if the value is empty.
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
 	if err != nil {
-		return fmt.Errorf("failed to resolve relay address: %s", err)
+		return 0, err
 	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", value)
+	}
+	return d, nil
+}
 
+func (s *UDPServer) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := s.Serve(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return errors.New("interrupted")
+}
+
+// Serve registers with the relays and serves clients until the context is done.
+func (s *UDPServer) Serve(ctx context.Context) error {
 	serverAddr, err := net.ResolveUDPAddr("udp", s.serverAddress)
 	if err != nil {
 		return fmt.Errorf("failed to resolve server address: %s", err)
 	}
 
-	go func() {
-		for {
-			if err := s.registerAndServe(relayAddr, serverAddr); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to register and serve: %s", err.Error())
-				fmt.Fprintf(os.Stderr, "Retrying in %s\n", s.retryDuration)
-				time.Sleep(s.retryDuration)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.health.Run(ctx)
+
+	return relays.ServeEach(ctx, s.relays, func(ctx context.Context, relayAddress string) error {
+		return s.serveRelay(ctx, relayAddress, serverAddr)
+	})
+}
+
+// serveRelay registers with one relay and serves the clients it sends until
+// the context is done.
+func (s *UDPServer) serveRelay(ctx context.Context, relayAddress string, serverAddr *net.UDPAddr) error {
+	relayAddr, err := net.ResolveUDPAddr("udp", relayAddress)
+	if err != nil {
+		return fmt.Errorf("failed to resolve relay address: %s", err)
+	}
+
+	retryBackoff := s.Circuits.For(relayAddress)
+	for {
+		if err := s.registerAndServe(ctx, relayAddr, serverAddr, retryBackoff); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			delay := retryBackoff.Failure()
+			fmt.Fprintf(os.Stderr, "Failed to register and serve: %s\n", err.Error())
+			fmt.Fprintf(os.Stderr, "Retrying in %s\n", delay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
 			}
 		}
-	}()
-
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
-	return errors.New("interrupted")
+	}
 }
 
-func (s *UDPServer) registerAndServe(relayAddr, serverAddr *net.UDPAddr) error {
+func (s *UDPServer) registerAndServe(ctx context.Context, relayAddr, serverAddr *net.UDPAddr, retryBackoff *backoff.Backoff) error {
 	listen, err := net.ListenUDP("udp", nil)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %s", err)
@@ -90,35 +237,84 @@ func (s *UDPServer) registerAndServe(relayAddr, serverAddr *net.UDPAddr) error {
 
 	fmt.Printf("Listening on %s\n", listen.LocalAddr().String())
 
-	serverConn, err := net.DialUDP("udp", nil, serverAddr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to server: %s", err)
+	var serverConn *net.UDPConn
+	var transport *stream.Transport
+	if s.stream {
+		// clients open streams to us on the registered socket
+		transport, err = stream.NewTransport(stream.TransportOpts{
+			Conn:            listen,
+			Cipher:          s.cipher,
+			MaxDatagramSize: s.maxDatagramSize,
+			Debug:           s.debug,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create stream transport: %s", err)
+		}
+		defer transport.Close()
+		go s.acceptStreams(transport)
+	} else {
+		serverConn, err = net.DialUDP("udp", nil, serverAddr)
+		if err != nil {
+			return fmt.Errorf("failed to connect to server: %s", err)
+		}
+		defer serverConn.Close()
 	}
-	defer serverConn.Close()
 
-	registerChan := make(chan string)
-	pongChan := make(chan struct{})
+	registerChan := make(chan string, 1)
+	pongChan := make(chan struct{}, 1)
+	lostChan := make(chan struct{}, 1)
+
+	// the largest datagram a client may send, plus a byte to detect truncation
+	size := int(s.bufferSize) + s.cipher.Overhead()
+	if s.fragmenter != nil || s.stream {
+		size = int(s.maxDatagramSize)
+	}
 
 	// Read messages from the relay server
-	go func(registerChan chan<- string, pongChan chan<- struct{}) {
+	go func(registerChan chan<- string, pongChan, lostChan chan<- struct{}) {
+		buffer := make([]byte, size+1)
 		for {
-			buffer := make([]byte, 1024)
 			n, remoteAddr, err := listen.ReadFromUDP(buffer)
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				fmt.Printf("[ERROR] Failed to read from UDP: %s\n", err.Error())
 				continue
 			}
+			if n > size {
+				fmt.Printf("[ERROR] Dropped datagram from %s larger than %d bytes\n", remoteAddr.String(), size)
+				continue
+			}
 			message := buffer[:n]
 
+			if transport != nil && remoteAddr.String() != relayAddr.String() {
+				if err := transport.Input(remoteAddr, message); err != nil && s.debug {
+					fmt.Printf("[ERROR] Dropped stream datagram from %s: %s\n", remoteAddr.String(), err.Error())
+				}
+				continue
+			}
+
 			fmt.Printf("[INCOMING] from %s:\n%s\n", remoteAddr.String(), string(message))
 
 			switch remoteAddr.String() {
 			case relayAddr.String():
-				if err := handleRelayServerMessage(message, registerChan, pongChan); err != nil {
+				if err := handleRelayServerMessage(message, registerChan, pongChan, lostChan); err != nil {
 					fmt.Printf("failed to handle relay server message: %s\n", err)
 					continue
 				}
 			default:
+				if s.reassembler != nil {
+					message, err = s.reassembler.Add(remoteAddr.String(), message)
+					if err != nil {
+						fmt.Printf("[ERROR] Failed to reassemble message: %s\n", err.Error())
+						continue
+					}
+					if message == nil {
+						continue
+					}
+				}
+
 				decryptedMessage, err := s.cipher.Decrypt(message)
 				if err != nil {
 					fmt.Printf("[ERROR] Failed to decrypt message: %s\n", err.Error())
@@ -132,14 +328,18 @@ func (s *UDPServer) registerAndServe(relayAddr, serverAddr *net.UDPAddr) error {
 				}
 
 				// Read the response from the server
-				buffer := make([]byte, 1024)
-				_, err = serverConn.Read(buffer)
+				responseBuffer := make([]byte, s.bufferSize+1)
+				n, err := serverConn.Read(responseBuffer)
 				if err != nil {
 					fmt.Printf("failed to read from server: %s\n", err)
 					continue
 				}
+				if n > int(s.bufferSize) {
+					fmt.Printf("[ERROR] Dropped response larger than buffer size of %d bytes\n", s.bufferSize)
+					continue
+				}
 
-				response := buffer[:n]
+				response := responseBuffer[:n]
 
 				encryptedResponse, err := s.cipher.Encrypt(response)
 				if err != nil {
@@ -147,7 +347,7 @@ func (s *UDPServer) registerAndServe(relayAddr, serverAddr *net.UDPAddr) error {
 					continue
 				}
 
-				_, err = listen.WriteToUDP(encryptedResponse, remoteAddr)
+				err = s.writeToClient(listen, remoteAddr, encryptedResponse)
 				if err != nil {
 					fmt.Printf("[ERROR] Failed to write to %s: %s\n", remoteAddr.String(), err.Error())
 					continue
@@ -155,50 +355,203 @@ func (s *UDPServer) registerAndServe(relayAddr, serverAddr *net.UDPAddr) error {
 			}
 
 		}
-	}(registerChan, pongChan)
+	}(registerChan, pongChan, lostChan)
 
 	// Register with the relay server
-	relayErrChan := make(chan error)
-
 	for {
+		if err := s.health.Wait(ctx); err != nil {
+			return err
+		}
 		fmt.Printf("Registering with relay server %s\n", relayAddr.String())
-		go func(relayErrChan chan<- error) {
-			err := s.register(listen, relayAddr)
-			if err != nil {
-				relayErrChan <- fmt.Errorf("failed to register: %s", err.Error())
-				return
+		err := s.keepRegistered(ctx, listen, relayAddr, retryBackoff, registerChan, pongChan, lostChan)
+		if ctx.Err() != nil {
+			// free the name right away rather than waiting for the relay to time it out
+			if err := s.unregister(listen, relayAddr); err != nil {
+				fmt.Printf("failed to unregister: %s\n", err.Error())
 			}
-
-			select {
-			case <-time.After(time.Second * 5):
-				relayErrChan <- errors.New("registration timeout")
-				return
-			case target := <-registerChan:
-				fmt.Printf("Registered as %s\n", target)
+			return ctx.Err()
+		}
+		if errors.Is(err, errUnhealthy) {
+			// withdraw so the relay stops sending clients until the backend recovers
+			fmt.Println("Unregistering while the backend is unhealthy")
+			if err := s.unregister(listen, relayAddr); err != nil {
+				fmt.Printf("failed to unregister: %s\n", err.Error())
 			}
+			continue
+		}
+		if errors.Is(err, errNotRegistered) {
+			// the relay restarted and is back, so there is no reason to wait
+			fmt.Println("Relay lost the registration, registering again")
+			continue
+		}
+		delay := retryBackoff.Failure()
+		fmt.Printf("failed to connect to relay server: %s\n", err.Error())
+		fmt.Printf("Retrying in %s\n", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
 
-			for {
-				time.Sleep(time.Second * 5)
-				if err := s.ping(listen, relayAddr); err != nil {
-					relayErrChan <- fmt.Errorf("failed to ping: %s", err)
+// acceptStreams connects every stream a client opens to the TCP server, or
+// to the destination it asks for when proxying, until the transport is closed.
+func (s *UDPServer) acceptStreams(transport *stream.Transport) {
+	for {
+		clientConn, err := transport.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if s.proxy != nil {
+				targetConn, client, err := s.proxy.Accept(clientConn)
+				if err != nil {
+					fmt.Printf("[ERROR] Failed to connect client: %s\n", err.Error())
+					clientConn.Close()
 					return
 				}
-				select {
-				case <-time.After(time.Second * 5):
-					relayErrChan <- errors.New("ping timeout")
-					return
-				case <-pongChan:
+				if s.debug {
+					fmt.Printf("Streaming %s to %s\n", clientConn.RemoteAddr().String(), targetConn.RemoteAddr().String())
 				}
+				pipe.Join(client, targetConn)
+				return
 			}
-		}(relayErrChan)
-		err := <-relayErrChan
-		fmt.Printf("failed to connect to relay server: %s\n", err.Error())
-		time.Sleep(time.Second * 5)
+			serverConn, err := net.Dial("tcp", s.serverAddress)
+			if err != nil {
+				fmt.Printf("[ERROR] Failed to connect to server: %s\n", err.Error())
+				clientConn.Close()
+				return
+			}
+			if s.debug {
+				fmt.Printf("Streaming %s to %s\n", clientConn.RemoteAddr().String(), s.serverAddress)
+			}
+			pipe.Join(clientConn, serverConn)
+		}()
 	}
 }
 
+// errUnhealthy is returned by keepRegistered when the backend becomes unhealthy.
+var errUnhealthy = errors.New("backend is unhealthy")
+
+// errNotRegistered is returned by keepRegistered when the relay answers a
+// ping without knowing us, which it does after restarting.
+var errNotRegistered = errors.New("not registered")
+
+// keepRegistered registers with the relay and pings it until the relay
+// stops responding, the backend becomes unhealthy or the context is done.
+func (s *UDPServer) keepRegistered(ctx context.Context, listen *net.UDPConn, relayAddr *net.UDPAddr, retryBackoff *backoff.Backoff, registerChan <-chan string, pongChan, lostChan <-chan struct{}) error {
+	down := s.health.Down()
+
+	// drop an acknowledgement that arrived after an earlier registration
+	// gave up waiting, so that it isn't taken for this one's
+	select {
+	case <-registerChan:
+	default:
+	}
+
+	err := s.register(listen, relayAddr)
+	if err != nil {
+		return fmt.Errorf("failed to register: %s", err.Error())
+	}
+
+	pingInterval := s.pingInterval
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-down:
+		return errUnhealthy
+	case <-time.After(s.registerTimeout):
+		return errors.New("registration timeout")
+	case value := <-registerChan:
+		retryBackoff.Success()
+		// drop a loss reported before this registration
+		select {
+		case <-lostChan:
+		default:
+		}
+		// the relay may advertise how long it waits for a ping before evicting us
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return errors.New("empty registration response from relay")
+		}
+		fmt.Printf("Registered as %s with %s\n", fields[0], relayAddr.String())
+		if len(fields) > 1 {
+			evictionTimeout, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return fmt.Errorf("invalid eviction timeout from relay: %s", fields[1])
+			}
+			if pingInterval > evictionTimeout/2 {
+				pingInterval = evictionTimeout / 2
+				fmt.Printf("Relay evicts after %s, pinging every %s\n", evictionTimeout, pingInterval)
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-down:
+			return errUnhealthy
+		case <-time.After(pingInterval):
+		}
+		if err := s.ping(listen, relayAddr); err != nil {
+			return fmt.Errorf("failed to ping: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.pingTimeout):
+			return errors.New("ping timeout")
+		case <-lostChan:
+			return errNotRegistered
+		case <-pongChan:
+		}
+	}
+}
+
+func (s *UDPServer) writeToClient(listen *net.UDPConn, remoteAddr *net.UDPAddr, message []byte) error {
+	if s.fragmenter == nil {
+		_, err := listen.WriteToUDP(message, remoteAddr)
+		return err
+	}
+
+	datagrams, err := s.fragmenter.Split(message)
+	if err != nil {
+		return err
+	}
+	for _, datagram := range datagrams {
+		if _, err := listen.WriteToUDP(datagram, remoteAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *UDPServer) register(listen *net.UDPConn, remoteAddr *net.UDPAddr) error {
-	_, err := listen.WriteTo([]byte(fmt.Sprintf("REGISTER: %s", s.serverName)), remoteAddr)
+	request := fmt.Sprintf("REGISTER: %s", s.serverName)
+	if s.weight > 0 || s.credential != "" {
+		// the token follows the weight, so a weight is always sent with it
+		weight := s.weight
+		if weight == 0 {
+			weight = 1
+		}
+		request = fmt.Sprintf("%s %d", request, weight)
+	}
+	if s.credential != "" {
+		request = fmt.Sprintf("%s %s", request, s.credential)
+	}
+	_, err := listen.WriteTo([]byte(request), remoteAddr)
+	if err != nil {
+		return fmt.Errorf("failed to write to relay server %s: %s", remoteAddr.String(), err.Error())
+	}
+
+	return nil
+}
+
+func (s *UDPServer) unregister(listen *net.UDPConn, remoteAddr *net.UDPAddr) error {
+	_, err := listen.WriteTo([]byte(fmt.Sprintf("UNREGISTER: %s", s.serverName)), remoteAddr)
 	if err != nil {
 		return fmt.Errorf("failed to write to relay server %s: %s", remoteAddr.String(), err.Error())
 	}
@@ -215,19 +568,33 @@ func (s *UDPServer) ping(listen *net.UDPConn, remoteAddr *net.UDPAddr) error {
 	return nil
 }
 
-func handleRelayServerMessage(message []byte, registerChan chan<- string, pongChan chan<- struct{}) error {
+func handleRelayServerMessage(message []byte, registerChan chan<- string, pongChan, lostChan chan<- struct{}) error {
 	parts := strings.Split(string(message), ": ")
 	if len(parts) != 2 {
 		return fmt.Errorf("invalid message from relay server: %s", string(message))
 	}
 	action, target := parts[0], parts[1]
 
+	// never block the read loop on a registration that is no longer waiting
 	switch action {
 	case "SUCCESS":
-		registerChan <- target
+		select {
+		case registerChan <- target:
+		default:
+		}
 	case "PONG":
-		pongChan <- struct{}{}
+		select {
+		case pongChan <- struct{}{}:
+		default:
+		}
+	case "UNREGISTERED":
 	case "FAIL":
+		if target == "NOT REGISTERED" {
+			select {
+			case lostChan <- struct{}{}:
+			default:
+			}
+		}
 		return fmt.Errorf("failure message from relay server: %s", target)
 	default:
 		return fmt.Errorf("unknown action from relay server: %s", action)
@@ -0,0 +1,513 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSendSegments bounds the segments queued or in flight before Write blocks
+	maxSendSegments = 512
+	// maxRecvSegments is the receive window advertised to the peer
+	maxRecvSegments = 512
+	maxRetries      = 12
+	minRTO          = time.Millisecond * 200
+	maxRTO          = time.Second * 10
+	tickInterval    = time.Millisecond * 10
+	// lingerTimeout is how long a closed stream waits for the peer to close its side
+	lingerTimeout = time.Second * 30
+)
+
+var (
+	ErrReset    = errors.New("stream reset by peer")
+	ErrTimedOut = errors.New("stream timed out")
+)
+
+type outSegment struct {
+	seg     *segment
+	sent    bool
+	sentAt  time.Time
+	retries int
+}
+
+// Conn is a reliable, ordered stream over datagrams. It implements net.Conn.
+type Conn struct {
+	transport *Transport
+	id        uint32
+	remote    net.Addr
+	mu        sync.Mutex
+	cond      *sync.Cond
+	notify    chan struct{}
+
+	// sending
+	sndNext  uint32
+	sndUna   uint32
+	unacked  []*outSegment
+	cwnd     float64
+	ssthresh float64
+	rwnd     uint16
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	// peerHighest is the highest sequence number the peer has received
+	peerHighest uint32
+	// recover is the sequence number that ends the current loss recovery
+	recover    uint32
+	recovering bool
+
+	// receiving
+	rcvNext    uint32
+	rcvHighest uint32
+	outOfOrder map[uint32]*segment
+	readBuf    bytes.Buffer
+	ackPending bool
+
+	established bool
+	finSent     bool
+	finReceived bool
+	closed      bool
+	closedAt    time.Time
+	err         error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(t *Transport, id uint32, remote net.Addr) *Conn {
+	c := &Conn{
+		transport:  t,
+		id:         id,
+		remote:     remote,
+		notify:     make(chan struct{}, 1),
+		cwnd:       2,
+		ssthresh:   64,
+		rwnd:       maxRecvSegments,
+		rto:        time.Second,
+		outOfOrder: make(map[uint32]*segment),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+// queue adds a segment to be sent reliably. The caller must hold c.mu.
+func (c *Conn) queue(flags byte, data []byte) {
+	c.unacked = append(c.unacked, &outSegment{
+		seg: &segment{flags: flags, stream: c.id, seq: c.sndNext, data: data},
+	})
+	c.sndNext++
+	c.wake()
+}
+
+func (c *Conn) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// window is the number of segments the peer may still send us. The caller must hold c.mu.
+func (c *Conn) window() uint16 {
+	used := len(c.outOfOrder) + c.readBuf.Len()/c.transport.mss
+	if used >= maxRecvSegments {
+		return 0
+	}
+	return uint16(maxRecvSegments - used)
+}
+
+func (c *Conn) send(seg *segment) {
+	// every segment carries the latest acknowledgement and window
+	seg.ack = c.rcvNext
+	seg.wnd = c.window()
+	c.ackPending = false
+	c.transport.write(seg, c.remote)
+}
+
+// run sends and retransmits segments until the stream is finished.
+func (c *Conn) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.notify:
+		}
+
+		c.mu.Lock()
+		done := c.flush(time.Now())
+		c.mu.Unlock()
+
+		if done {
+			c.transport.remove(c)
+			return
+		}
+	}
+}
+
+// flush sends what the windows allow, retransmits lost segments and
+// reports whether the stream is finished. The caller must hold c.mu.
+func (c *Conn) flush(now time.Time) bool {
+	if c.err != nil {
+		return true
+	}
+
+	window := int(c.cwnd)
+	if int(c.rwnd) < window {
+		window = int(c.rwnd)
+	}
+	if window < 1 {
+		// always allow one segment to probe a closed window
+		window = 1
+	}
+
+	lost := false
+	for i, o := range c.unacked {
+		if i >= window {
+			break
+		}
+		switch {
+		case !o.sent:
+			o.sent = true
+		case before(o.seg.seq, c.peerHighest) && c.srtt > 0 && now.Sub(o.sentAt) > c.srtt+c.srtt/4:
+			// a later segment arrived and this one is overdue, it was most
+			// likely lost so don't wait for it to time out. Without a round
+			// trip sample yet, only the timeout below applies.
+			o.retries++
+			if o.retries > maxRetries {
+				c.fail(ErrTimedOut)
+				return true
+			}
+			c.enterRecovery()
+		case now.Sub(o.sentAt) > c.rto:
+			o.retries++
+			if o.retries > maxRetries {
+				c.fail(ErrTimedOut)
+				return true
+			}
+			lost = true
+		default:
+			continue
+		}
+		o.sentAt = now
+		c.send(o.seg)
+	}
+
+	if lost {
+		// back off once per flush however many segments timed out
+		c.ssthresh = c.cwnd / 2
+		if c.ssthresh < 2 {
+			c.ssthresh = 2
+		}
+		c.cwnd = 1
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+	}
+
+	if c.ackPending {
+		c.send(&segment{flags: flagACK, stream: c.id, seq: c.rcvHighest})
+	}
+
+	if c.finSent && len(c.unacked) == 0 && c.finReceived {
+		return true
+	}
+	return c.closed && now.Sub(c.closedAt) > lingerTimeout
+}
+
+// input handles a segment received from the peer.
+func (c *Conn) input(seg *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if seg.flags&flagRST != 0 {
+		c.fail(ErrReset)
+		return
+	}
+
+	c.rwnd = seg.wnd
+	c.handleAck(seg.ack)
+
+	if seg.flags&flagACK != 0 {
+		// a pure ack carries the highest sequence number the peer has received
+		if before(c.peerHighest, seg.seq) && before(seg.seq, c.sndNext) {
+			c.peerHighest = seg.seq
+			c.wake()
+		}
+		return
+	}
+
+	if !before(seg.seq, c.rcvHighest) {
+		c.rcvHighest = seg.seq
+	}
+
+	// acknowledge every segment, including duplicates whose ack may have been lost
+	c.ackPending = true
+	c.wake()
+
+	if seg.seq == c.rcvNext {
+		c.deliver(seg)
+		for {
+			next, ok := c.outOfOrder[c.rcvNext]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.rcvNext)
+			c.deliver(next)
+		}
+	} else if before(c.rcvNext, seg.seq) && seg.seq-c.rcvNext < maxRecvSegments {
+		seg.data = append([]byte(nil), seg.data...)
+		c.outOfOrder[seg.seq] = seg
+	}
+}
+
+// deliver consumes the next segment in order. The caller must hold c.mu.
+func (c *Conn) deliver(seg *segment) {
+	c.rcvNext++
+	c.established = true
+	if len(seg.data) > 0 {
+		c.readBuf.Write(seg.data)
+	}
+	if seg.flags&flagFIN != 0 {
+		c.finReceived = true
+	}
+}
+
+// handleAck removes acknowledged segments and adjusts the congestion window.
+// The caller must hold c.mu.
+func (c *Conn) handleAck(ack uint32) {
+	if before(c.sndUna, ack) && !before(c.sndNext, ack) {
+		now := time.Now()
+		for len(c.unacked) > 0 && before(c.unacked[0].seg.seq, ack) {
+			o := c.unacked[0]
+			c.unacked = c.unacked[1:]
+			// only sample segments sent once so retransmissions don't skew the estimate
+			if o.retries == 0 && o.sent {
+				c.updateRTO(now.Sub(o.sentAt))
+			}
+			if c.cwnd < c.ssthresh {
+				c.cwnd++
+			} else {
+				c.cwnd += 1 / c.cwnd
+			}
+		}
+		c.sndUna = ack
+		c.established = true
+		if c.recovering && !before(ack, c.recover) {
+			c.recovering = false
+		}
+		c.wake()
+	}
+}
+
+// enterRecovery reduces the congestion window once per loss event rather
+// than once per lost segment. The caller must hold c.mu.
+func (c *Conn) enterRecovery() {
+	if c.recovering {
+		return
+	}
+	c.recovering = true
+	c.recover = c.sndNext
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < 2 {
+		c.ssthresh = 2
+	}
+	c.cwnd = c.ssthresh
+}
+
+// updateRTO updates the retransmission timeout as in RFC 6298. The caller must hold c.mu.
+func (c *Conn) updateRTO(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		diff := c.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// fail ends the stream with an error. The caller must hold c.mu.
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.wake()
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.readBuf.Len() == 0 {
+		switch {
+		case c.finReceived:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.closed:
+			return 0, net.ErrClosed
+		case !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	wasFull := c.window() == 0
+	n, _ := c.readBuf.Read(b)
+	if wasFull && c.window() > 0 {
+		// tell the peer the window has opened again
+		c.ackPending = true
+		c.wake()
+	}
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		for len(c.unacked) >= maxSendSegments {
+			switch {
+			case c.err != nil:
+				return written, c.err
+			case c.closed:
+				return written, net.ErrClosed
+			case !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline):
+				return written, os.ErrDeadlineExceeded
+			}
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.finSent {
+			return written, net.ErrClosed
+		}
+
+		n := len(b) - written
+		if n > c.transport.mss {
+			n = c.transport.mss
+		}
+		c.queue(0, append([]byte(nil), b[written:written+n]...))
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN after everything written so far. The peer reads
+// io.EOF once it has received all of it, and may keep sending.
+func (c *Conn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeWrite()
+	return nil
+}
+
+// closeWrite queues a FIN unless one was already sent. The caller must hold c.mu.
+func (c *Conn) closeWrite() {
+	if c.finSent || c.err != nil {
+		return
+	}
+	c.finSent = true
+	c.queue(flagFIN, nil)
+	c.cond.Broadcast()
+}
+
+// Close closes both directions. The stream is released once the peer has
+// acknowledged everything and closed its side, or after a linger timeout.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	c.closeWrite()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.transport.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.broadcastAt(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.broadcastAt(t)
+	return nil
+}
+
+// broadcastAt wakes blocked readers and writers when a deadline passes.
+func (c *Conn) broadcastAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
+
+// waitEstablished waits until the peer has acknowledged the SYN.
+func (c *Conn) waitEstablished(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	c.broadcastAt(deadline)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.established {
+		if c.err != nil {
+			return c.err
+		}
+		if !time.Now().Before(deadline) {
+			c.fail(ErrTimedOut)
+			return ErrTimedOut
+		}
+		c.cond.Wait()
+	}
+	return nil
+}
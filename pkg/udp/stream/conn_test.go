@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestConn returns a stream with two data segments in flight, of which
+// the peer has received the second but not the first. The returned time is
+// when they were sent. The caller must release c.mu.
+func newTestConn(t *testing.T) (*Conn, time.Time) {
+	t.Helper()
+	a, b := newLossyPair(1, 0, 1)
+	transport, err := NewTransport(TransportOpts{Conn: a, Cipher: newTestCipher(t)})
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	t.Cleanup(func() { transport.Close() })
+
+	c := newConn(transport, 1, b.addr)
+	t.Cleanup(func() {
+		c.mu.Lock()
+		c.fail(net.ErrClosed)
+		c.mu.Unlock()
+	})
+	c.mu.Lock()
+	c.established = true
+	c.queue(0, []byte("first"))
+	c.queue(0, []byte("second"))
+	now := time.Now()
+	c.flush(now)
+	c.peerHighest = c.unacked[1].seg.seq
+	return c, now
+}
+
+func TestFastRetransmitWithoutRTTSample(t *testing.T) {
+	c, sent := newTestConn(t)
+	defer c.mu.Unlock()
+
+	// without a round trip sample, only the timeout retransmits
+	for now := sent; now.Sub(sent) < c.rto; now = now.Add(tickInterval) {
+		if c.flush(now) {
+			t.Fatalf("stream finished after %s", now.Sub(sent))
+		}
+	}
+	if retries := c.unacked[0].retries; retries != 0 {
+		t.Fatalf("retransmitted %d times before the timeout", retries)
+	}
+}
+
+func TestFastRetransmit(t *testing.T) {
+	c, sent := newTestConn(t)
+	defer c.mu.Unlock()
+
+	c.srtt = time.Millisecond * 20
+	c.flush(sent.Add(time.Millisecond * 30))
+	if retries := c.unacked[0].retries; retries != 1 {
+		t.Fatalf("retransmitted %d times, want 1", retries)
+	}
+	if retries := c.unacked[1].retries; retries != 0 {
+		t.Fatalf("retransmitted the received segment %d times", retries)
+	}
+	if !c.recovering {
+		t.Fatal("expected the stream to be recovering from the loss")
+	}
+}
+
+func TestFastRetransmitMaxRetries(t *testing.T) {
+	c, sent := newTestConn(t)
+	defer c.mu.Unlock()
+
+	c.srtt = time.Millisecond
+	now := sent
+	for i := 0; i < maxRetries; i++ {
+		now = now.Add(time.Millisecond * 10)
+		if c.flush(now) {
+			t.Fatalf("stream finished after %d retries", i+1)
+		}
+	}
+	now = now.Add(time.Millisecond * 10)
+	if !c.flush(now) {
+		t.Fatal("expected the stream to finish after too many retries")
+	}
+	if c.err != ErrTimedOut {
+		t.Fatalf("got %v, want ErrTimedOut", c.err)
+	}
+}
+
+func TestRetransmitTimeout(t *testing.T) {
+	c, sent := newTestConn(t)
+	defer c.mu.Unlock()
+
+	// the peer has received neither segment
+	c.peerHighest = c.unacked[0].seg.seq
+	rto := c.rto
+	c.flush(sent.Add(rto + time.Millisecond))
+	for i, o := range c.unacked {
+		if o.retries != 1 {
+			t.Fatalf("segment %d retransmitted %d times, want 1", i, o.retries)
+		}
+	}
+	if c.rto != rto*2 {
+		t.Fatalf("timeout is %s after a loss, want %s", c.rto, rto*2)
+	}
+	if c.cwnd != 1 {
+		t.Fatalf("congestion window is %v after a loss, want 1", c.cwnd)
+	}
+}
+
+func TestUpdateRTO(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{"first sample", []time.Duration{time.Millisecond * 100}, time.Millisecond * 300},
+		{"floor", []time.Duration{time.Millisecond}, minRTO},
+		{"ceiling", []time.Duration{time.Second * 5}, maxRTO},
+		{"steady", []time.Duration{time.Millisecond * 100, time.Millisecond * 100}, time.Millisecond * 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conn{rto: time.Second}
+			for _, rtt := range tt.samples {
+				c.updateRTO(rtt)
+			}
+			if c.rto != tt.want {
+				t.Fatalf("got %s, want %s", c.rto, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	flagSYN byte = 1 << iota
+	flagFIN
+	flagRST
+	// flagACK marks a segment that only acknowledges. Its seq field holds the
+	// highest sequence number received rather than one of its own.
+	flagACK
+)
+
+// Every segment starts with a header of
+// flags (1 byte) | stream id (4 bytes) | seq (4 bytes) | ack (4 bytes) | window (2 bytes)
+const headerSize = 15
+
+// segment is the unit of the ARQ. Each SYN, FIN or data segment takes one
+// sequence number and is retransmitted until it is acknowledged.
+type segment struct {
+	flags  byte
+	stream uint32
+	seq    uint32
+	ack    uint32
+	wnd    uint16
+	data   []byte
+}
+
+func (s *segment) marshal() []byte {
+	b := make([]byte, headerSize+len(s.data))
+	b[0] = s.flags
+	binary.BigEndian.PutUint32(b[1:5], s.stream)
+	binary.BigEndian.PutUint32(b[5:9], s.seq)
+	binary.BigEndian.PutUint32(b[9:13], s.ack)
+	binary.BigEndian.PutUint16(b[13:15], s.wnd)
+	copy(b[headerSize:], s.data)
+	return b
+}
+
+func unmarshal(b []byte) (*segment, error) {
+	if len(b) < headerSize {
+		return nil, errors.New("segment too short")
+	}
+	return &segment{
+		flags:  b[0],
+		stream: binary.BigEndian.Uint32(b[1:5]),
+		seq:    binary.BigEndian.Uint32(b[5:9]),
+		ack:    binary.BigEndian.Uint32(b[9:13]),
+		wnd:    binary.BigEndian.Uint16(b[13:15]),
+		data:   b[headerSize:],
+	}, nil
+}
+
+// before reports whether sequence number a comes before b, allowing for wrap around.
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSegmentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		seg  segment
+	}{
+		{"syn", segment{flags: flagSYN, stream: 7, seq: 1}},
+		{"data", segment{stream: 7, seq: 2, ack: 9, wnd: 512, data: []byte("hello")}},
+		{"fin", segment{flags: flagFIN, stream: 7, seq: 3, ack: 10, wnd: 511}},
+		{"ack", segment{flags: flagACK, stream: 7, seq: 42, ack: 43, wnd: 0}},
+		{"reset", segment{flags: flagRST | flagACK, stream: 0xffffffff}},
+		{"largest numbers", segment{stream: 0xffffffff, seq: 0xffffffff, ack: 0xffffffff, wnd: 0xffff, data: []byte{0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.seg.marshal()
+			if len(b) != headerSize+len(tt.seg.data) {
+				t.Fatalf("marshaled %d bytes, want %d", len(b), headerSize+len(tt.seg.data))
+			}
+			got, err := unmarshal(b)
+			if err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if got.flags != tt.seg.flags || got.stream != tt.seg.stream || got.seq != tt.seg.seq ||
+				got.ack != tt.seg.ack || got.wnd != tt.seg.wnd || !bytes.Equal(got.data, tt.seg.data) {
+				t.Fatalf("got %+v, want %+v", *got, tt.seg)
+			}
+		})
+	}
+}
+
+func TestUnmarshalShort(t *testing.T) {
+	if _, err := unmarshal(make([]byte, headerSize-1)); err == nil {
+		t.Fatal("expected an error for a segment shorter than the header")
+	}
+}
+
+func TestBefore(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xffffffff, 0, true},
+		{0, 0xffffffff, false},
+		{0xfffffff0, 0x10, true},
+	}
+	for _, tt := range tests {
+		if got := before(tt.a, tt.b); got != tt.want {
+			t.Errorf("before(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
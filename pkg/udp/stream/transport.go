@@ -0,0 +1,218 @@
+package stream
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/crypto"
+)
+
+// Transport multiplexes reliable streams over a datagram socket. Every
+// datagram is encrypted, so a transport can share its socket with other
+// traffic as long as that traffic is handled before calling Input.
+type Transport struct {
+	conn        net.PacketConn
+	cipher      crypto.Cipher
+	mss         int
+	dialTimeout time.Duration
+	debug       bool
+	mu          sync.Mutex
+	streams     map[string]*Conn
+	acceptChan  chan *Conn
+	nextID      uint32
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type TransportOpts struct {
+	Conn            net.PacketConn
+	Cipher          crypto.Cipher
+	MaxDatagramSize uint
+	DialTimeout     time.Duration
+	Debug           bool
+}
+
+func NewTransport(opts TransportOpts) (*Transport, error) {
+	maxDatagramSize := int(opts.MaxDatagramSize)
+	if maxDatagramSize == 0 {
+		maxDatagramSize = 1400
+	}
+	mss := maxDatagramSize - headerSize - opts.Cipher.Overhead()
+	if mss <= 0 {
+		return nil, fmt.Errorf("maximum datagram size of %d is too small", maxDatagramSize)
+	}
+
+	dialTimeout := opts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = time.Second * 5
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &Transport{
+		conn:        opts.Conn,
+		cipher:      opts.Cipher,
+		mss:         mss,
+		dialTimeout: dialTimeout,
+		debug:       opts.Debug,
+		streams:     make(map[string]*Conn),
+		acceptChan:  make(chan *Conn, 64),
+		nextID:      binary.BigEndian.Uint32(b),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+func streamKey(remote net.Addr, id uint32) string {
+	return fmt.Sprintf("%s/%d", remote.String(), id)
+}
+
+// Serve reads datagrams from the socket until the transport is closed.
+// Use it when the transport owns the socket, otherwise feed datagrams to Input.
+func (t *Transport) Serve() error {
+	buffer := make([]byte, 65535)
+	for {
+		n, remote, err := t.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-t.done:
+				return nil
+			default:
+				return fmt.Errorf("failed to read from socket: %s", err.Error())
+			}
+		}
+		if err := t.Input(remote, buffer[:n]); err != nil && t.debug {
+			log.Printf("[STREAM] dropped datagram from %s: %s\n", remote.String(), err.Error())
+		}
+	}
+}
+
+// Input handles a datagram received from remote.
+func (t *Transport) Input(remote net.Addr, datagram []byte) error {
+	plaintext, err := t.cipher.Decrypt(datagram)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt: %s", err.Error())
+	}
+	seg, err := unmarshal(plaintext)
+	if err != nil {
+		return err
+	}
+
+	key := streamKey(remote, seg.stream)
+
+	t.mu.Lock()
+	c, ok := t.streams[key]
+	if !ok {
+		if seg.flags&flagSYN == 0 {
+			t.mu.Unlock()
+			if seg.flags&flagRST == 0 {
+				t.write(&segment{flags: flagRST | flagACK, stream: seg.stream}, remote)
+			}
+			return fmt.Errorf("unknown stream %d", seg.stream)
+		}
+		select {
+		case <-t.done:
+			t.mu.Unlock()
+			return errors.New("transport closed")
+		default:
+		}
+		c = newConn(t, seg.stream, remote)
+		select {
+		case t.acceptChan <- c:
+			t.streams[key] = c
+		default:
+			t.mu.Unlock()
+			c.mu.Lock()
+			c.fail(errors.New("accept queue full"))
+			c.mu.Unlock()
+			return errors.New("accept queue full")
+		}
+		if t.debug {
+			log.Printf("[STREAM] accepted stream %d from %s\n", seg.stream, remote.String())
+		}
+	}
+	t.mu.Unlock()
+
+	c.input(seg)
+	return nil
+}
+
+// Dial opens a stream to remote and waits for it to be acknowledged.
+func (t *Transport) Dial(remote net.Addr) (*Conn, error) {
+	id := atomic.AddUint32(&t.nextID, 1)
+
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	c := newConn(t, id, remote)
+	t.streams[streamKey(remote, id)] = c
+	c.mu.Lock()
+	c.queue(flagSYN, nil)
+	c.mu.Unlock()
+	t.mu.Unlock()
+
+	if err := c.waitEstablished(t.dialTimeout); err != nil {
+		return nil, fmt.Errorf("failed to open stream to %s: %s", remote.String(), err.Error())
+	}
+	if t.debug {
+		log.Printf("[STREAM] opened stream %d to %s\n", id, remote.String())
+	}
+	return c, nil
+}
+
+// Accept waits for a stream opened by a peer.
+func (t *Transport) Accept() (*Conn, error) {
+	select {
+	case c := <-t.acceptChan:
+		return c, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close resets every open stream. The socket belongs to the caller and is
+// left open, closing it is what makes Serve return.
+func (t *Transport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.mu.Lock()
+		for _, c := range t.streams {
+			t.write(&segment{flags: flagRST | flagACK, stream: c.id}, c.remote)
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+		t.mu.Unlock()
+	})
+	return nil
+}
+
+func (t *Transport) remove(c *Conn) {
+	t.mu.Lock()
+	delete(t.streams, streamKey(c.remote, c.id))
+	t.mu.Unlock()
+}
+
+func (t *Transport) write(seg *segment, remote net.Addr) {
+	datagram, err := t.cipher.Encrypt(seg.marshal())
+	if err != nil {
+		log.Printf("[STREAM] failed to encrypt segment: %s\n", err.Error())
+		return
+	}
+	if _, err := t.conn.WriteTo(datagram, remote); err != nil && t.debug {
+		log.Printf("[STREAM] failed to write to %s: %s\n", remote.String(), err.Error())
+	}
+}
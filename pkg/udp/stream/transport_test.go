@@ -0,0 +1,279 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/crypto"
+)
+
+// lossyAddr names one end of a lossy link.
+type lossyAddr string
+
+func (a lossyAddr) Network() string { return "lossy" }
+func (a lossyAddr) String() string  { return string(a) }
+
+type datagram struct {
+	b    []byte
+	from net.Addr
+}
+
+// lossyLink connects two packet conns in memory, dropping a share of the
+// datagrams and delaying the rest by a random amount, which reorders them.
+type lossyLink struct {
+	loss     float64
+	maxDelay time.Duration
+	mu       sync.Mutex
+	rand     *mathrand.Rand
+}
+
+// lossyConn is one end of a lossy link.
+type lossyConn struct {
+	link  *lossyLink
+	addr  lossyAddr
+	peer  *lossyConn
+	inbox chan datagram
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newLossyPair(loss float64, maxDelay time.Duration, seed int64) (*lossyConn, *lossyConn) {
+	link := &lossyLink{loss: loss, maxDelay: maxDelay, rand: mathrand.New(mathrand.NewSource(seed))}
+	a := &lossyConn{link: link, addr: "a", inbox: make(chan datagram, 1024), done: make(chan struct{})}
+	b := &lossyConn{link: link, addr: "b", inbox: make(chan datagram, 1024), done: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.link.mu.Lock()
+	dropped := c.link.rand.Float64() < c.link.loss
+	var delay time.Duration
+	if c.link.maxDelay > 0 {
+		delay = time.Duration(c.link.rand.Int63n(int64(c.link.maxDelay)))
+	}
+	c.link.mu.Unlock()
+	if dropped {
+		return len(b), nil
+	}
+
+	d := datagram{b: append([]byte(nil), b...), from: c.addr}
+	time.AfterFunc(delay, func() {
+		select {
+		case c.peer.inbox <- d:
+		case <-c.peer.done:
+		default:
+			// a full inbox drops like a full socket buffer
+		}
+	})
+	return len(b), nil
+}
+
+func (c *lossyConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.inbox:
+		return copy(b, d.b), d.from, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *lossyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *lossyConn) LocalAddr() net.Addr                { return c.addr }
+func (c *lossyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *lossyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *lossyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newTestCipher(t *testing.T) crypto.Cipher {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	cipher, err := crypto.NewAESCipher(crypto.AESCipherOpts{Key: key})
+	if err != nil {
+		t.Fatalf("NewAESCipher: %v", err)
+	}
+	return cipher
+}
+
+// newTestTransports serves a transport on each end of a packet conn pair.
+func newTestTransports(t *testing.T, a, b net.PacketConn) (*Transport, *Transport) {
+	t.Helper()
+	cipher := newTestCipher(t)
+	transports := make([]*Transport, 2)
+	for i, conn := range []net.PacketConn{a, b} {
+		transport, err := NewTransport(TransportOpts{Conn: conn, Cipher: cipher, MaxDatagramSize: 512})
+		if err != nil {
+			t.Fatalf("NewTransport: %v", err)
+		}
+		go transport.Serve()
+		transports[i] = transport
+		conn := conn
+		t.Cleanup(func() {
+			transport.Close()
+			conn.Close()
+		})
+	}
+	return transports[0], transports[1]
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		loss     float64
+		maxDelay time.Duration
+		size     int
+	}{
+		{"clean", 0, 0, 256 * 1024},
+		{"reordered", 0, time.Millisecond * 5, 128 * 1024},
+		{"lossy", 0.1, 0, 64 * 1024},
+		{"lossy and reordered", 0.1, time.Millisecond * 5, 64 * 1024},
+		{"very lossy", 0.2, time.Millisecond * 2, 4 * 1024},
+		{"empty", 0.1, time.Millisecond * 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newLossyPair(tt.loss, tt.maxDelay, 1)
+			client, server := newTestTransports(t, a, b)
+
+			// the server echoes what it reads until the client closes its side
+			echoErr := make(chan error, 1)
+			go func() {
+				conn, err := server.Accept()
+				if err != nil {
+					echoErr <- err
+					return
+				}
+				defer conn.Close()
+				data, err := io.ReadAll(conn)
+				if err != nil {
+					echoErr <- err
+					return
+				}
+				_, err = conn.Write(data)
+				echoErr <- err
+			}()
+
+			conn, err := client.Dial(b.addr)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+
+			message := make([]byte, tt.size)
+			rand.Read(message)
+			if _, err := conn.Write(message); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := conn.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite: %v", err)
+			}
+
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if err := <-echoErr; err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+			if !bytes.Equal(got, message) {
+				t.Fatalf("echoed %d bytes, want %d", len(got), len(message))
+			}
+		})
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// everything is dropped, so the SYN is never acknowledged
+	a, b := newLossyPair(1, 0, 1)
+	cipher := newTestCipher(t)
+	transport, err := NewTransport(TransportOpts{Conn: a, Cipher: cipher, DialTimeout: time.Millisecond * 100})
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	defer transport.Close()
+
+	if _, err := transport.Dial(b.addr); err == nil {
+		t.Fatal("expected the dial to time out")
+	}
+}
+
+func TestReset(t *testing.T) {
+	a, b := newLossyPair(0, 0, 1)
+	client, server := newTestTransports(t, a, b)
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := client.Dial(b.addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	<-accepted
+
+	// closing the server's transport resets its streams
+	server.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrReset) {
+		t.Fatalf("got %v, want ErrReset", err)
+	}
+}
+
+func TestUnknownStream(t *testing.T) {
+	a, b := newLossyPair(0, 0, 1)
+	cipher := newTestCipher(t)
+	transport, err := NewTransport(TransportOpts{Conn: a, Cipher: cipher})
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	defer transport.Close()
+
+	// data for a stream that was never opened is answered with a reset
+	datagram, err := cipher.Encrypt((&segment{stream: 9, seq: 1, data: []byte("x")}).marshal())
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if err := transport.Input(b.addr, datagram); err == nil {
+		t.Fatal("expected an error for an unknown stream")
+	}
+
+	buffer := make([]byte, 1500)
+	n, _, err := b.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	plaintext, err := cipher.Decrypt(buffer[:n])
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	seg, err := unmarshal(plaintext)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if seg.flags&flagRST == 0 || seg.stream != 9 {
+		t.Fatalf("got flags %#x for stream %d, want a reset of stream 9", seg.flags, seg.stream)
+	}
+}
@@ -0,0 +1,208 @@
+package upstream
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cbodonnell/net/pkg/httpproxy"
+	"github.com/cbodonnell/net/pkg/socks"
+	"github.com/cbodonnell/net/pkg/websocket"
+)
+
+// handshakeTimeout is how long a proxy has to connect to the relay, and the
+// relay has to accept a WebSocket.
+const handshakeTimeout = time.Second * 10
+
+// Dialer connects agents to the relay, through an HTTP or SOCKS5 proxy when
+// one is configured. Without one, it uses the proxy in HTTPS_PROXY or
+// ALL_PROXY from the environment, and addresses matching NO_PROXY are
+// always dialed directly.
+type Dialer struct {
+	proxy   *url.URL
+	noProxy []string
+	debug   bool
+}
+
+type DialerOpts struct {
+	Proxy string
+	Debug bool
+}
+
+func NewDialer(opts DialerOpts) (*Dialer, error) {
+	spec := opts.Proxy
+	if spec == "" {
+		spec = getenv("HTTPS_PROXY", "ALL_PROXY")
+	}
+
+	d := &Dialer{debug: opts.Debug}
+	for _, entry := range strings.Split(getenv("NO_PROXY"), ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			d.noProxy = append(d.noProxy, entry)
+		}
+	}
+	if spec == "" {
+		return d, nil
+	}
+
+	// a proxy without a scheme is an HTTP proxy
+	if !strings.Contains(spec, "://") {
+		spec = "http://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %s", spec, err.Error())
+	}
+	switch u.Scheme {
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "socks5", "socks5h":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	d.proxy = u
+	return d, nil
+}
+
+// getenv returns the first of the variables that is set, in upper or
+// lower case.
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		if v := os.Getenv(strings.ToLower(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Dial connects to a relay at a host:port, or at a ws:// or wss:// URL
+// over a WebSocket, through the proxy unless it is bypassed.
+func (d *Dialer) Dial(address string) (net.Conn, error) {
+	if !strings.HasPrefix(address, "ws://") && !strings.HasPrefix(address, "wss://") {
+		return d.dial(address)
+	}
+
+	location, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %s: %s", address, err.Error())
+	}
+	conn, err := d.dial(websocket.Address(location))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	wsConn, err := websocket.Client(conn, location)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return wsConn, nil
+}
+
+func (d *Dialer) dial(address string) (net.Conn, error) {
+	if d.proxy == nil || d.bypass(address) {
+		return net.Dial("tcp", address)
+	}
+
+	if d.debug {
+		log.Printf("Connecting to %s through %s\n", address, d.proxy.Redacted())
+	}
+	conn, err := net.DialTimeout("tcp", d.proxy.Host, handshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy: %s", err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	username := d.proxy.User.Username()
+	password, _ := d.proxy.User.Password()
+	switch d.proxy.Scheme {
+	case "http":
+		var tunnel net.Conn
+		if tunnel, err = httpproxy.Connect(conn, address, username, password); err == nil {
+			conn = tunnel
+		}
+	case "socks5":
+		// socks5 resolves the relay locally, and socks5h leaves it to the proxy
+		var target string
+		if target, err = resolve(address); err == nil {
+			err = socks.Connect(conn, target, username, password)
+		}
+	case "socks5h":
+		err = socks.Connect(conn, address, username, password)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func resolve(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// bypass reports whether an address matches NO_PROXY. Each entry is *, a
+// domain that matches itself and its subdomains, an address or a CIDR
+// range, with an optional port.
+func (d *Dialer) bypass(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, entry := range d.noProxy {
+		if entry == "*" {
+			return true
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
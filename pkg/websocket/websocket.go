@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	ws "golang.org/x/net/websocket"
+)
+
+// Agents that can only reach the relay over HTTP carry their usual
+// connection to it inside a WebSocket, one connection per WebSocket, with
+// each write sent as a binary message. The relay can sit behind an HTTP
+// reverse proxy that terminates TLS, or serve wss itself.
+
+// Conn is a WebSocket used as a connection. Its addresses are those of the
+// connection it was started on, rather than the URL and origin.
+type Conn struct {
+	*ws.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Address returns the host:port to connect to for a ws:// or wss:// URL.
+func Address(location *url.URL) string {
+	if location.Port() != "" {
+		return location.Host
+	}
+	if location.Scheme == "wss" {
+		return net.JoinHostPort(location.Hostname(), "443")
+	}
+	return net.JoinHostPort(location.Hostname(), "80")
+}
+
+// Client starts a WebSocket to a ws:// or wss:// URL on a connection to its
+// host, first starting TLS for wss.
+func Client(conn net.Conn, location *url.URL) (*Conn, error) {
+	origin := &url.URL{Scheme: "http", Host: location.Host}
+	var rwc net.Conn = conn
+	switch location.Scheme {
+	case "ws":
+	case "wss":
+		origin.Scheme = "https"
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: location.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("error starting TLS: %s", err.Error())
+		}
+		rwc = tlsConn
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket scheme: %s", location.Scheme)
+	}
+
+	config, err := ws.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	c, err := ws.NewClient(config, rwc)
+	if err != nil {
+		return nil, fmt.Errorf("error starting WebSocket: %s", err.Error())
+	}
+	c.PayloadType = ws.BinaryFrame
+	return &Conn{Conn: c, remote: conn.RemoteAddr(), local: conn.LocalAddr()}, nil
+}
+
+// Handler upgrades requests to WebSockets and passes them to handle, which
+// owns the connection until it returns.
+func Handler(handle func(conn net.Conn)) http.Handler {
+	return ws.Server{
+		// agents aren't browsers, so there is no origin to check
+		Handshake: func(*ws.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(c *ws.Conn) {
+			c.PayloadType = ws.BinaryFrame
+			conn := &Conn{Conn: c, remote: c.RemoteAddr(), local: c.LocalAddr()}
+			req := c.Request()
+			if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+				conn.remote = addr
+			}
+			if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				conn.local = addr
+			}
+			handle(conn)
+		},
+	}
+}